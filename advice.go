@@ -0,0 +1,128 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// adviceMinMargin is the least that a client's idle timeout should be below the
+// server's, to allow for the server's close taking time to reach the client.
+const adviceMinMargin = time.Second
+
+// goDefaultIdleConnTimeout is http.DefaultTransport's IdleConnTimeout.
+const goDefaultIdleConnTimeout = 90 * time.Second
+
+// poolAdvice is recommended Go http.Transport settings for a client of the server.
+type poolAdvice struct {
+	SchemaVersion int `json:"schemaVersion"`
+	// IdleConnTimeout is empty if keep-alives should be disabled
+	IdleConnTimeout     string   `json:"idleConnTimeout,omitempty"`
+	DisableKeepAlives   bool     `json:"disableKeepAlives,omitempty"`
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost,omitempty"`
+	Reasons             []string `json:"reasons"`
+	// ServerIdleTimeout is the server's idle timeout that the advice is from, if it
+	// was bracketed, and Margin is how far from it the timeout could be
+	ServerIdleTimeout string `json:"serverIdleTimeout,omitempty"`
+	Margin            string `json:"margin,omitempty"`
+	// LowConfidence is set if the bracket is from single probes (see idleBracket)
+	LowConfidence bool `json:"lowConfidence,omitempty"`
+	// Run is set when the advice is written out, to record where it came from
+	Run *runMetadata `json:"run,omitempty"`
+}
+
+// idleTimeoutAdvice recommends an IdleConnTimeout that avoids the race where the
+// server closes an idle connection just as the client reuses it, given that
+// connections idle for shortest are known to have been closed (zero if none were)
+// and alive are known to have survived.
+func idleTimeoutAdvice(alive, shortest time.Duration) poolAdvice {
+	var a poolAdvice
+	switch {
+	case shortest == 0:
+		// No server timeout was seen, so the client's own timeout is the only limit
+		timeout := goDefaultIdleConnTimeout
+		if alive < timeout {
+			timeout = alive
+		}
+		a.IdleConnTimeout = timeout.String()
+		a.Reasons = append(a.Reasons, fmt.Sprintf("no server idle timeout was seen up to %v, so the client's timeout is safe up to there", alive))
+	default:
+		known := alive
+		if known == 0 || known > shortest {
+			known = shortest
+		}
+		margin := known / 10
+		if margin < adviceMinMargin {
+			margin = adviceMinMargin
+		}
+		if known <= margin {
+			a.DisableKeepAlives = true
+			a.Reasons = append(a.Reasons, fmt.Sprintf("the server closes idle connections after %v or less, which is too short to reuse them safely", known))
+			break
+		}
+		// A round number is easier to put in a config
+		timeout := (known - margin).Truncate(100 * time.Millisecond)
+		if timeout >= 10*time.Second {
+			timeout = timeout.Truncate(time.Second)
+		}
+		a.IdleConnTimeout = timeout.String()
+		a.Reasons = append(a.Reasons, fmt.Sprintf("the server closes idle connections after ~%v; staying %v under that avoids reusing a connection the server is closing", known, known-timeout))
+		if timeout < goDefaultIdleConnTimeout {
+			a.Reasons = append(a.Reasons, fmt.Sprintf("Go's default of %v is too long: expect \"server closed idle connection\" errors with it", goDefaultIdleConnTimeout))
+		}
+	}
+	return a
+}
+
+// addBracket records the idle timeout bracket that a was from, if both its ends were
+// found.
+func (a *poolAdvice) addBracket(b idleBracket) {
+	mid, margin, ok := b.estimate()
+	if !ok {
+		return
+	}
+	a.ServerIdleTimeout = mid.String()
+	a.Margin = margin.String()
+	a.LowConfidence = b.lowConfidence()
+	if a.LowConfidence {
+		a.Reasons = append(a.Reasons, fmt.Sprintf("the server's idle timeout of ~%v ±%v is from one probe per gap, so it's low confidence; Watch runs narrow it", mid, margin))
+	}
+}
+
+// printAdvice prints the advice, and writes it as JSON to params' AdviceFile if
+// that's set (uploading it too, if Upload is set).
+func printAdvice(a poolAdvice, params testParams) {
+	fmt.Println(cyan("recommended Go http.Transport settings for clients:"))
+	if a.DisableKeepAlives {
+		fmt.Println(cyan("  DisableKeepAlives: true"))
+	} else {
+		fmt.Println(cyan("  IdleConnTimeout: " + a.IdleConnTimeout))
+	}
+	if a.MaxIdleConnsPerHost != 0 {
+		fmt.Println(cyan(fmt.Sprintf("  MaxIdleConnsPerHost: %d", a.MaxIdleConnsPerHost)))
+	}
+	for _, r := range a.Reasons {
+		fmt.Println("  - " + r)
+	}
+
+	filename := params.adviceFile
+	if filename == "" {
+		return
+	}
+	a.SchemaVersion = reportSchemaVersion
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filename, append(b, '\n'), 0o644)
+	}
+	if err != nil {
+		fmt.Println(red("failed to write advice:"), err)
+	} else {
+		fmt.Printf(cyan("advice written to %s\n"), filename)
+		if params.uploadURI != "" {
+			uploadResult(params.uploadURI, filename, params.host)
+		}
+	}
+}
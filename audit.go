@@ -0,0 +1,754 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// auditFinding is the result of one audit probe.
+type auditFinding struct {
+	probe string
+	// topic is what explains the result, for -explain
+	topic string
+	// outcome describes what the server did
+	outcome string
+	// after is how long into the probe the server acted; zero if it didn't
+	after time.Duration
+	err   error
+	// margin is set if after is the top of a bracket, to how far the timeout could be
+	// from the bracket's middle (after-margin); lowConfidence is set if that's uncertain
+	margin        time.Duration
+	lowConfidence bool
+
+	// accepted is set by the header size probe if the headers were accepted
+	accepted bool
+
+	// expected is the expected value of after, if hasExpected is set; zero means
+	// no timeout is expected
+	expected time.Duration
+	// expectedFrom is the server config directive that expected came from, if any
+	expectedFrom string
+	// expectedAtLeast is set if expected is only a minimum
+	expectedAtLeast bool
+	hasExpected     bool
+	metExpected     bool
+
+	severity string
+	// note explains the severity, if there's anything to say
+	note string
+}
+
+// Severities of audit findings, from most to least severe.
+const (
+	severityHigh   = "HIGH"
+	severityMedium = "MEDIUM"
+	severityLow    = "LOW"
+	severityInfo   = "INFO"
+)
+
+// auditThresholds are the limits that findings are graded against.
+type auditThresholds struct {
+	// maxReadTimeout is the longest a request read timeout can be before it's a concern
+	maxReadTimeout time.Duration
+	// maxIdleTimeout is the longest an idle timeout can be before it's a concern
+	maxIdleTimeout time.Duration
+}
+
+// auditProbe is one of the probes in an audit.
+type auditProbe struct {
+	name  string
+	run   func(params testParams, bound time.Duration) auditFinding
+	grade func(f auditFinding, th auditThresholds) (severity, note string)
+	// topic is what explains the probe's result, for -explain
+	topic string
+}
+
+var auditProbes = []auditProbe{
+	{"header read timeout", auditSlowHeaders, gradeReadTimeout("slowloris risk"), explainHeaderRead},
+	{"body read timeout", auditSlowBody, gradeReadTimeout("slow-body (R-U-Dead-Yet) risk"), explainBodyRead},
+	{"response write timeout", auditStalledRead, gradeWriteTimeout, explainStalledReader},
+	{"idle timeout", auditIdle, gradeIdleTimeout, explainIdle},
+	{"max header size", auditOversizedHeaders, gradeHeaderSize, explainHeaderSize},
+}
+
+// gradeReadTimeout grades how long the server waits for a stalled request.
+func gradeReadTimeout(risk string) func(f auditFinding, th auditThresholds) (string, string) {
+	return func(f auditFinding, th auditThresholds) (string, string) {
+		switch {
+		case f.after == 0:
+			return severityHigh, "no timeout detected: " + risk
+		case f.after > th.maxReadTimeout:
+			return severityMedium, fmt.Sprintf("longer than %v: %s", th.maxReadTimeout, risk)
+		default:
+			return severityInfo, ""
+		}
+	}
+}
+
+func gradeWriteTimeout(f auditFinding, th auditThresholds) (string, string) {
+	if f.after == 0 {
+		// Not seeing one usually means the response was too small to tell
+		return severityLow, "no timeout detected for a client that stops reading"
+	}
+	return severityInfo, ""
+}
+
+func gradeIdleTimeout(f auditFinding, th auditThresholds) (string, string) {
+	switch {
+	case f.after == 0:
+		return severityMedium, "no idle timeout detected: idle connections are held indefinitely"
+	case f.after > th.maxIdleTimeout:
+		return severityLow, fmt.Sprintf("longer than %v: idle connections tie up server resources", th.maxIdleTimeout)
+	default:
+		return severityInfo, ""
+	}
+}
+
+func gradeHeaderSize(f auditFinding, th auditThresholds) (string, string) {
+	if f.accepted {
+		return severityMedium, "more than 1MB of headers accepted"
+	}
+	return severityInfo, ""
+}
+
+// auditTarget is an endpoint to audit, with any per-target settings.
+type auditTarget struct {
+	host string
+	path string
+	// serverName overrides the TLS SNI, if set
+	serverName string
+	// dialHost is the address host resolved to with -resolver, if used
+	dialHost string
+	// headers are added to every request, like an Authorization header
+	headers []string
+	// expect is the expected result of each probe, by probe name, if known
+	expect map[string]time.Duration
+	// expectFrom is the server config directive each expectation came from, by probe
+	// name, if it was read from a config
+	expectFrom map[string]string
+	// expectAtLeast marks the expectations, by probe name, that are only a minimum:
+	// a longer timeout, or none, meets them too
+	expectAtLeast map[string]bool
+	// tags label the target's results, like team=payments, in every output
+	tags map[string]string
+}
+
+// auditFlags are the audit subcommand's flags.
+type auditFlags struct {
+	bound, probeGap                                   time.Duration
+	path, inventory, sarifFile, upload                string
+	resolver, bastion, k8s, expectConfig, origin, cdn string
+	statsd, statsdTags, snippets                      string
+	parallel, maxConns                                int
+	th                                                auditThresholds
+	notifySinks                                       []string
+}
+
+// newAuditFlagSet defines the audit subcommand's flags. It's separate from runAudit
+// so that completion and help can list them.
+func newAuditFlagSet() (*flag.FlagSet, *auditFlags) {
+	var f auditFlags
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.DurationVar(&f.bound, "bound", 2*time.Minute, "longest to wait in each probe")
+	fs.StringVar(&f.path, "path", "/", "path to request")
+	fs.StringVar(&f.inventory, "inventory", "", "file listing targets to audit, with per-target settings and tags (a .csv file is read as CSV)")
+	fs.StringVar(&f.sarifFile, "sarif", "", "also write the findings to this file in SARIF format")
+	fs.Func("upload", "copy the SARIF file to this s3:// or gs:// URI, which can use {{.Target}}, {{.Time}}, and {{.Name}}", func(s string) error {
+		if err := validUploadURI(s); err != nil {
+			return err
+		}
+		f.upload = s
+		return nil
+	})
+	fs.DurationVar(&f.th.maxReadTimeout, "max-read-timeout", time.Minute, "header and body read timeouts longer than this are graded MEDIUM")
+	fs.BoolVar(&explainMode, "explain", false, "annotate findings with the server settings that likely govern them")
+	fs.DurationVar(&f.th.maxIdleTimeout, "max-idle-timeout", 10*time.Minute, "idle timeouts longer than this are graded LOW")
+	fs.IntVar(&f.parallel, "parallel", 1, "number of targets to audit at once")
+	fs.BoolVar(&ownTarget, "i-own-this-target", false, "allow auditing an inventory of targets that aren't local or in "+allowedTargetsEnv)
+	fs.IntVar(&f.maxConns, "max-conns", 0, "most connections to have open to a host at once; 0 for one per probe")
+	fs.DurationVar(&f.probeGap, "probe-gap", 0, "least time between new connections to a host")
+	fs.StringVar(&f.resolver, "resolver", "", "DNS server IP or DNS-over-HTTPS URL to resolve targets with")
+	fs.StringVar(&f.bastion, "ssh", "", "reach targets through an ssh tunnel via this host, like user@bastion")
+	fs.StringVar(&f.expectConfig, "expect-config", "", "check the timeouts set in this server config, like nginx:/etc/nginx/nginx.conf (or haproxy:, envoy:, alb:<arn>, or cloudfront:<id>)")
+	fs.StringVar(&f.origin, "origin", "", "also audit the target at this origin address, bypassing its edge (CDN or load balancer), and compare")
+	fs.StringVar(&f.cdn, "cdn", "auto", "CDN in front of the targets, for interpreting results: auto (detect it), none, or one of "+cdnNames())
+	fs.Func("notify", "post a summary to this webhook URL (or slack:<URL> for a Slack-compatible one) if findings don't meet expectations; can be repeated", func(s string) error {
+		if err := validNotifySink(s); err != nil {
+			return err
+		}
+		f.notifySinks = append(f.notifySinks, s)
+		return nil
+	})
+	fs.StringVar(&f.statsd, "statsd", "", "send the timeouts found to this StatsD server (host:port)")
+	fs.StringVar(&f.statsdTags, "statsd-tags", "", "comma-separated tags for the StatsD metrics, like env:prod,team:web")
+	fs.StringVar(&f.snippets, "snippets", "", "after the audit, print settings that would reproduce the timeouts found, for all servers or some of "+strings.Join(snippetServers, ", "))
+	fs.StringVar(&f.k8s, "k8s", "", "audit this Kubernetes service or pod through kubectl port-forward instead of a host, like namespace/service:port")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: httptimeout audit [flags] <host:port>")
+		fmt.Fprintln(fs.Output(), "       httptimeout audit [flags] -inventory <file>")
+		fmt.Fprintln(fs.Output(), "       httptimeout audit [flags] -k8s <namespace/service:port>")
+		fs.PrintDefaults()
+	}
+	return fs, &f
+}
+
+// runAudit runs every audit probe against one or more targets and prints a one-page
+// report of the timeouts found for each. args are the command line arguments after
+// "audit".
+func runAudit(args []string) {
+	fs, f := newAuditFlagSet()
+	fs.Parse(args)
+
+	var targets []auditTarget
+	switch {
+	case f.k8s != "" && f.inventory == "" && fs.NArg() == 0 && f.bastion == "" && f.resolver == "":
+		params, t, err := startK8sTunnel(testParams{}, f.k8s)
+		if err != nil {
+			fmt.Println(red("Kubernetes port-forward failed:"), err)
+			return
+		}
+		defer t.close()
+		fmt.Println()
+		targets = []auditTarget{{host: params.host, dialHost: params.dialHost, path: f.path}}
+	case f.k8s == "" && f.inventory != "" && fs.NArg() == 0:
+		var err error
+		if targets, err = readInventory(f.inventory, f.path); err != nil {
+			fmt.Println(red("inventory read failed:"), err)
+			return
+		}
+	case f.k8s == "" && f.inventory == "" && fs.NArg() == 1:
+		targets = []auditTarget{{host: fs.Arg(0), path: f.path}}
+	default:
+		fs.Usage()
+		return
+	}
+	if f.parallel < 1 || f.maxConns < 0 || f.probeGap < 0 || (f.upload != "" && f.sarifFile == "") || (f.cdn != "auto" && f.cdn != "none" && cdnPresetNamed(f.cdn) == nil) {
+		fs.Usage()
+		return
+	}
+	var snippetsFor []string
+	if f.snippets != "" {
+		var err error
+		if snippetsFor, err = parseSnippetServers(f.snippets); err != nil {
+			fmt.Println(red("bad -snippets:"), err)
+			return
+		}
+	}
+	if f.origin != "" {
+		if f.inventory != "" {
+			fs.Usage()
+			return
+		}
+		// The origin is audited as a second target, with the same Host and SNI
+		o := targets[0]
+		o.dialHost = f.origin
+		targets = append(targets, o)
+	}
+	if f.inventory != "" && len(targets) > 1 {
+		// A single target's audit is a handful of connections, but an inventory's
+		// fans out across a fleet
+		refused := false
+		for _, t := range targets {
+			if err := checkTargetAllowed(t.host, "auditing an inventory of targets"); err != nil {
+				fmt.Println(red("not auditing:"), err)
+				refused = true
+			}
+		}
+		if refused {
+			return
+		}
+	}
+	if f.expectConfig != "" {
+		if f.inventory != "" {
+			// Inventory targets each have their own ExpectConfig
+			fs.Usage()
+			return
+		}
+		var err error
+		if targets[0].expect, targets[0].expectFrom, targets[0].expectAtLeast, err = configExpectations(f.expectConfig); err != nil {
+			fmt.Println(red("server config read failed:"), err)
+			return
+		}
+	}
+
+	if f.resolver != "" {
+		for i, t := range targets {
+			if t.dialHost != "" {
+				// Already given an address, like the -origin
+				continue
+			}
+			params, err := resolveHost(auditParams(t), f.resolver)
+			if err != nil {
+				fmt.Println(red("resolve failed:"), err)
+				return
+			}
+			targets[i].dialHost = params.dialHost
+		}
+		fmt.Println()
+	}
+	if f.bastion != "" {
+		for i, t := range targets {
+			params, tunnel, err := startSSHTunnel(auditParams(t), f.bastion)
+			if err != nil {
+				fmt.Println(red("ssh tunnel failed:"), err)
+				return
+			}
+			defer tunnel.close()
+			targets[i].dialHost = params.dialHost
+		}
+		fmt.Println()
+	}
+
+	// Inventory entries can share a host, so the limits are per host rather than per
+	// target. Each probe has at most one connection open at a time, so limiting the
+	// probes running against a host limits its connections.
+	limiters := map[string]*hostLimiter{}
+	for _, t := range targets {
+		if limiters[t.limitKey()] == nil {
+			conns := f.maxConns
+			if conns == 0 {
+				conns = len(auditProbes)
+			}
+			limiters[t.limitKey()] = &hostLimiter{slots: make(chan struct{}, conns), pacer: &connPacer{gap: f.probeGap}}
+		}
+	}
+
+	// Targets are audited up to parallel at a time, but reported in order
+	done := make([]chan auditResult, len(targets))
+	sem := make(chan struct{}, f.parallel)
+	for i, t := range targets {
+		done[i] = make(chan auditResult, 1)
+		go func(i int, t auditTarget) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			done[i] <- auditOne(auditParams(t), t, f.bound, f.th, limiters[t.limitKey()], f.cdn)
+		}(i, t)
+	}
+
+	var results []auditResult
+	for i, t := range targets {
+		params := auditParams(t)
+		about := "path " + t.path
+		if len(t.tags) > 0 {
+			about += "; " + formatTags(t.tags)
+		}
+		if f.origin != "" && i == 1 {
+			fmt.Printf("auditing %s at its origin %s (%s), waiting up to %v per probe\n\n", params.host, f.origin, about, f.bound)
+		} else {
+			fmt.Printf("auditing %s (%s), waiting up to %v per probe\n\n", params.host, about, f.bound)
+		}
+		r := <-done[i]
+		printAuditFindings(r)
+		fmt.Println()
+		results = append(results, r)
+	}
+	if f.origin != "" {
+		printDifferential(results[0], results[1], f.origin)
+	}
+	printTagSummary(results)
+	if len(snippetsFor) > 0 {
+		for _, r := range results {
+			printSnippets(r, snippetsFor, f.bound)
+		}
+	}
+
+	if f.statsd != "" {
+		sendAuditMetrics(f.statsd, f.statsdTags, results)
+	}
+	if len(f.notifySinks) > 0 {
+		if n, ok := auditNotification(results); ok {
+			notify(f.notifySinks, n)
+		}
+	}
+
+	if f.sarifFile != "" {
+		settings := map[string]string{}
+		fs.VisitAll(func(f *flag.Flag) { settings[f.Name] = f.Value.String() })
+		if err := writeAuditSARIF(f.sarifFile, newRunMetadata(settings), results); err != nil {
+			fmt.Println(red("failed to write SARIF:"), err)
+		} else {
+			fmt.Printf(cyan("SARIF written to %s\n"), f.sarifFile)
+			if f.upload != "" {
+				target := targets[0].host
+				if f.inventory != "" {
+					target = strings.TrimSuffix(filepath.Base(f.inventory), filepath.Ext(f.inventory))
+				}
+				uploadResult(f.upload, f.sarifFile, target)
+			}
+		}
+	}
+}
+
+// limitKey is what the target's connections are limited by: the address dialed.
+func (t auditTarget) limitKey() string {
+	if t.dialHost != "" {
+		return t.dialHost
+	}
+	return t.host
+}
+
+// auditResult is the findings for one audited target.
+type auditResult struct {
+	target   string
+	findings []auditFinding
+	// conn describes the first connection made to the target; nil if none was
+	conn *connMetadata
+	// cdn is the CDN in front of the target, if any; cdnBy is how it was recognized
+	cdn   *cdnPreset
+	cdnBy string
+	// tags are the target's tags
+	tags map[string]string
+}
+
+// hostLimiter limits how hard an audit hits a host, so that auditing a production
+// fleet doesn't itself look like an attack.
+type hostLimiter struct {
+	// slots has room for each probe allowed to run against the host at once
+	slots chan struct{}
+	pacer *connPacer
+}
+
+// connPacer spaces out new connections to a host by at least gap.
+type connPacer struct {
+	gap  time.Duration
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until it's time for the next connection.
+func (p *connPacer) wait() {
+	if p.gap == 0 {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(p.gap)
+	p.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// auditOne runs the audit probes against a target, within the host's limits, and
+// grades the results. cdn is the -cdn setting.
+func auditOne(params testParams, t auditTarget, bound time.Duration, th auditThresholds, limiter *hostLimiter, cdn string) auditResult {
+	params.connPacer = limiter.pacer
+	var first firstConnRecorder
+	params.onDial = first.record
+	res := auditResult{target: auditTargetURI(params), tags: t.tags}
+
+	switch cdn {
+	case "none":
+	case "auto":
+		// If this fails, so will the probes, which will say why
+		limiter.slots <- struct{}{}
+		res.cdn, res.cdnBy, _ = detectCDN(params)
+		<-limiter.slots
+		if res.cdn != nil {
+			res.cdnBy += " header"
+		}
+	default:
+		res.cdn, res.cdnBy = cdnPresetNamed(cdn), "-cdn flag"
+	}
+
+	// The probes are independent, so they run at the same time, each on its own
+	// connection(s), to keep the audit to roughly the length of the longest one.
+	findings := make([]auditFinding, len(auditProbes))
+	var wg sync.WaitGroup
+	for i, p := range auditProbes {
+		wg.Add(1)
+		go func(i int, p auditProbe) {
+			defer wg.Done()
+			limiter.slots <- struct{}{}
+			defer func() { <-limiter.slots }()
+			f := p.run(params, bound)
+			f.probe, f.topic = p.name, p.topic
+			if f.err == nil {
+				f.severity, f.note = p.grade(f, th)
+				if want, ok := t.expect[p.name]; ok {
+					f.expected, f.hasExpected = want, true
+					f.expectedFrom, f.expectedAtLeast = t.expectFrom[p.name], t.expectAtLeast[p.name]
+					if f.expectedAtLeast {
+						f.metExpected = f.after == 0 || f.after >= want
+					} else {
+						f.metExpected = meetsExpectation(f.after, want)
+					}
+				}
+			}
+			findings[i] = f
+		}(i, p)
+	}
+	wg.Wait()
+	res.findings, res.conn = findings, first.meta
+	return res
+}
+
+// expectationTolerance is how far a measurement can be from the expected value and
+// still meet it, as a fraction of the expected value.
+const expectationTolerance = 0.1
+
+// meetsExpectation says whether a measured timeout matches the expected one. An
+// expected zero means no timeout.
+func meetsExpectation(after, want time.Duration) bool {
+	if want == 0 || after == 0 {
+		return want == after
+	}
+	diff := after - want
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) <= expectationTolerance*float64(want)
+}
+
+// printAuditFindings prints the one-page audit report for a target.
+func printAuditFindings(r auditResult) {
+	if r.cdn != nil {
+		fmt.Printf(cyan("  behind %s (going by the %s)\n"), r.cdn.name, r.cdnBy)
+		for _, n := range r.cdn.notes {
+			fmt.Println("  - " + n)
+		}
+		fmt.Println()
+	}
+	for _, f := range r.findings {
+		if f.err != nil {
+			fmt.Printf("  %-8s %-24s %s\n", "", f.probe, red("probe failed: "+f.err.Error()))
+			continue
+		}
+		// Pad before colouring, since the colour codes would throw off the width
+		sev := severityColor(f.severity)(fmt.Sprintf("%-8s", "["+f.severity+"]"))
+		fmt.Printf("  %s %-24s %s\n", sev, f.probe, f.outcome)
+		if f.note != "" {
+			fmt.Printf("  %-8s %-24s %s\n", "", "", f.note)
+		}
+		if r.cdn != nil && cdnEdgeProbes[f.probe] {
+			fmt.Printf("  %-8s %-24s %s\n", "", "", "this is "+r.cdn.name+"'s edge, not the origin")
+		}
+		if f.hasExpected {
+			want := "no timeout"
+			if f.expected != 0 {
+				want = f.expected.String()
+			}
+			if f.expectedAtLeast {
+				want = "at least " + want
+			}
+			if f.expectedFrom != "" {
+				want += " (" + f.expectedFrom + ")"
+			}
+			if f.metExpected {
+				fmt.Printf("  %-8s %-24s %s\n", "", "", cyan("expected "+want+" ✓"))
+			} else {
+				fmt.Printf("  %-8s %-24s %s\n", "", "", red("expected "+want+" ✗"))
+			}
+		}
+		explain(f.topic)
+	}
+}
+
+// severityColor returns the function that colours output for a severity.
+func severityColor(severity string) func(string) string {
+	switch severity {
+	case severityHigh:
+		return red
+	case severityMedium, severityLow:
+		return yellow
+	default:
+		return cyan
+	}
+}
+
+// auditTargetURI is the URL of the audited endpoint. Whether it's really HTTPS isn't
+// known until connecting, so it's guessed from the port.
+func auditTargetURI(params testParams) string {
+	scheme := "http"
+	if _, port, err := net.SplitHostPort(params.host); err == nil && port == "443" {
+		scheme = "https"
+	}
+	_, path := params.requestLine()
+	return scheme + "://" + params.host + path
+}
+
+// auditParams makes the params for a plain GET of the target.
+func auditParams(t auditTarget) testParams {
+	hostHeader := t.host
+	if h, port, err := net.SplitHostPort(t.host); err == nil && (port == "80" || port == "443") {
+		hostHeader = h
+	}
+	params := testParams{
+		host:       t.host,
+		serverName: t.serverName,
+		dialHost:   t.dialHost,
+		headers: []header{
+			{val: fmt.Sprintf("GET %s HTTP/1.1", t.path)},
+			{val: "Host: " + hostHeader},
+		},
+	}
+	for _, h := range t.headers {
+		params.headers = append(params.headers, header{val: h})
+	}
+	return params
+}
+
+// auditSlowHeaders sends the request headers without the blank line that ends them
+// and then stalls.
+func auditSlowHeaders(params testParams, bound time.Duration) auditFinding {
+	var req string
+	for _, h := range params.headers {
+		req += h.val + "\r\n"
+	}
+	return auditStall(params, req, bound)
+}
+
+// auditSlowBody sends the headers of a request with a body and then stalls after the
+// first body byte.
+func auditSlowBody(params testParams, bound time.Duration) auditFinding {
+	_, path := params.requestLine()
+	req := fmt.Sprintf("POST %s HTTP/1.1\r\n", path)
+	for _, h := range params.headers[1:] {
+		req += h.val + "\r\n"
+	}
+	req += "Content-Length: 1024\r\n\r\nx"
+	return auditStall(params, req, bound)
+}
+
+// auditStall writes req and waits for the server to do something about the rest of
+// the request never arriving.
+func auditStall(params testParams, req string, bound time.Duration) auditFinding {
+	conn, err := dial(params)
+	if err != nil {
+		return auditFinding{err: err}
+	}
+	defer conn.c.Close()
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	if _, err := conn.c.Write([]byte(req)); err != nil {
+		return auditFinding{err: err}
+	}
+	start := time.Now()
+
+	_, err = readByte(conn, start.Add(bound))
+	after := time.Since(start).Round(time.Millisecond)
+	switch {
+	case err == nil:
+		// Read the rest of the status line so we can say what it was
+		for !strings.Contains(string(conn.response), "\r\n") {
+			if _, err := readByte(conn, time.Now().Add(time.Second)); err != nil {
+				break
+			}
+		}
+		status := responseStatus(conn.response)
+		if status == "" {
+			status = "something that isn't HTTP"
+		}
+		return auditFinding{outcome: fmt.Sprintf("responded %s after %v", status, after), after: after}
+	case isTimeout(err):
+		return auditFinding{outcome: fmt.Sprintf("none: still waiting after %v", bound)}
+	default:
+		return auditFinding{outcome: fmt.Sprintf("%s after %v", describeEnd(err), after), after: after}
+	}
+}
+
+// auditStalledRead requests a response and doesn't read it. This can only hold the
+// server back if the response is bigger than the socket buffers, so a small response
+// gives an inconclusive result.
+func auditStalledRead(params testParams, bound time.Duration) auditFinding {
+	params.receiveBuffer = 1
+	conn, err := dial(params)
+	if err != nil {
+		return auditFinding{err: err}
+	}
+	defer conn.c.Close()
+
+	if _, err := conn.c.Write([]byte(fastRequest(params))); err != nil {
+		return auditFinding{err: err}
+	}
+	start := time.Now()
+
+	// Buffered response data hides a FIN, but a RST still shows up
+	for time.Since(start) < bound {
+		time.Sleep(time.Second)
+		if _, err := connCheck(conn.sc); err != nil {
+			after := time.Since(start).Round(time.Millisecond)
+			return auditFinding{outcome: fmt.Sprintf("%s after %v while we weren't reading", describeEnd(err), after), after: after}
+		}
+	}
+	return auditFinding{outcome: fmt.Sprintf("none seen within %v (inconclusive if the response fits in the socket buffers)", bound)}
+}
+
+// auditIdle brackets the keep-alive idle timeout.
+func auditIdle(params testParams, bound time.Duration) auditFinding {
+	params.idleProbeMin, params.idleProbeMax = time.Second, bound
+	alive, dead, err := bracketIdleTimeout(params, io.Discard)
+	if err != nil {
+		return auditFinding{err: err}
+	}
+	bracket := idleBracket{alive: alive, dead: dead, samples: 1}
+	f := auditFinding{outcome: describeIdleBracket(bracket), after: dead}
+	if _, margin, ok := bracket.estimate(); ok {
+		f.margin, f.lowConfidence = margin, bracket.lowConfidence()
+	}
+	return f
+}
+
+// auditOversizedHeadersLen is a little more than Go's default MaxHeaderBytes (plus
+// its slack), which is larger than most servers allow.
+const auditOversizedHeadersLen = 1<<20 + 8<<10
+
+// auditOversizedHeaders sends a request with a huge header.
+func auditOversizedHeaders(params testParams, bound time.Duration) auditFinding {
+	conn, err := dial(params)
+	if err != nil {
+		return auditFinding{err: err}
+	}
+	defer conn.c.Close()
+
+	req := fastRequest(params)
+	pad := "X-Pad: " + strings.Repeat("x", auditOversizedHeadersLen) + "\r\n"
+	// Put the padding after the request line and Host
+	i := strings.Index(req, "\r\n") + 2
+	i += strings.Index(req[i:], "\r\n") + 2
+	req = req[:i] + pad + req[i:]
+
+	// The server may stop reading and respond part way through, so don't give up on
+	// a failed write
+	conn.c.SetWriteDeadline(time.Now().Add(bound))
+	conn.c.Write([]byte(req))
+	conn.c.SetWriteDeadline(time.Time{})
+
+	head, err := readResponseHead(conn)
+	switch status := responseStatus(head); {
+	case status == "431":
+		return auditFinding{outcome: fmt.Sprintf("rejected %dKB of headers with 431", len(pad)>>10)}
+	case strings.HasPrefix(status, "4"), strings.HasPrefix(status, "5"):
+		return auditFinding{outcome: fmt.Sprintf("responded %s to %dKB of headers", status, len(pad)>>10)}
+	case status != "":
+		return auditFinding{outcome: fmt.Sprintf("responded %s to %dKB of headers", status, len(pad)>>10), accepted: true}
+	case err != nil && !isTimeout(err):
+		return auditFinding{outcome: fmt.Sprintf("%s on %dKB of headers, without a response", describeEnd(err), len(pad)>>10)}
+	default:
+		return auditFinding{outcome: fmt.Sprintf("no response to %dKB of headers", len(pad)>>10)}
+	}
+}
+
+// describeEnd describes an error that ended a connection.
+func describeEnd(err error) string {
+	switch {
+	case err == io.EOF:
+		return "closed (FIN)"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset (RST)"
+	default:
+		return fmt.Sprintf("ended by error (%v)", err)
+	}
+}
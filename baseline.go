@@ -0,0 +1,81 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// baseline is the timing of the configured request sent at normal speed, as a control
+// for interpreting the slow scenario.
+type baseline struct {
+	rtt time.Duration
+	// ttfb is from the request being written to the first response byte
+	ttfb time.Duration
+	// head is from the request being written to the end of the response headers
+	head time.Duration
+	// responseHead is the status line and headers of the response
+	responseHead []byte
+}
+
+// runBaseline sends the configured request without any sleeps on its own connection
+// and times the response.
+func runBaseline(params testParams) (baseline, error) {
+	params, err := params.expanded(nil)
+	if err != nil {
+		return baseline{}, err
+	}
+	conn, err := dial(params)
+	if err != nil {
+		return baseline{}, err
+	}
+	defer conn.c.Close()
+
+	if _, err := conn.c.Write([]byte(fastRequest(params))); err != nil {
+		return baseline{}, fmt.Errorf("baseline request write failed: %w", err)
+	}
+	sent := time.Now()
+	head, err := readResponseHead(conn)
+	if err != nil {
+		return baseline{}, fmt.Errorf("baseline request got no response: %w", err)
+	}
+
+	return baseline{
+		rtt:          conn.rtt,
+		ttfb:         conn.firstByteTime.Sub(sent),
+		head:         conn.lastReadTime.Sub(sent),
+		responseHead: head,
+	}, nil
+}
+
+// fastRequest is the whole configured request, without its sleeps and steps.
+func fastRequest(params testParams) string {
+	var sb strings.Builder
+	gotContentLength := false
+	for _, h := range params.headers {
+		if !h.isLine() {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(h.val), "content-length:") {
+			gotContentLength = true
+		}
+		sb.WriteString(h.val + "\r\n")
+	}
+	if len(params.trailers) > 0 {
+		for _, line := range chunkedHeaders(params.trailers) {
+			sb.WriteString(line + "\r\n")
+		}
+		sb.WriteString("\r\n")
+		head, tail := chunkedFraming([]byte(params.body), params.trailers)
+		sb.WriteString(head + params.body + tail)
+		return sb.String()
+	}
+	if !gotContentLength {
+		fmt.Fprintf(&sb, "Content-Length: %d\r\n", len(params.body))
+	}
+	sb.WriteString("\r\n")
+	sb.WriteString(params.body)
+	return sb.String()
+}
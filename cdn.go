@@ -0,0 +1,127 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cdnPreset is what we know about a CDN that may be in front of an audited target.
+type cdnPreset struct {
+	name string
+	// fingerprint says whether response headers (with lower-cased names) came
+	// through the CDN, and if so, which header gave it away
+	fingerprint func(headers map[string]string) (string, bool)
+	// notes help interpret an audit of a target behind the CDN
+	notes []string
+}
+
+var cdnPresets = []cdnPreset{
+	{
+		name: "Cloudflare",
+		fingerprint: func(h map[string]string) (string, bool) {
+			if _, ok := h["cf-ray"]; ok {
+				return "CF-Ray", true
+			}
+			return "Server: cloudflare", strings.EqualFold(h["server"], "cloudflare")
+		},
+		notes: []string{
+			"Cloudflare waits 100s for the origin's response headers before giving up with a 524 (Enterprise plans can raise it)",
+			"a 520-527 response is Cloudflare reporting a problem reaching the origin, not the origin's own response",
+		},
+	},
+	{
+		name: "CloudFront",
+		fingerprint: func(h map[string]string) (string, bool) {
+			if _, ok := h["x-amz-cf-id"]; ok {
+				return "X-Amz-Cf-Id", true
+			}
+			return "Via: ... CloudFront", strings.Contains(strings.ToLower(h["via"]), "cloudfront")
+		},
+		notes: []string{
+			"CloudFront waits 30s for the origin by default (the origin response timeout, configurable up to 60s) before a 504",
+		},
+	},
+	{
+		name: "Fastly",
+		fingerprint: func(h map[string]string) (string, bool) {
+			if _, ok := h["x-fastly-request-id"]; ok {
+				return "X-Fastly-Request-ID", true
+			}
+			return "X-Served-By: cache-...", strings.HasPrefix(h["x-served-by"], "cache-")
+		},
+		notes: []string{
+			"Fastly waits 15s for the origin's first byte by default (first_byte_timeout) before a 503",
+		},
+	},
+	{
+		name: "Akamai",
+		fingerprint: func(h map[string]string) (string, bool) {
+			return "Server: AkamaiGHost", strings.EqualFold(h["server"], "AkamaiGHost")
+		},
+		notes: []string{
+			"Akamai waits 120s for the origin by default (the origin timeout) before an error",
+		},
+	},
+}
+
+// cdnEdgeProbes are the audit probes that a CDN answers itself, without passing the
+// stall or idleness on to the origin.
+var cdnEdgeProbes = map[string]bool{
+	"header read timeout": true,
+	"body read timeout":   true,
+	"idle timeout":        true,
+	"max header size":     true,
+}
+
+// detectCDN makes a plain request of the target and looks for the fingerprint of a
+// known CDN in the response headers. It returns nil if there's none, and how it
+// was recognized if there is.
+func detectCDN(params testParams) (*cdnPreset, string, error) {
+	conn, err := dial(params)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.c.Close()
+
+	if _, err := conn.c.Write([]byte(fastRequest(params))); err != nil {
+		return nil, "", err
+	}
+	head, err := readResponseHead(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("no response to check for a CDN: %w", err)
+	}
+
+	headers := map[string]string{}
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			headers[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	for i, p := range cdnPresets {
+		if by, ok := p.fingerprint(headers); ok {
+			return &cdnPresets[i], by, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// cdnPresetNamed returns the preset for a CDN, matching the name case-insensitively.
+func cdnPresetNamed(name string) *cdnPreset {
+	for i, p := range cdnPresets {
+		if strings.EqualFold(p.name, name) {
+			return &cdnPresets[i]
+		}
+	}
+	return nil
+}
+
+// cdnNames lists the names of the CDN presets, for usage messages.
+func cdnNames() string {
+	var names []string
+	for _, p := range cdnPresets {
+		names = append(names, strings.ToLower(p.name))
+	}
+	return strings.Join(names, ", ")
+}
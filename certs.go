@@ -0,0 +1,154 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how close to expiry a certificate is worth pointing out.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// certMetadata describes a certificate that the server presented.
+type certMetadata struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"notAfter"`
+	DNSNames []string  `json:"dnsNames,omitempty"`
+	// Pin is the hash of the certificate's public key, as Pin takes it
+	Pin string `json:"pin"`
+}
+
+// tlsConfig is the TLS config for connecting to serverName with params' ClientHello,
+// CACert, and Pin settings. With pins, a pinned public key is what's trusted, instead
+// of the chain leading to a known CA, so that self-signed servers can be probed
+// safely (see verifyPins).
+func tlsConfig(params testParams, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if params.clientHello != "" {
+		clientHelloProfiles[params.clientHello](config)
+	}
+	if params.caCertFile != "" {
+		pem, err := os.ReadFile(params.caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CACert: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CACert %s", params.caCertFile)
+		}
+	}
+	if len(params.pins) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state.PeerCertificates, params.pins, serverName, config.RootCAs)
+		}
+	}
+	return config, nil
+}
+
+// verifyPins checks that the server's chain is anchored at a pinned key. Only the
+// leaf's key is proven by the handshake: anyone can send a copy of a public CA or
+// intermediate certificate. So a pin on the leaf is enough by itself, but a pin
+// further up only counts if the leaf verifies (for serverName) up to it, either
+// through roots (nil for the system's) or with the pinned certificate as the root.
+func verifyPins(certs []*x509.Certificate, pins []string, serverName string, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	pinned := func(cert *x509.Certificate) bool {
+		for _, pin := range pins {
+			if certPin(cert) == pin {
+				return true
+			}
+		}
+		return false
+	}
+	leaf := certs[0]
+	if pinned(leaf) {
+		return nil
+	}
+
+	intermediates, pinnedRoots := x509.NewCertPool(), x509.NewCertPool()
+	anyPinned := false
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+		if pinned(cert) {
+			pinnedRoots.AddCert(cert)
+			anyPinned = true
+		}
+	}
+	opts := x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates, Roots: roots}
+	if chains, err := leaf.Verify(opts); err == nil {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if pinned(cert) {
+					return nil
+				}
+			}
+		}
+	}
+	if anyPinned {
+		opts.Roots = pinnedRoots
+		_, err := leaf.Verify(opts)
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("the server's chain has a pinned certificate, but its leaf doesn't verify up to it: %w", err)
+	}
+	return errors.New("no certificate in the server's chain matches Pin")
+}
+
+// certPin is the pin of cert's public key: "sha256/" and the base64 SHA-256 of its
+// SubjectPublicKeyInfo, as in HPKP and curl's --pinnedpubkey.
+func certPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// describeCerts describes the certificate chain the server presented.
+func describeCerts(certs []*x509.Certificate) []certMetadata {
+	var res []certMetadata
+	for _, c := range certs {
+		res = append(res, certMetadata{
+			Subject:  c.Subject.String(),
+			Issuer:   c.Issuer.String(),
+			NotAfter: c.NotAfter,
+			DNSNames: c.DNSNames,
+			Pin:      certPin(c),
+		})
+	}
+	return res
+}
+
+// printCertChain prints the certificate chain of a TLS connection, which shows what
+// terminated TLS: a CDN, a load balancer, or the origin.
+func printCertChain(conn *conn) {
+	tc, ok := conn.c.(*tls.Conn)
+	if !ok {
+		return
+	}
+	for i, c := range describeCerts(tc.ConnectionState().PeerCertificates) {
+		fmt.Printf("certificate %d: %s\n", i, c.Subject)
+		fmt.Printf("  issuer: %s\n", c.Issuer)
+		expiry := fmt.Sprintf("  expires: %s", c.NotAfter.Format(time.RFC3339))
+		if left := time.Until(c.NotAfter); left < 0 {
+			expiry = red(expiry + " (expired)")
+		} else if left < certExpiryWarning {
+			expiry = yellow(fmt.Sprintf("%s (in %d days)", expiry, int(left.Hours()/24)))
+		}
+		fmt.Println(expiry)
+		if len(c.DNSNames) > 0 {
+			fmt.Printf("  names: %s\n", strings.Join(c.DNSNames, ", "))
+		}
+		fmt.Printf("  pin: %s\n", c.Pin)
+	}
+}
@@ -0,0 +1,80 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert makes a certificate for name, signed by parent (self-signed if nil).
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !isCA {
+		tmpl.DNSNames = []string{name}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca, caKey := newTestCert(t, "Private CA", true, nil, nil)
+	leaf, _ := newTestCert(t, "api.example.com", false, ca, caKey)
+	selfSigned, _ := newTestCert(t, "api.example.com", false, nil, nil)
+	// An interceptor can't sign as the CA, but it can send a copy of its certificate
+	evilLeaf, _ := newTestCert(t, "api.example.com", false, nil, nil)
+
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		pin   *x509.Certificate
+		ok    bool
+	}{
+		{"pinned self-signed leaf", []*x509.Certificate{selfSigned}, selfSigned, true},
+		{"pinned leaf", []*x509.Certificate{leaf, ca}, leaf, true},
+		{"pinned CA that signed the leaf", []*x509.Certificate{leaf, ca}, ca, true},
+		{"pinned CA appended to another leaf", []*x509.Certificate{evilLeaf, ca}, ca, false},
+		{"nothing pinned", []*x509.Certificate{leaf, ca}, selfSigned, false},
+	}
+	for _, tt := range tests {
+		err := verifyPins(tt.chain, []string{certPin(tt.pin)}, "api.example.com", nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verifyPins() = %v; want ok %v", tt.name, err, tt.ok)
+		}
+	}
+
+	// The pinned CA must have signed for the name asked for
+	if err := verifyPins([]*x509.Certificate{leaf, ca}, []string{certPin(ca)}, "other.example.com", nil); err == nil {
+		t.Errorf("pinned CA accepted a leaf for another name")
+	}
+}
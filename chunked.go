@@ -0,0 +1,111 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// chunkedHeaders are the headers that replace Content-Length when the body is sent
+// chunked so that it can be followed by trailers.
+func chunkedHeaders(trailers []string) []string {
+	var names []string
+	for _, t := range trailers {
+		name, _, _ := strings.Cut(t, ":")
+		names = append(names, strings.TrimSpace(name))
+	}
+	return []string{"Transfer-Encoding: chunked", "Trailer: " + strings.Join(names, ", ")}
+}
+
+// chunkedFraming is what goes before and after the body to send it as a single chunk
+// followed by the trailers.
+func chunkedFraming(body []byte, trailers []string) (head, tail string) {
+	if len(body) > 0 {
+		head = fmt.Sprintf("%x\r\n", len(body))
+		tail = "\r\n"
+	}
+	tail += "0\r\n"
+	for _, t := range trailers {
+		tail += t + "\r\n"
+	}
+	return head, tail + "\r\n"
+}
+
+// printResponseTrailers reports the trailers of a chunked response, and whether the
+// trailers it declared in a Trailer header arrived. Servers (and proxies) can hold
+// a response open while trailers are pending, which can look like a stalled body.
+func printResponseTrailers(conn *conn) {
+	end := bytes.Index(conn.response, []byte("\r\n\r\n"))
+	if end < 0 || conn.responseLen > len(conn.response) {
+		// Without the whole response, the end of the body can't be found
+		return
+	}
+	var chunked bool
+	var declared string
+	for _, line := range strings.Split(string(conn.response[:end]), "\r\n")[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case "trailer":
+			declared = strings.TrimSpace(value)
+		}
+	}
+	if !chunked {
+		return
+	}
+
+	trailers, complete := chunkedTrailers(conn.response[end+4:])
+	switch {
+	case !complete && declared != "":
+		fmt.Printf(cyan("chunked response ended before its trailers (declared: %s) arrived\n"), declared)
+	case !complete:
+		fmt.Println(cyan("chunked response ended before its last chunk"))
+	case len(trailers) > 0:
+		fmt.Println(cyan("response trailers: " + strings.Join(trailers, "; ")))
+	case declared != "":
+		fmt.Printf(cyan("response declared trailers (%s) but sent none\n"), declared)
+	}
+}
+
+// chunkedTrailers reads a chunked body and returns its trailer lines. complete is
+// false if the body ends before the end of the trailers.
+func chunkedTrailers(body []byte) (trailers []string, complete bool) {
+	for {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return nil, false
+		}
+		sizeStr, _, _ := strings.Cut(string(body[:i]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			return nil, false
+		}
+		body = body[i+2:]
+		if size == 0 {
+			break
+		}
+		if int64(len(body)) < size+2 {
+			return nil, false
+		}
+		body = body[size+2:]
+	}
+
+	for {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			return trailers, false
+		}
+		if i == 0 {
+			return trailers, true
+		}
+		trailers = append(trailers, string(body[:i]))
+		body = body[i+2:]
+	}
+}
@@ -0,0 +1,148 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// subcommands are the first arguments that aren't a config file.
+var subcommands = []string{"audit", "completion", "demo", "heatmap", "help", "init", "lint", "scenarios"}
+
+// The completion scripts ask the binary itself for candidates, with the words of the
+// command line so far (without the program name, and ending with the word being
+// completed), so they never go stale. Where there are none, the shell completes file
+// names instead.
+const (
+	bashCompletion = `_httptimeout() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	local IFS=$'\n'
+	COMPREPLY=($(compgen -W "$(httptimeout __complete "${COMP_WORDS[@]:1:COMP_CWORD}")" -- "$cur"))
+}
+complete -o default -F _httptimeout httptimeout
+`
+	zshCompletion = `#compdef httptimeout
+_httptimeout() {
+	local -a candidates
+	candidates=(${(f)"$(httptimeout __complete "${(@)words[2,CURRENT]}")"})
+	if (( ${#candidates} )); then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _httptimeout httptimeout
+`
+	fishCompletion = `complete -c httptimeout -a '(httptimeout __complete (commandline -opc)[2..-1] (commandline -ct))'
+`
+)
+
+// newMainFlagSet defines the flags for running a config file.
+func newMainFlagSet(fs *flag.FlagSet) {
+	fs.BoolVar(&explainMode, "explain", false, "annotate report lines with the server settings that likely govern them")
+	fs.BoolVar(&assumeYes, "yes", false, fmt.Sprintf("don't ask before runs that may take more than %v", confirmRuntime))
+	fs.BoolVar(&ownTarget, "i-own-this-target", false, "allow modes that open many connections at once against a target that isn't local or in "+allowedTargetsEnv)
+}
+
+// runCompletion implements the completion subcommand, which prints the completion
+// script for a shell.
+func runCompletion(args []string) {
+	scripts := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}
+	if len(args) != 1 || scripts[args[0]] == "" {
+		fmt.Println("Usage: httptimeout completion bash|zsh|fish")
+		fmt.Println()
+		fmt.Println(helpCompletion)
+		os.Exit(2)
+	}
+	fmt.Print(scripts[args[0]])
+}
+
+// runComplete prints the completion candidates for words, one per line.
+func runComplete(words []string) {
+	for _, c := range completions(words) {
+		fmt.Println(c)
+	}
+}
+
+// completions returns the candidates for the last of words, which are the command
+// line arguments so far. The shell filters them by what's been typed.
+func completions(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur := words[len(words)-1]
+
+	if len(words) == 1 {
+		if strings.HasPrefix(cur, "-") {
+			fs := flag.NewFlagSet("", flag.ContinueOnError)
+			newMainFlagSet(fs)
+			return flagCompletions(fs, "")
+		}
+		configs, _ := filepath.Glob(cur + "*.txt")
+		return append(append([]string(nil), subcommands...), configs...)
+	}
+
+	prev := words[len(words)-2]
+	switch words[0] {
+	case "audit":
+		fs, _ := newAuditFlagSet()
+		if prev == "-cdn" {
+			return append([]string{"auto", "none"}, strings.Split(cdnNames(), ", ")...)
+		}
+		return flagCompletions(fs, prev)
+	case "demo":
+		fs, _, _ := newDemoFlagSet()
+		return flagCompletions(fs, prev)
+	case "heatmap":
+		fs, _ := newHeatmapFlagSet()
+		return flagCompletions(fs, prev)
+	case "scenarios":
+		if len(words) == 2 {
+			return []string{"list", "describe", "show"}
+		}
+		if len(words) == 3 && (prev == "describe" || prev == "show") {
+			scenarios, _ := readScenarios()
+			var names []string
+			for _, s := range scenarios {
+				names = append(names, s.name)
+			}
+			return names
+		}
+	case "help":
+		if len(words) == 2 {
+			var topics []string
+			for _, t := range helpTopics {
+				topics = append(topics, t.name)
+			}
+			return topics
+		}
+	case "completion":
+		if len(words) == 2 {
+			return []string{"bash", "zsh", "fish"}
+		}
+	}
+	return nil
+}
+
+// flagCompletions returns the flags in fs, unless prev is a flag that takes a value,
+// in which case there's nothing to suggest (leaving the shell to complete file names).
+func flagCompletions(fs *flag.FlagSet, prev string) []string {
+	if f := fs.Lookup(strings.TrimLeft(prev, "-")); strings.HasPrefix(prev, "-") && f != nil && !isBoolFlag(f) {
+		return nil
+	}
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+	sort.Strings(names)
+	return names
+}
+
+// isBoolFlag is true if f doesn't take a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,705 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type header struct {
+	val   string
+	sleep time.Duration
+	// sleepRTTs is a sleep given as a multiple of the connection RTT, before it's
+	// resolved into sleep
+	sleepRTTs float64
+	// step is a custom step to run at this point in the request head, from a "step"
+	// line
+	step step
+}
+
+func (h header) isSleep() bool {
+	return h.sleep != 0 || h.sleepRTTs != 0
+}
+
+// isLine is true if h is a line of the request head, rather than a sleep or a step.
+func (h header) isLine() bool {
+	return !h.isSleep() && h.step == nil
+}
+
+// preTLSStep is part of a plaintext exchange made before the TLS handshake.
+type preTLSStep struct {
+	send string
+	// expect is read for after send; it's empty if no response is expected
+	expect string
+}
+
+type testParams struct {
+	host string
+	// serverName overrides the TLS SNI, which is otherwise taken from host
+	serverName string
+	// clientHello is the ClientHello profile to send (see clientHelloProfiles); empty
+	// is Go's own
+	clientHello string
+	// caCertFile is a PEM file of CA certificates to trust instead of the system's
+	caCertFile string
+	// pins are public key hashes (see certPin), one of which the server's chain must
+	// have; they're trusted in place of the chain leading to a known CA
+	pins []string
+	// resolver is the DNS server (an IP address) or DNS-over-HTTPS URL to resolve host
+	// with, if set
+	resolver string
+	// dialHost is the address to connect to instead of host, once it's been resolved
+	// or tunnelled
+	dialHost string
+	// sshBastion is the host (like user@bastion) to tunnel connections through with
+	// ssh, if set
+	sshBastion string
+	// k8sTarget is the Kubernetes service or pod to port-forward to with kubectl, if
+	// set, like namespace/service:port
+	k8sTarget string
+	// connPacer spaces out new connections, if set
+	connPacer *connPacer
+	// onDial is called with each new connection, if set
+	onDial func(*conn)
+	// preTLS is the plaintext exchange to make before starting TLS, if any
+	preTLS []preTLSStep
+	// For automatic Content-Length header, exclude that header
+	headers          []header
+	body             string
+	perByteBodySleep time.Duration
+	// headerEndSleep is slept after the last header line, before the blank line that
+	// ends the headers, and bodyStartSleep after that blank line, before the first body
+	// byte. Some servers start their body timer at the end of the headers, so these
+	// separate the boundary from the sleeps around it.
+	headerEndSleep time.Duration
+	bodyStartSleep time.Duration
+	// bodyStartSteps are custom steps run after the headers, before BodyStartSleep,
+	// from "step" lines among the byte-sleeps
+	bodyStartSteps []step
+	// Sleeps given as multiples of the connection RTT, resolved once it's measured
+	perByteBodySleepRTTs         float64
+	perByteResponseReadSleepRTTs float64
+	headerEndSleepRTTs           float64
+	bodyStartSleepRTTs           float64
+	// lineEndings is how the lines of the request head end: "crlf" (the default), "lf",
+	// or "mixed" (alternating, starting with CRLF)
+	lineEndings string
+
+	// Reading slowly only holds the server back once the socket buffers are full, so
+	// this works best with a small receiveBuffer.
+	perByteResponseReadSleep time.Duration
+	// receiveBuffer is the SO_RCVBUF size set before connecting, if non-zero. Setting it
+	// before the handshake keeps the advertised TCP window small.
+	receiveBuffer int
+	// maxSegment is the TCP_MAXSEG set before connecting, if non-zero. It caps the MSS
+	// we advertise, so the server's segments are small too.
+	maxSegment int
+
+	// If maxResponseBytes is set, only that many response bytes are shown, and if
+	// closeAtMaxResponseBytes is also set, we stop reading and close at that point
+	maxResponseBytes        int
+	closeAtMaxResponseBytes bool
+
+	// stopAfter is the point at which to stop the scenario early, if set: "headers"
+	// (before the blank line that ends them), "body" (before its last byte), or
+	// "first-response-byte" (close when it arrives)
+	stopAfter string
+
+	// If baseline is set, the request is first sent at normal speed on its own
+	// connection, as a control
+	baseline bool
+	// If retryEarlyFailure is set, the request is sent once more if the connection
+	// fails within earlyFailure, and the two attempts are compared
+	retryEarlyFailure bool
+	// preflight is "same" or "new" to send a CORS preflight before the request, on
+	// the same connection or on a connection of its own, if set
+	preflight string
+	// If traceRecords is set, each write of the request is annotated with the TLS
+	// records it went out as
+	traceRecords bool
+	// writeStrategy is how the request's writes become syscalls: writeEach (the
+	// default, if empty), writeBuffered, or writeCork
+	writeStrategy string
+	// If tarpitBytes is set, the request is instead sent with a body of that many
+	// bytes, as fast as the server accepts it for up to tarpitMax, to detect a tarpit
+	tarpitBytes int
+	tarpitMax   time.Duration
+	// If closeCompare is set, the request is instead sent at normal speed with
+	// Connection: keep-alive and with Connection: close, to compare how they're handled
+	closeCompare bool
+
+	// lingerProbe is how long to keep writing after the server's FIN, to measure a
+	// lingering close, if set
+	lingerProbe time.Duration
+
+	// responseFile is where to save the response body as it arrived, if set; the head
+	// goes in the same name plus responseHeadSuffix
+	responseFile string
+
+	// serverEvents is the example server's /events URL, if set, to fetch the server's
+	// side of the connection from and merge it into the client's timeline
+	serverEvents string
+
+	// trailers are sent after the body, if set, which is then sent chunked instead of
+	// with a Content-Length
+	trailers []string
+
+	// If bodyEscapes is set, backslash escapes in the body are interpreted
+	bodyEscapes bool
+	// If bodyTrailingNewline is set, a newline is appended to the body
+	bodyTrailingNewline bool
+
+	// If idleProbeMax is set, the idle timeout is bracketed with keep-alive probes
+	// between these gaps instead of running the configured request
+	idleProbeMin time.Duration
+	idleProbeMax time.Duration
+	// If idleRaceAttempts is set, the idle probe is followed by that many attempts at
+	// each offset around the idle timeout to reuse an idle connection
+	idleRaceAttempts int
+	// If idlePoolSize is set, that many keep-alive connections are opened and left
+	// idle, and how many remain open is reported every idlePoolReport
+	idlePoolSize   int
+	idlePoolReport time.Duration
+	// adviceFile is where to write the client tuning advice from IdleProbe or
+	// IdlePool as JSON, if set
+	adviceFile string
+	// uploadURI is where in object storage to copy AdviceFile and WatchHistory after
+	// they're written, if set; see uploadResult
+	uploadURI string
+	// If watch is set, the idle probe is repeated at this interval and only changes
+	// are reported
+	watch time.Duration
+	// watchHistory is where to append each Watch run as a line of JSON, if set, for
+	// the heatmap subcommand
+	watchHistory string
+	// notifySinks are the webhooks to post to when Watch sees a change, as for notify
+	notifySinks []string
+	// statsd is the StatsD server (host:port) to send metrics to after each run, if
+	// set, tagged with statsdTags (comma-separated, like "env:prod,team:web")
+	statsd     string
+	statsdTags string
+	// hmacHeader, if set, is added to the request with hmacPrefix followed by the hex
+	// HMAC-SHA256 of the body, keyed with the secret in the environment variable
+	// hmacSecretEnv
+	hmacHeader    string
+	hmacSecretEnv string
+	hmacPrefix    string
+	// sigV4Region and sigV4Service, if set, sign the request with AWS Signature
+	// Version 4, using the AWS credentials in the environment
+	sigV4Region  string
+	sigV4Service string
+}
+
+func readConfig(filename string) (testParams, error) {
+	// Open the file for reading
+	f, err := os.Open(filename)
+	if err != nil {
+		return testParams{}, fmt.Errorf("failed to open config file %q: %w", filename, err)
+	}
+	defer f.Close()
+	return parseConfig(f)
+}
+
+// parseConfig parses a config, as described by config-example.txt.
+func parseConfig(f io.Reader) (testParams, error) {
+	var err error
+	preTLSSendRegexp := regexp.MustCompile(`^PreTLSSend:\s?(.*)`)
+	preTLSExpectRegexp := regexp.MustCompile(`^PreTLSExpect:\s?(.*)`)
+	resolverRegexp := regexp.MustCompile(`^Resolver:\s*(\S+)`)
+	caCertRegexp := regexp.MustCompile(`^CACert:\s*(.+)`)
+	clientHelloRegexp := regexp.MustCompile(`^ClientHello:\s*(\S+)`)
+	pinRegexp := regexp.MustCompile(`^Pin:\s*(\S+)`)
+	sshRegexp := regexp.MustCompile(`^SSH:\s*(\S+)`)
+	k8sRegexp := regexp.MustCompile(`^K8s:\s*(\S+)`)
+	sleepRegexp := regexp.MustCompile(`^sleep (\S+)`)
+	stepRegexp := regexp.MustCompile(`^step (.+)`)
+	perByteBodySleepRegexp := regexp.MustCompile(`^PerByteBodySleep:\s*(\S+)`)
+	perByteResponseReadSleepRegexp := regexp.MustCompile(`^PerByteResponseReadSleep:\s*(\S+)`)
+	headerEndSleepRegexp := regexp.MustCompile(`^HeaderEndSleep:\s*(\S+)`)
+	bodyStartSleepRegexp := regexp.MustCompile(`^BodyStartSleep:\s*(\S+)`)
+	lineEndingsRegexp := regexp.MustCompile(`^LineEndings:\s*(\S+)`)
+	receiveBufferRegexp := regexp.MustCompile(`^ReceiveBuffer:\s*(\S+)`)
+	maxSegmentRegexp := regexp.MustCompile(`^MSS:\s*(\S+)`)
+	maxResponseBytesRegexp := regexp.MustCompile(`^MaxResponseBytes:\s*(\S+)(\s+close)?\s*$`)
+	responseFileRegexp := regexp.MustCompile(`^ResponseFile:\s*(.+)`)
+	stopAfterRegexp := regexp.MustCompile(`^StopAfter:\s*(\S+)`)
+	watchRegexp := regexp.MustCompile(`^Watch:\s*(\S+)`)
+	watchHistoryRegexp := regexp.MustCompile(`^WatchHistory:\s*(.+)`)
+	notifyRegexp := regexp.MustCompile(`^Notify:\s*(\S+)`)
+	statsdRegexp := regexp.MustCompile(`^StatsD:\s*(\S+)`)
+	statsdTagsRegexp := regexp.MustCompile(`^StatsDTags:\s*(\S+)`)
+	hmacRegexp := regexp.MustCompile(`^HMAC:\s*(\S+)\s+(\S+)(?:\s+(\S+))?\s*$`)
+	sigV4Regexp := regexp.MustCompile(`^SigV4:\s*(\S+)\s+(\S+)`)
+	lingerProbeRegexp := regexp.MustCompile(`^LingerProbe:\s*(\S+)`)
+	baselineRegexp := regexp.MustCompile(`^Baseline:\s*(\S+)`)
+	closeCompareRegexp := regexp.MustCompile(`^CloseCompare:\s*(\S+)`)
+	retryEarlyFailureRegexp := regexp.MustCompile(`^RetryEarlyFailure:\s*(\S+)`)
+	preflightRegexp := regexp.MustCompile(`^Preflight:\s*(\S+)`)
+	traceRecordsRegexp := regexp.MustCompile(`^TraceRecords:\s*(\S+)`)
+	writeStrategyRegexp := regexp.MustCompile(`^WriteStrategy:\s*(\S+)`)
+	tarpitProbeRegexp := regexp.MustCompile(`^TarpitProbe:\s*(\S+)\s+(\S+)`)
+	bodyEscapesRegexp := regexp.MustCompile(`^BodyEscapes:\s*(\S+)`)
+	bodyTrailingNewlineRegexp := regexp.MustCompile(`^BodyTrailingNewline:\s*(\S+)`)
+	idleProbeRegexp := regexp.MustCompile(`^IdleProbe:\s*(\S+)\s+(\S+)`)
+	idlePoolRegexp := regexp.MustCompile(`^IdlePool:\s*(\S+)\s+(\S+)`)
+	idleRaceRegexp := regexp.MustCompile(`^IdleRace:\s*(\S+)`)
+	serverEventsRegexp := regexp.MustCompile(`^ServerEvents:\s*(\S+)`)
+	adviceFileRegexp := regexp.MustCompile(`^AdviceFile:\s*(.+)`)
+	uploadRegexp := regexp.MustCompile(`^Upload:\s*(.+)`)
+	trailerRegexp := regexp.MustCompile(`^Trailer:\s*(\S+:.*)`)
+
+	var res testParams
+	phase := "host"
+
+	reader := bufio.NewReader(f)
+	for firstLine := true; ; firstLine = false {
+		// Read the next line. ReadString has no length limit, unlike ReadLine.
+		lineStr, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if lineStr == "" {
+				break
+			}
+			// Last line has no newline; process it and stop on the next read.
+		} else if err != nil {
+			return testParams{}, err
+		}
+
+		// Tolerate files saved on Windows: CRLF line endings and a leading BOM
+		lineStr = strings.TrimSuffix(lineStr, "\n")
+		lineStr = strings.TrimSuffix(lineStr, "\r")
+		if firstLine {
+			lineStr = strings.TrimPrefix(lineStr, "\ufeff")
+		}
+
+		if lineStr == "" {
+			switch phase {
+			case "host":
+				phase = "headers"
+			case "headers":
+				phase = "byte-sleeps"
+			case "byte-sleeps":
+				phase = "body"
+			}
+			continue
+		}
+
+		if strings.HasPrefix(lineStr, "#") {
+			// comment
+			continue
+		}
+
+		switch phase {
+		case "host":
+			if match := preTLSSendRegexp.FindStringSubmatch(lineStr); match != nil {
+				send, err := unescape(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad PreTLSSend in config: %q; %w", lineStr, err)
+				}
+				res.preTLS = append(res.preTLS, preTLSStep{send: send})
+			} else if match := preTLSExpectRegexp.FindStringSubmatch(lineStr); match != nil {
+				expect, err := unescape(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad PreTLSExpect in config: %q; %w", lineStr, err)
+				}
+				if len(res.preTLS) == 0 || res.preTLS[len(res.preTLS)-1].expect != "" {
+					res.preTLS = append(res.preTLS, preTLSStep{})
+				}
+				res.preTLS[len(res.preTLS)-1].expect = expect
+			} else if match := resolverRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.resolver = match[1]
+			} else if match := clientHelloRegexp.FindStringSubmatch(lineStr); match != nil {
+				if clientHelloProfiles[match[1]] == nil {
+					return testParams{}, fmt.Errorf("got bad ClientHello in config: %q; want one of %s", lineStr, clientHelloProfileNames())
+				}
+				res.clientHello = match[1]
+			} else if match := caCertRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.caCertFile = strings.TrimSpace(match[1])
+			} else if match := pinRegexp.FindStringSubmatch(lineStr); match != nil {
+				if !strings.HasPrefix(match[1], "sha256/") {
+					return testParams{}, fmt.Errorf("got bad Pin in config: %q; want sha256/ and a base64 hash", lineStr)
+				}
+				res.pins = append(res.pins, match[1])
+			} else if match := sshRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.sshBastion = match[1]
+			} else if match := k8sRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.k8sTarget = match[1]
+			} else {
+				res.host = lineStr
+			}
+		case "headers":
+			if match := sleepRegexp.FindStringSubmatch(lineStr); match != nil {
+				sleep, rtts, err := parseSleep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad header sleep in config: %q; %w", lineStr, err)
+				}
+				res.headers = append(res.headers, header{sleep: sleep, sleepRTTs: rtts})
+			} else if match := stepRegexp.FindStringSubmatch(lineStr); match != nil {
+				st, err := parseStep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad step in config: %q; %w", lineStr, err)
+				}
+				res.headers = append(res.headers, header{step: st})
+			} else {
+				res.headers = append(res.headers, header{val: lineStr})
+			}
+		case "byte-sleeps":
+			if match := perByteBodySleepRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.perByteBodySleep, res.perByteBodySleepRTTs, err = parseSleep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad PerByteBodySleep in config: %q; %w", lineStr, err)
+				}
+			} else if match := perByteResponseReadSleepRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.perByteResponseReadSleep, res.perByteResponseReadSleepRTTs, err = parseSleep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad PerByteResponseReadSleep in config: %q; %w", lineStr, err)
+				}
+			} else if match := headerEndSleepRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.headerEndSleep, res.headerEndSleepRTTs, err = parseSleep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad HeaderEndSleep in config: %q; %w", lineStr, err)
+				}
+			} else if match := bodyStartSleepRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.bodyStartSleep, res.bodyStartSleepRTTs, err = parseSleep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad BodyStartSleep in config: %q; %w", lineStr, err)
+				}
+			} else if match := lineEndingsRegexp.FindStringSubmatch(lineStr); match != nil {
+				switch match[1] {
+				case "crlf", "lf", "mixed":
+					res.lineEndings = match[1]
+				default:
+					return testParams{}, fmt.Errorf("got bad LineEndings in config: %q; want crlf, lf, or mixed", lineStr)
+				}
+			} else if match := receiveBufferRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.receiveBuffer, err = strconv.Atoi(match[1])
+				if err != nil || res.receiveBuffer < 0 {
+					return testParams{}, fmt.Errorf("got bad ReceiveBuffer in config: %q", lineStr)
+				}
+			} else if match := maxSegmentRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.maxSegment, err = strconv.Atoi(match[1])
+				if err != nil || res.maxSegment <= 0 {
+					return testParams{}, fmt.Errorf("got bad MSS in config: %q", lineStr)
+				}
+			} else if match := maxResponseBytesRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.maxResponseBytes, err = strconv.Atoi(match[1])
+				if err != nil || res.maxResponseBytes <= 0 {
+					return testParams{}, fmt.Errorf("got bad MaxResponseBytes in config: %q", lineStr)
+				}
+				res.closeAtMaxResponseBytes = match[2] != ""
+			} else if match := responseFileRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.responseFile = strings.TrimSpace(match[1])
+			} else if match := serverEventsRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.serverEvents = match[1]
+			} else if match := trailerRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.trailers = append(res.trailers, match[1])
+			} else if match := adviceFileRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.adviceFile = strings.TrimSpace(match[1])
+			} else if match := uploadRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.uploadURI = strings.TrimSpace(match[1])
+				if err := validUploadURI(res.uploadURI); err != nil {
+					return testParams{}, fmt.Errorf("got bad Upload in config: %w", err)
+				}
+			} else if match := stopAfterRegexp.FindStringSubmatch(lineStr); match != nil {
+				switch match[1] {
+				case "headers", "body", "first-response-byte":
+					res.stopAfter = match[1]
+				default:
+					return testParams{}, fmt.Errorf("got bad StopAfter in config: %q; want headers, body, or first-response-byte", lineStr)
+				}
+			} else if match := lingerProbeRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.lingerProbe, err = time.ParseDuration(match[1])
+				if err != nil || res.lingerProbe <= 0 {
+					return testParams{}, fmt.Errorf("got bad LingerProbe in config: %q", lineStr)
+				}
+			} else if match := watchRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.watch, err = time.ParseDuration(match[1])
+				if err != nil || res.watch <= 0 {
+					return testParams{}, fmt.Errorf("got bad Watch in config: %q", lineStr)
+				}
+			} else if match := watchHistoryRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.watchHistory = strings.TrimSpace(match[1])
+			} else if match := notifyRegexp.FindStringSubmatch(lineStr); match != nil {
+				if err := validNotifySink(match[1]); err != nil {
+					return testParams{}, fmt.Errorf("got bad Notify in config: %q; %w", lineStr, err)
+				}
+				res.notifySinks = append(res.notifySinks, match[1])
+			} else if match := statsdRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.statsd = match[1]
+			} else if match := statsdTagsRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.statsdTags = match[1]
+			} else if match := hmacRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.hmacHeader, res.hmacSecretEnv, res.hmacPrefix = match[1], match[2], match[3]
+			} else if match := sigV4Regexp.FindStringSubmatch(lineStr); match != nil {
+				res.sigV4Region, res.sigV4Service = match[1], match[2]
+			} else if match := baselineRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.baseline, err = strconv.ParseBool(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad Baseline in config: %q; %w", lineStr, err)
+				}
+			} else if match := tarpitProbeRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.tarpitBytes, err = strconv.Atoi(match[1])
+				if err != nil || res.tarpitBytes <= 0 {
+					return testParams{}, fmt.Errorf("got bad TarpitProbe in config: %q; want a byte count and a duration", lineStr)
+				}
+				res.tarpitMax, err = time.ParseDuration(match[2])
+				if err != nil || res.tarpitMax <= 0 {
+					return testParams{}, fmt.Errorf("got bad TarpitProbe in config: %q; want a byte count and a duration", lineStr)
+				}
+			} else if match := writeStrategyRegexp.FindStringSubmatch(lineStr); match != nil {
+				switch match[1] {
+				case writeEach, writeBuffered:
+				case writeCork:
+					if !corkSupported {
+						return testParams{}, fmt.Errorf("got WriteStrategy: cork in config, but TCP_CORK is only available on Linux")
+					}
+				default:
+					return testParams{}, fmt.Errorf("got bad WriteStrategy in config: %q; want each, buffered, or cork", lineStr)
+				}
+				res.writeStrategy = match[1]
+			} else if match := traceRecordsRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.traceRecords, err = strconv.ParseBool(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad TraceRecords in config: %q; %w", lineStr, err)
+				}
+			} else if match := preflightRegexp.FindStringSubmatch(lineStr); match != nil {
+				if match[1] != "same" && match[1] != "new" {
+					return testParams{}, fmt.Errorf("got bad Preflight in config: %q; want same or new", lineStr)
+				}
+				res.preflight = match[1]
+			} else if match := retryEarlyFailureRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.retryEarlyFailure, err = strconv.ParseBool(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad RetryEarlyFailure in config: %q; %w", lineStr, err)
+				}
+			} else if match := closeCompareRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.closeCompare, err = strconv.ParseBool(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad CloseCompare in config: %q; %w", lineStr, err)
+				}
+			} else if match := bodyEscapesRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.bodyEscapes, err = strconv.ParseBool(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad BodyEscapes in config: %q; %w", lineStr, err)
+				}
+			} else if match := bodyTrailingNewlineRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.bodyTrailingNewline, err = strconv.ParseBool(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad BodyTrailingNewline in config: %q; %w", lineStr, err)
+				}
+			} else if match := idleProbeRegexp.FindStringSubmatch(lineStr); match != nil {
+				min, err := time.ParseDuration(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad IdleProbe in config: %q; %w", lineStr, err)
+				}
+				max, err := time.ParseDuration(match[2])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad IdleProbe in config: %q; %w", lineStr, err)
+				}
+				if min <= 0 || max <= min {
+					return testParams{}, fmt.Errorf("got bad IdleProbe in config: %q; need 0 < min < max", lineStr)
+				}
+				res.idleProbeMin, res.idleProbeMax = min, max
+			} else if match := idleRaceRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.idleRaceAttempts, err = strconv.Atoi(match[1])
+				if err != nil || res.idleRaceAttempts <= 0 {
+					return testParams{}, fmt.Errorf("got bad IdleRace in config: %q", lineStr)
+				}
+			} else if match := idlePoolRegexp.FindStringSubmatch(lineStr); match != nil {
+				res.idlePoolSize, err = strconv.Atoi(match[1])
+				if err != nil || res.idlePoolSize <= 0 {
+					return testParams{}, fmt.Errorf("got bad IdlePool in config: %q; want a connection count and a report interval", lineStr)
+				}
+				res.idlePoolReport, err = time.ParseDuration(match[2])
+				if err != nil || res.idlePoolReport <= 0 {
+					return testParams{}, fmt.Errorf("got bad IdlePool in config: %q; want a connection count and a report interval", lineStr)
+				}
+			} else if match := stepRegexp.FindStringSubmatch(lineStr); match != nil {
+				st, err := parseStep(match[1])
+				if err != nil {
+					return testParams{}, fmt.Errorf("got bad step in config: %q; %w", lineStr, err)
+				}
+				res.bodyStartSteps = append(res.bodyStartSteps, st)
+			} else {
+				return testParams{}, fmt.Errorf("got unexpected byte-sleep: %q", lineStr)
+			}
+
+		case "body":
+			if res.body != "" {
+				res.body += "\n"
+			}
+			res.body += lineStr
+		}
+	}
+
+	if res.bodyEscapes {
+		res.body, err = unescape(res.body)
+		if err != nil {
+			return testParams{}, fmt.Errorf("got bad escape in config body: %w", err)
+		}
+	}
+	if res.bodyTrailingNewline {
+		res.body += "\n"
+	}
+	if err := res.checkTemplates(); err != nil {
+		return testParams{}, err
+	}
+	if res.watch != 0 && res.idleProbeMax == 0 {
+		return testParams{}, fmt.Errorf("Watch needs IdleProbe")
+	}
+	if (res.watchHistory != "" || len(res.notifySinks) > 0) && res.watch == 0 {
+		return testParams{}, fmt.Errorf("WatchHistory and Notify need Watch")
+	}
+	if res.uploadURI != "" && res.adviceFile == "" && res.watchHistory == "" {
+		return testParams{}, fmt.Errorf("Upload needs AdviceFile or WatchHistory")
+	}
+	if res.idleRaceAttempts != 0 && (res.idleProbeMax == 0 || res.watch != 0) {
+		return testParams{}, fmt.Errorf("IdleRace needs IdleProbe, without Watch")
+	}
+	if res.retryEarlyFailure && (res.idleProbeMax != 0 || res.idlePoolSize != 0 || res.closeCompare || res.tarpitBytes != 0) {
+		return testParams{}, fmt.Errorf("RetryEarlyFailure can't be used with IdleProbe, IdlePool, CloseCompare, or TarpitProbe")
+	}
+	if res.preflight != "" {
+		if res.idleProbeMax != 0 || res.idlePoolSize != 0 || res.closeCompare || res.tarpitBytes != 0 {
+			return testParams{}, fmt.Errorf("Preflight can't be used with IdleProbe, IdlePool, CloseCompare, or TarpitProbe")
+		}
+		if newPreflight(res).origin == "" {
+			return testParams{}, fmt.Errorf("Preflight needs an Origin header in the request")
+		}
+	}
+	if res.idlePoolSize != 0 && res.idleProbeMax != 0 {
+		return testParams{}, fmt.Errorf("IdlePool can't be used with IdleProbe")
+	}
+	if res.closeCompare && (res.idleProbeMax != 0 || res.idlePoolSize != 0) {
+		return testParams{}, fmt.Errorf("CloseCompare can't be used with IdleProbe or IdlePool")
+	}
+	if res.tarpitBytes != 0 && (res.idleProbeMax != 0 || res.idlePoolSize != 0 || res.closeCompare) {
+		return testParams{}, fmt.Errorf("TarpitProbe can't be used with IdleProbe, IdlePool, or CloseCompare")
+	}
+	if res.baseline && res.stopAfter != "" {
+		// The baseline completes the request, which StopAfter is there to avoid
+		return testParams{}, fmt.Errorf("Baseline can't be used with StopAfter")
+	}
+	if res.k8sTarget != "" && (res.sshBastion != "" || res.resolver != "") {
+		return testParams{}, fmt.Errorf("K8s can't be used with SSH or Resolver")
+	}
+	if res.maxSegment > 0 && (res.sshBastion != "" || res.k8sTarget != "") {
+		// The socket we'd set it on only goes as far as the local end of the tunnel
+		return testParams{}, fmt.Errorf("MSS can't be used with SSH or K8s")
+	}
+	if res.host == "" && res.k8sTarget == "" {
+		return testParams{}, fmt.Errorf("no host in config")
+	}
+	if len(res.trailers) > 0 {
+		for _, h := range res.headers {
+			if strings.HasPrefix(strings.ToLower(h.val), "content-length:") {
+				return testParams{}, fmt.Errorf("Trailer can't be used with a Content-Length header; the body is sent chunked")
+			}
+		}
+	}
+	if res.stopAfter == "body" && res.body == "" {
+		return testParams{}, fmt.Errorf("StopAfter: body needs a body")
+	}
+
+	return res, nil
+}
+
+// parseSleep parses a sleep given either as a duration or as a multiple of the
+// connection RTT, like "10rtt" or "0.5rtt".
+func parseSleep(s string) (sleep time.Duration, rtts float64, err error) {
+	if num := strings.TrimSuffix(s, "rtt"); num != s {
+		rtts, err = strconv.ParseFloat(num, 64)
+		if err == nil && rtts <= 0 {
+			err = fmt.Errorf("RTT multiple must be positive")
+		}
+		return 0, rtts, err
+	}
+	sleep, err = time.ParseDuration(s)
+	return sleep, 0, err
+}
+
+// scaledToRTT returns a copy of p with its RTT-relative sleeps resolved using rtt.
+func (p testParams) scaledToRTT(rtt time.Duration) testParams {
+	scale := func(d time.Duration, rtts float64) time.Duration {
+		if rtts == 0 {
+			return d
+		}
+		if d = time.Duration(rtts * float64(rtt)); d <= 0 {
+			// Zero would mean no sleep at all
+			d = 1
+		}
+		return d
+	}
+
+	p.headers = append([]header(nil), p.headers...)
+	for i, h := range p.headers {
+		p.headers[i].sleep = scale(h.sleep, h.sleepRTTs)
+	}
+	p.perByteBodySleep = scale(p.perByteBodySleep, p.perByteBodySleepRTTs)
+	p.perByteResponseReadSleep = scale(p.perByteResponseReadSleep, p.perByteResponseReadSleepRTTs)
+	p.headerEndSleep = scale(p.headerEndSleep, p.headerEndSleepRTTs)
+	p.bodyStartSleep = scale(p.bodyStartSleep, p.bodyStartSleepRTTs)
+	return p
+}
+
+// unescape interprets the escapes \r, \n, \t, \\, and \xHH in s.
+func unescape(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		switch s[i] {
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case '\\':
+			sb.WriteByte('\\')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("short \\x escape at offset %d", i-1)
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("bad \\x escape at offset %d: %w", i-1, err)
+			}
+			sb.WriteByte(byte(b))
+			i += 2
+		default:
+			return "", fmt.Errorf("unknown escape \\%c at offset %d", s[i], i-1)
+		}
+	}
+	return sb.String(), nil
+}
+
+// requestLine returns the method and path from the first configured header line.
+func (p testParams) requestLine() (method, path string) {
+	for _, h := range p.headers {
+		if !h.isLine() {
+			continue
+		}
+		fields := strings.Fields(h.val)
+		if len(fields) > 0 {
+			method = fields[0]
+		}
+		if len(fields) > 1 {
+			path = fields[1]
+		}
+		break
+	}
+	return method, path
+}
@@ -0,0 +1,344 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// headerVals returns the header lines of p, leaving out sleeps and steps.
+func headerVals(p testParams) []string {
+	var vals []string
+	for _, h := range p.headers {
+		if h.isLine() {
+			vals = append(vals, h.val)
+		}
+	}
+	return vals
+}
+
+func TestParseConfig(t *testing.T) {
+	longHeader := "X-Long: " + strings.Repeat("a", 100000)
+	tests := []struct {
+		name    string
+		config  string
+		host    string
+		headers []string
+		body    string
+		check   func(t *testing.T, p testParams)
+	}{
+		{
+			name:    "phases",
+			config:  "localhost:8585\n\nPOST / HTTP/1.1\nHost: localhost\n\nPerByteBodySleep: 1s\n\nline one\nline two\n",
+			host:    "localhost:8585",
+			headers: []string{"POST / HTTP/1.1", "Host: localhost"},
+			body:    "line one\nline two",
+			check: func(t *testing.T, p testParams) {
+				if p.perByteBodySleep != time.Second {
+					t.Errorf("perByteBodySleep = %v; want 1s", p.perByteBodySleep)
+				}
+			},
+		},
+		{
+			name:    "no body section",
+			config:  "localhost:8585\n\nGET / HTTP/1.1\n",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1"},
+		},
+		{
+			name:    "last line without newline",
+			config:  "localhost:8585\n\nGET / HTTP/1.1\n\n\nbody",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1"},
+			body:    "body",
+		},
+		{
+			name:    "comments",
+			config:  "# the target\nlocalhost:8585\n\n# the request\nGET / HTTP/1.1\n#Connection: close\nHost: localhost\n\n# no options\n\n",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1", "Host: localhost"},
+		},
+		{
+			name:    "CRLF",
+			config:  "localhost:8585\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n\r\nbody\r\n",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1", "Host: localhost"},
+			body:    "body",
+		},
+		{
+			name:    "BOM",
+			config:  "\ufefflocalhost:8585\n\nGET / HTTP/1.1\n",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1"},
+		},
+		{
+			name:    "long line",
+			config:  "localhost:8585\n\nGET / HTTP/1.1\n" + longHeader + "\nHost: localhost\n",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1", longHeader, "Host: localhost"},
+		},
+		{
+			name:    "header sleeps",
+			config:  "localhost:8585\n\nGET / HTTP/1.1\nsleep 2s\nHost: localhost\nsleep 10rtt\n",
+			host:    "localhost:8585",
+			headers: []string{"GET / HTTP/1.1", "Host: localhost"},
+			check: func(t *testing.T, p testParams) {
+				want := []header{
+					{val: "GET / HTTP/1.1"},
+					{sleep: 2 * time.Second},
+					{val: "Host: localhost"},
+					{sleepRTTs: 10},
+				}
+				if !reflect.DeepEqual(p.headers, want) {
+					t.Errorf("headers = %+v; want %+v", p.headers, want)
+				}
+			},
+		},
+		{
+			name:    "body escapes",
+			config:  "localhost:8585\n\nPOST / HTTP/1.1\n\nBodyEscapes: true\nBodyTrailingNewline: true\n\na\\r\\nb\\x00\n",
+			host:    "localhost:8585",
+			headers: []string{"POST / HTTP/1.1"},
+			body:    "a\r\nb\x00\n",
+		},
+		{
+			name:    "pre-TLS exchange",
+			config:  "PreTLSSend: STARTTLS\\r\\n\nPreTLSExpect: 220\nlocalhost:25\n\nGET / HTTP/1.1\n",
+			host:    "localhost:25",
+			headers: []string{"GET / HTTP/1.1"},
+			check: func(t *testing.T, p testParams) {
+				want := []preTLSStep{{send: "STARTTLS\r\n", expect: "220"}}
+				if !reflect.DeepEqual(p.preTLS, want) {
+					t.Errorf("preTLS = %+v; want %+v", p.preTLS, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseConfig(strings.NewReader(tt.config))
+			if err != nil {
+				t.Fatalf("parseConfig failed: %v", err)
+			}
+			if p.host != tt.host {
+				t.Errorf("host = %q; want %q", p.host, tt.host)
+			}
+			if got := headerVals(p); !reflect.DeepEqual(got, tt.headers) {
+				t.Errorf("headers = %q; want %q", got, tt.headers)
+			}
+			if p.body != tt.body {
+				t.Errorf("body = %q; want %q", p.body, tt.body)
+			}
+			if tt.check != nil {
+				tt.check(t, p)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	const head = "localhost:8585\n\nGET / HTTP/1.1\nHost: localhost\n\n"
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"no host", "\nGET / HTTP/1.1\n", "no host in config"},
+		{"bad header sleep", "localhost:8585\n\nGET / HTTP/1.1\nsleep soon\n", "bad header sleep"},
+		{"bad byte-sleep", head + "PerByteBodySleep: -1rtt\n", "bad PerByteBodySleep"},
+		{"unknown option", head + "Frobnicate: true\n", "unexpected byte-sleep"},
+		{"bad bool", head + "Baseline: maybe\n", "bad Baseline"},
+		{"bad body escape", head + "BodyEscapes: true\n\n\\q\n", "bad escape in config body"},
+		{"bad IdleProbe range", head + "IdleProbe: 10s 5s\n", "need 0 < min < max"},
+		{"Watch without IdleProbe", head + "Watch: 1h\n", "Watch needs IdleProbe"},
+		{"WatchHistory without Watch", head + "IdleProbe: 1s 10s\nWatchHistory: h.jsonl\n", "WatchHistory and Notify need Watch"},
+		{"IdleRace without IdleProbe", head + "IdleRace: 3\n", "IdleRace needs IdleProbe"},
+		{"IdleRace with Watch", head + "IdleProbe: 1s 10s\nWatch: 1h\nIdleRace: 3\n", "IdleRace needs IdleProbe, without Watch"},
+		{"IdlePool with IdleProbe", head + "IdleProbe: 1s 10s\nIdlePool: 3 1s\n", "IdlePool can't be used with IdleProbe"},
+		{"CloseCompare with IdlePool", head + "IdlePool: 3 1s\nCloseCompare: true\n", "CloseCompare can't be used"},
+		{"TarpitProbe with CloseCompare", head + "CloseCompare: true\nTarpitProbe: 1000 1s\n", "TarpitProbe can't be used"},
+		{"RetryEarlyFailure with IdleProbe", head + "IdleProbe: 1s 10s\nRetryEarlyFailure: true\n", "RetryEarlyFailure can't be used"},
+		{"Preflight without Origin", head + "Preflight: same\n", "Preflight needs an Origin header"},
+		{"Baseline with StopAfter", head + "Baseline: true\nStopAfter: headers\n", "Baseline can't be used with StopAfter"},
+		{"StopAfter body without body", head + "StopAfter: body\n", "StopAfter: body needs a body"},
+		{"K8s with SSH", "K8s: default/svc:80\nSSH: user@bastion\n\nGET / HTTP/1.1\n", "K8s can't be used with SSH or Resolver"},
+		{"MSS with SSH", "localhost:8585\nSSH: user@bastion\n\nGET / HTTP/1.1\n\nMSS: 500\n", "MSS can't be used with SSH or K8s"},
+		{"Upload without output", head + "Upload: s3://bucket/x.json\n", "Upload needs AdviceFile or WatchHistory"},
+		{"Trailer with Content-Length", "localhost:8585\n\nPOST / HTTP/1.1\nContent-Length: 1\n\nTrailer: X-Sum: 1\n\nx\n", "Trailer can't be used with a Content-Length header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(strings.NewReader(tt.config))
+			if err == nil {
+				t.Fatalf("parseConfig succeeded; want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseConfig error = %q; want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{in: "plain", want: "plain"},
+		{in: "", want: ""},
+		{in: `a\r\nb`, want: "a\r\nb"},
+		{in: `\t\\`, want: "\t\\"},
+		{in: `\x00\xff\x41`, want: "\x00\xffA"},
+		{in: `\x4`, wantErr: "short \\x escape"},
+		{in: `\xzz`, wantErr: "bad \\x escape"},
+		{in: `\q`, wantErr: "unknown escape"},
+		{in: `trailing\`, wantErr: "trailing backslash"},
+	}
+	for _, tt := range tests {
+		got, err := unescape(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("unescape(%q) error = %v; want it to contain %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("unescape(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseSleep(t *testing.T) {
+	tests := []struct {
+		in      string
+		sleep   time.Duration
+		rtts    float64
+		wantErr bool
+	}{
+		{in: "1500ms", sleep: 1500 * time.Millisecond},
+		{in: "2m", sleep: 2 * time.Minute},
+		{in: "10rtt", rtts: 10},
+		{in: "0.5rtt", rtts: 0.5},
+		{in: "0rtt", wantErr: true},
+		{in: "-1rtt", wantErr: true},
+		{in: "rtt", wantErr: true},
+		{in: "10", wantErr: true},
+		{in: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		sleep, rtts, err := parseSleep(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSleep(%q) succeeded; want an error", tt.in)
+			}
+			continue
+		}
+		if err != nil || sleep != tt.sleep || rtts != tt.rtts {
+			t.Errorf("parseSleep(%q) = %v, %v, %v; want %v, %v", tt.in, sleep, rtts, err, tt.sleep, tt.rtts)
+		}
+	}
+}
+
+func TestScaledToRTT(t *testing.T) {
+	p := testParams{
+		headers:              []header{{val: "GET / HTTP/1.1"}, {sleepRTTs: 2}, {sleep: time.Second}},
+		perByteBodySleepRTTs: 0.5,
+		headerEndSleep:       3 * time.Second,
+	}
+	s := p.scaledToRTT(100 * time.Millisecond)
+	if s.headers[1].sleep != 200*time.Millisecond || s.headers[2].sleep != time.Second {
+		t.Errorf("header sleeps = %v, %v; want 200ms, 1s", s.headers[1].sleep, s.headers[2].sleep)
+	}
+	if s.perByteBodySleep != 50*time.Millisecond {
+		t.Errorf("perByteBodySleep = %v; want 50ms", s.perByteBodySleep)
+	}
+	if s.headerEndSleep != 3*time.Second {
+		t.Errorf("headerEndSleep = %v; want 3s", s.headerEndSleep)
+	}
+	if p.headers[1].sleep != 0 {
+		t.Errorf("scaledToRTT changed the original's headers")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	p, err := parseConfig(strings.NewReader("localhost:8585\n\nPOST / HTTP/1.1\nX-Literal: {{\"{{\"}}x}}\n\n\n{{\"{{\"}}\n"))
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+	e, err := p.expanded(nil)
+	if err != nil {
+		t.Fatalf("expanded failed: %v", err)
+	}
+	if got := headerVals(e)[1]; got != "X-Literal: {{x}}" {
+		t.Errorf("escaped header = %q; want %q", got, "X-Literal: {{x}}")
+	}
+	if e.body != "{{" {
+		t.Errorf("escaped body = %q; want %q", e.body, "{{")
+	}
+
+	_, err = parseConfig(strings.NewReader("localhost:8585\n\nPOST / HTTP/1.1\n\n\n{{x\n"))
+	if err == nil || !strings.Contains(err.Error(), literalBracesHint) {
+		t.Errorf("unescaped {{ error = %v; want it to say how to escape it", err)
+	}
+
+	// The body is only known to be empty once it's expanded
+	p, err = parseConfig(strings.NewReader("localhost:8585\n\nPOST / HTTP/1.1\n\nStopAfter: body\n\n{{env \"HTTPTIMEOUT_TEST_UNSET\"}}\n"))
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+	if _, err := p.expanded(nil); err == nil {
+		t.Errorf("StopAfter: body with a body that expanded to nothing wasn't an error")
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	config := "# the target\nlocalhost:8585\n\nPOST /login HTTP/1.1\nsleep 1500ms\nHost: localhost:8585\n\nPerByteBodySleep: 100ms\nPerByteResponseReadSleep: 10ms\n\nline one\nline two\n"
+	filename := filepath.Join(t.TempDir(), "config.txt")
+	if err := os.WriteFile(filename, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.host != "localhost:8585" {
+		t.Errorf("host = %q; want localhost:8585", p.host)
+	}
+	if len(p.headers) != 3 {
+		t.Fatalf("got %d headers; want 3", len(p.headers))
+	}
+	if p.headers[0].val != "POST /login HTTP/1.1" || p.headers[2].val != "Host: localhost:8585" {
+		t.Errorf("headers = %q, %q", p.headers[0].val, p.headers[2].val)
+	}
+	if p.headers[1].val != "" || p.headers[1].sleep != 1500*time.Millisecond {
+		t.Errorf("header sleep = %q, %v; want 1.5s", p.headers[1].val, p.headers[1].sleep)
+	}
+	if p.perByteBodySleep != 100*time.Millisecond || p.perByteResponseReadSleep != 10*time.Millisecond {
+		t.Errorf("byte sleeps = %v, %v; want 100ms, 10ms", p.perByteBodySleep, p.perByteResponseReadSleep)
+	}
+	if p.body != "line one\nline two" {
+		t.Errorf("body = %q", p.body)
+	}
+
+	bad := map[string]string{
+		"bad header sleep":   "localhost:8585\n\nGET / HTTP/1.1\nsleep soon\n",
+		"bad byte sleep":     "localhost:8585\n\nGET / HTTP/1.1\n\nPerByteBodySleep: slow\n",
+		"unknown byte sleep": "localhost:8585\n\nGET / HTTP/1.1\n\nPerByteSleep: 1s\n",
+	}
+	for name, config := range bad {
+		filename := filepath.Join(t.TempDir(), "config.txt")
+		if err := os.WriteFile(filename, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(filename); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := readConfig(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
@@ -6,6 +6,10 @@ package main
 
 import "syscall"
 
-func connCheck(sc syscall.Conn) error {
+func connCheck(sc syscall.Conn) (readable bool, err error) {
+	return false, nil
+}
+
+func writeCheck(sc syscall.Conn) error {
 	return nil
 }
@@ -10,11 +10,13 @@ import (
 )
 
 // From https://stackoverflow.com/a/58664631/729729
-func connCheck(sc syscall.Conn) error {
+// readable is true if there is data waiting to be read, in which case a close
+// can't be detected until that data has been consumed.
+func connCheck(sc syscall.Conn) (readable bool, err error) {
 	var sysErr error = nil
 	rc, err := sc.SyscallConn()
 	if err != nil {
-		return err
+		return false, err
 	}
 	err = rc.Read(func(fd uintptr) bool {
 		var buf []byte = []byte{0}
@@ -24,14 +26,41 @@ func connCheck(sc syscall.Conn) error {
 			sysErr = io.EOF
 		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK:
 			sysErr = nil
+		case n > 0:
+			readable = true
+			sysErr = nil
 		default:
 			sysErr = err
 		}
 		return true
 	})
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	return readable, sysErr
+}
+
+// writeCheck reports a pending error on the socket (SO_ERROR), like a reset or an
+// unreachable host, without writing to it. These are otherwise only discovered by the
+// next write, which may be a long sleep away.
+func writeCheck(sc syscall.Conn) error {
+	var sysErr error
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	err = rc.Control(func(fd uintptr) {
+		soErr, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		switch {
+		case err != nil:
+			sysErr = err
+		case soErr != 0:
+			sysErr = syscall.Errno(soErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
 	return sysErr
 }
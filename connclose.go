@@ -0,0 +1,182 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// closeCompareWait is how long to wait, after the response, for the server to close
+// the connection.
+const closeCompareWait = 5 * time.Second
+
+// closeOutcome is how the server handled the request on one connection.
+type closeOutcome struct {
+	// ttfb is from the request being written to the first response byte
+	ttfb time.Duration
+	// done is from the request being written to the end of the response
+	done time.Duration
+	// end describes how the connection ended, if it did within closeCompareWait of
+	// the response, which endAfter is how long after
+	end      string
+	endAfter time.Duration
+}
+
+// runCloseCompare sends the configured request at normal speed twice, each on its own
+// connection, once with Connection: keep-alive and once with Connection: close, and
+// reports the differences. Some servers treat a connection they know they'll close
+// differently, like giving it shorter write or lingering-close timeouts.
+func runCloseCompare(params testParams) {
+	fmt.Printf("comparing Connection: keep-alive and Connection: close with %s\n\n", params.host)
+
+	var outcomes [2]closeOutcome
+	for i, value := range []string{"keep-alive", "close"} {
+		o, err := closeCompareOnce(params, value)
+		if err != nil {
+			fmt.Printf(red("Connection: %s request failed: %v\n"), value, err)
+			return
+		}
+		outcomes[i] = o
+		fmt.Printf(cyan("Connection: %-10s first response byte after %v, response complete after %v, %s\n"),
+			value, o.ttfb, o.done, o.describeEnd())
+	}
+
+	keep, closed := outcomes[0], outcomes[1]
+	fmt.Println()
+	switch {
+	case keep.end == "" && closed.end == "":
+		fmt.Println(yellow("the server didn't close either connection; it may not honour Connection: close"))
+	case keep.end != "" && closed.end != "":
+		fmt.Println(yellow("the server closed both connections; it may not support keep-alive"))
+	case keep.end != "":
+		fmt.Println(yellow("the server closed the keep-alive connection but not the one it was asked to close"))
+	}
+	if keep.end != closed.end && keep.end != "" && closed.end != "" {
+		fmt.Printf(cyan("the connections ended differently: %s with keep-alive, %s with close\n"), keep.end, closed.end)
+	}
+	fmt.Printf(cyan("response complete %v with Connection: close than with keep-alive\n"), laterOrSooner(closed.done-keep.done))
+}
+
+// laterOrSooner describes a difference between two durations.
+func laterOrSooner(d time.Duration) string {
+	if d < 0 {
+		return fmt.Sprintf("%v sooner", -d)
+	}
+	return fmt.Sprintf("%v later", d)
+}
+
+// describeEnd describes how the connection ended.
+func (o closeOutcome) describeEnd() string {
+	if o.end == "" {
+		return fmt.Sprintf("still open %v later", closeCompareWait)
+	}
+	return fmt.Sprintf("%s %v later", o.end, o.endAfter)
+}
+
+// closeCompareOnce sends the configured request, with its Connection header set to
+// connection, on a new connection and times the response and the end of the
+// connection.
+func closeCompareOnce(params testParams, connection string) (closeOutcome, error) {
+	params.headers = withConnectionHeader(params.headers, connection)
+	conn, err := dial(params)
+	if err != nil {
+		return closeOutcome{}, err
+	}
+	defer conn.c.Close()
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	if _, err := conn.c.Write([]byte(fastRequest(params))); err != nil {
+		return closeOutcome{}, fmt.Errorf("request write failed: %w", err)
+	}
+	sent := time.Now()
+	head, err := readResponseHead(conn)
+	if err != nil {
+		return closeOutcome{}, fmt.Errorf("no response: %w", err)
+	}
+	method, _ := params.requestLine()
+	status := responseStatus(head)
+	if method != "HEAD" && status != "204" && status != "304" {
+		if err := readResponseBody(conn, head); err != nil {
+			return closeOutcome{}, fmt.Errorf("response body read failed: %w", err)
+		}
+	}
+
+	o := closeOutcome{ttfb: conn.firstByteTime.Sub(sent), done: conn.lastReadTime.Sub(sent)}
+	deadline := time.Now().Add(closeCompareWait)
+	for {
+		if _, err := readByte(conn, deadline); err != nil {
+			if !isTimeout(err) {
+				o.end, o.endAfter = describeEnd(err), conn.readEndTime.Sub(conn.lastReadTime)
+			}
+			break
+		}
+	}
+	return o, nil
+}
+
+// withConnectionHeader returns headers with any Connection header replaced by one
+// with value, or one added after the request line if there wasn't one.
+func withConnectionHeader(headers []header, value string) []header {
+	var res []header
+	added := false
+	for _, h := range headers {
+		if strings.HasPrefix(strings.ToLower(h.val), "connection:") {
+			if !added {
+				res = append(res, header{val: "Connection: " + value})
+				added = true
+			}
+			continue
+		}
+		res = append(res, h)
+		if !added && h.isLine() && len(res) == 1 {
+			res = append(res, header{val: "Connection: " + value})
+			added = true
+		}
+	}
+	return res
+}
+
+var contentLengthRegexp = regexp.MustCompile(`(?im)^content-length:\s*(\d+)\s*$`)
+
+// readResponseBody reads the body of the response with headers head, going by its
+// Content-Length or chunked encoding. A response with neither is read until the
+// connection ends.
+func readResponseBody(conn *conn, head []byte) error {
+	deadline := time.Now().Add(idleProbeResponseTimeout)
+	if m := contentLengthRegexp.FindSubmatch(head); m != nil {
+		n, err := strconv.Atoi(string(m[1]))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if _, err := readByte(conn, deadline); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	chunked := bytes.Contains(bytes.ToLower(head), []byte("transfer-encoding: chunked"))
+	var body []byte
+	for {
+		b, err := readByte(conn, deadline)
+		if err != nil {
+			if !chunked && !isTimeout(err) {
+				// The end of the connection is the end of the body
+				return nil
+			}
+			return err
+		}
+		body = append(body, b)
+		if chunked && bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+			if _, complete := chunkedTrailers(body); complete {
+				return nil
+			}
+		}
+	}
+}
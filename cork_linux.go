@@ -0,0 +1,31 @@
+//go:build linux
+
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import "syscall"
+
+// corkSupported is true where setCork works.
+const corkSupported = true
+
+// setCork sets or clears TCP_CORK on the socket. While it's set, the kernel only
+// sends full segments; clearing it sends what's queued.
+func setCork(sc syscall.Conn, on bool) error {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	var sysErr error
+	err = rc.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, v)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
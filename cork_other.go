@@ -0,0 +1,17 @@
+//go:build !linux
+
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// corkSupported is true where setCork works.
+const corkSupported = false
+
+func setCork(sc syscall.Conn, on bool) error {
+	return errors.New("TCP_CORK is only available on Linux")
+}
@@ -0,0 +1,69 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The custom step types that come with the tool. They're registered like any other
+// would be, and serve as examples.
+func init() {
+	registerStepType("write", "<text with backslash escapes>", func(args string) (step, error) {
+		text, err := unescape(args)
+		if err != nil {
+			return nil, err
+		}
+		if text == "" {
+			return nil, errors.New("nothing to write")
+		}
+		return writeStep{text: text}, nil
+	})
+	registerStepType("expect", "<within> <text>", func(args string) (step, error) {
+		within, text, _ := strings.Cut(args, " ")
+		d, err := time.ParseDuration(within)
+		if err != nil {
+			return nil, err
+		}
+		if text == "" {
+			return nil, errors.New("no text to expect")
+		}
+		return expectStep{within: d, text: text}, nil
+	})
+}
+
+// errExpectFailed interrupts the request when the server didn't send what an expect
+// step was waiting for.
+var errExpectFailed = errors.New("expected response not received")
+
+// expectStep waits for the server to have sent text (like "100 Continue") before the
+// request goes on, and interrupts it if that doesn't happen within the time given.
+type expectStep struct {
+	within time.Duration
+	text   string
+}
+
+func (s expectStep) run(r *run) {
+	conn := r.conn
+	// Whatever's held back has to go out before the server can answer it
+	r.err = flushWrites(r.err, conn, false)
+	if r.err != nil {
+		fmt.Printf("skipping expect %q\n", s.text)
+		return
+	}
+
+	fmt.Println(timestamp(conn) + yellow(fmt.Sprintf("waiting up to %v for %q", s.within, s.text)))
+	start := time.Now()
+	for !strings.Contains(string(conn.response), s.text) {
+		if conn.earlyErr != nil || time.Since(start) >= s.within {
+			fmt.Println(timestamp(conn) + red(fmt.Sprintf("the server didn't send %q", s.text)))
+			r.err = errExpectFailed
+			return
+		}
+		readDuring(conn, 10*time.Millisecond)
+	}
+	fmt.Println(timestamp(conn) + cyan(fmt.Sprintf("got %q after %v", s.text, time.Since(start).Round(time.Millisecond))))
+}
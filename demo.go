@@ -0,0 +1,102 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// demoFiles are the docker-compose stack written by the demo command, along with the
+// example server's source to build into it.
+//
+//go:embed demo example-server/*.go
+var demoFiles embed.FS
+
+// demoAppGoMod is the go.mod for building the example server on its own.
+const demoAppGoMod = "module example-server\n\ngo 1.18\n"
+
+// newDemoFlagSet defines the demo subcommand's flags.
+func newDemoFlagSet() (flags *flag.FlagSet, dir *string, up *bool) {
+	flags = flag.NewFlagSet("demo", flag.ExitOnError)
+	dir = flags.String("dir", "httptimeout-demo", "directory to write the demo to")
+	up = flags.Bool("up", false, "start the demo with docker compose once it's written")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: httptimeout demo [flags]")
+		flags.PrintDefaults()
+	}
+	return flags, dir, up
+}
+
+// runDemo writes a docker-compose stack that puts the example server behind nginx,
+// HAProxy, and Envoy with known timeouts, along with scenarios and an inventory to
+// run against it, and starts it if asked. args are the command line arguments after
+// "demo".
+func runDemo(args []string) {
+	flags, dir, up := newDemoFlagSet()
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return
+	}
+
+	if err := writeDemo(*dir); err != nil {
+		fmt.Println(red("failed to write demo:"), err)
+		return
+	}
+	fmt.Printf(cyan("demo written to %s\n"), *dir)
+
+	if !*up {
+		fmt.Printf("start it with `docker compose up -d --build` in %s, then try:\n", *dir)
+	} else {
+		cmd := exec.Command("docker", "compose", "up", "-d", "--build")
+		cmd.Dir = *dir
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Println(red("docker compose failed:"), err)
+			return
+		}
+		fmt.Println(cyan("demo started; try:"))
+	}
+	fmt.Printf("  httptimeout %s\n", filepath.Join(*dir, "scenarios", "slow-headers-nginx.txt"))
+	fmt.Printf("  httptimeout audit -bound 40s -inventory %s\n", filepath.Join(*dir, "inventory.txt"))
+}
+
+// writeDemo writes the demo files to dir, with the example server's source in app.
+func writeDemo(dir string) error {
+	err := fs.WalkDir(demoFiles, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := demoFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		var out string
+		if rest := strings.TrimPrefix(name, "example-server/"); rest != name {
+			out = path.Join("app", rest)
+		} else {
+			out = strings.TrimPrefix(name, "demo/")
+		}
+		return writeDemoFile(dir, out, b)
+	})
+	if err != nil {
+		return err
+	}
+	return writeDemoFile(dir, "app/go.mod", []byte(demoAppGoMod))
+}
+
+func writeDemoFile(dir, name string, b []byte) error {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0o644)
+}
@@ -0,0 +1,45 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import "fmt"
+
+// printDifferential compares audits of the same target through its edge (like a CDN
+// or load balancer) and directly at its origin, and attributes each timeout to the
+// layer that enforces it.
+func printDifferential(edge, origin auditResult, originAddr string) {
+	fmt.Printf("edge vs origin (%s):\n\n", originAddr)
+	for i, e := range edge.findings {
+		o := origin.findings[i]
+		if e.err != nil || o.err != nil {
+			fmt.Printf("  %-24s %s\n", e.probe, yellow("can't compare: a probe failed"))
+			continue
+		}
+		fmt.Printf("  %-24s edge: %s\n", e.probe, e.outcome)
+		fmt.Printf("  %-24s origin: %s\n", "", o.outcome)
+		fmt.Printf("  %-24s %s\n", "", cyan(attributeTimeout(e, o)))
+	}
+	fmt.Println()
+}
+
+// attributeTimeout says which layer a timeout measured at the edge and at the origin
+// belongs to.
+func attributeTimeout(edge, origin auditFinding) string {
+	e, o := edge.after, origin.after
+	switch {
+	case e == 0 && o == 0 && edge.outcome == origin.outcome:
+		return "same at both"
+	case e == 0 && o == 0:
+		return "the edge answers differently from the origin"
+	case e == 0:
+		return fmt.Sprintf("the origin's %v is hidden by the edge, which doesn't time out", o)
+	case o == 0:
+		return fmt.Sprintf("edge layer: %v, which the origin doesn't have", e)
+	case meetsExpectation(e, o):
+		return fmt.Sprintf("origin layer: %v, passed through the edge (or both happen to agree)", o)
+	case e < o:
+		return fmt.Sprintf("edge layer: %v, shorter than the origin's %v", e, o)
+	default:
+		return fmt.Sprintf("edge layer: %v; the origin's shorter %v is hidden behind it", e, o)
+	}
+}
@@ -0,0 +1,63 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventRetention is how long a connection's events are kept after its last one.
+const eventRetention = 10 * time.Minute
+
+// serverEvent is something the server did on a connection.
+type serverEvent struct {
+	At    time.Time `json:"at"`
+	Event string    `json:"event"`
+}
+
+// eventLog holds each connection's events, keyed by the client's address, so that
+// the client can fetch them afterwards and merge them into its own timeline.
+type eventLog struct {
+	mu     sync.Mutex
+	byAddr map[string][]serverEvent
+}
+
+var events = &eventLog{byAddr: map[string][]serverEvent{}}
+
+// record adds an event for the connection from addr.
+func (l *eventLog) record(addr, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.byAddr[addr] = append(l.byAddr[addr], serverEvent{At: now, Event: fmt.Sprintf(format, args...)})
+	for a, evs := range l.byAddr {
+		if now.Sub(evs[len(evs)-1].At) > eventRetention {
+			delete(l.byAddr, a)
+		}
+	}
+}
+
+// ServeHTTP returns the events for the connection from ?client=<host:port> as JSON.
+func (l *eventLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	l.mu.Lock()
+	evs := l.byAddr[req.URL.Query().Get("client")]
+	l.mu.Unlock()
+
+	if evs == nil {
+		evs = []serverEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(evs)
+}
+
+// recordConnState is an http.Server.ConnState hook that records connection state
+// changes as events.
+func recordConnState(c net.Conn, state http.ConnState) {
+	events.record(c.RemoteAddr().String(), "connection %v", state)
+}
@@ -3,33 +3,103 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 )
 
 func main() {
+	var netem netemConfig
+	flag.DurationVar(&netem.latency, "latency", 0, "latency added to each read and write on accepted connections")
+	flag.IntVar(&netem.bandwidth, "bandwidth", 0, "bandwidth cap for each direction of accepted connections, in bytes/sec (0 is unlimited)")
+	flag.Float64Var(&netem.resetChance, "reset-chance", 0, "probability that a read or write on an accepted connection resets it")
+	useTLS := flag.Bool("tls", false, "serve HTTPS with a self-signed certificate, logging TLS handshake timing")
+	addr := flag.String("addr", "localhost:8585", "address to listen on")
+	clientLogFile := flag.String("client-log", "", "append the outcome of each /slow response to this file as a line of JSON")
+	maxHeaderBytes := flag.Int("max-header-bytes", 0, "http.Server.MaxHeaderBytes (0 is the stdlib default of 1MB; it also allows 4KB of slack)")
+	flag.Parse()
+
+	if *clientLogFile != "" {
+		f, err := os.OpenFile(*clientLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		clients.file = f
+	}
+
 	makeHandler := func(handlerTimeout time.Duration) http.Handler {
 		return statusLoggerMiddleware(http.TimeoutHandler(http.HandlerFunc(requestHandler), handlerTimeout, ""))
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle("/", makeHandler(3*time.Second))
+	// Without the TimeoutHandler, a slow request runs into the server's WriteTimeout
+	mux.Handle("/no-handler-timeout/", statusLoggerMiddleware(http.HandlerFunc(requestHandler)))
+	// TimeoutHandler buffers the whole response, so streaming can't go through it
+	mux.Handle("/drip", statusLoggerMiddleware(http.HandlerFunc(dripHandler)))
+	mux.Handle("/hijack", statusLoggerMiddleware(http.HandlerFunc(hijackHandler)))
+	// For testing clients' timeouts: the response is sent slowly, a stage at a time
+	mux.Handle("/slow", statusLoggerMiddleware(http.HandlerFunc(slowHandler)))
+	// What each client did with its slow responses, and what its timeouts seem to be
+	mux.Handle("/clients", clients)
+	// The server's side of each connection's timeline, for the client to merge with its own
+	mux.Handle("/events", events)
+
 	srv := &http.Server{
 		ReadHeaderTimeout: 2 * time.Second,
 		ReadTimeout:       4 * time.Second,
 		WriteTimeout:      5 * time.Second,
 		IdleTimeout:       13 * time.Second,
-		Handler:           makeHandler(3 * time.Second),
+		MaxHeaderBytes:    *maxHeaderBytes,
+		Handler:           mux,
+		ConnState:         recordConnState,
 
-		Addr: "localhost:8585",
+		Addr: *addr,
 	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
-		log.Fatal(srv.ListenAndServe())
+		l, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *useTLS {
+			l = &handshakeTimingListener{Listener: l}
+			// The stdlib only does TLS for a *tls.Conn it makes itself, so a wrapper can
+			// only go beneath it, where the 431 is encrypted
+			fmt.Println("under -tls, 431 rejections aren't logged")
+		} else {
+			// The server rejects oversized headers itself, so the handler never sees them
+			l = &rejectLoggingListener{Listener: l}
+		}
+		if netem.enabled() {
+			fmt.Printf("netem: latency %v, bandwidth %d B/s, reset chance %v\n", netem.latency, netem.bandwidth, netem.resetChance)
+			l = &netemListener{Listener: l, cfg: netem}
+		}
+		if *useTLS {
+			cert, err := selfSignedCert()
+			if err != nil {
+				log.Fatal(err)
+			}
+			srv.TLSConfig = handshakeTimingConfig(cert)
+			srv.ConnState = func(c net.Conn, state http.ConnState) {
+				recordConnState(c, state)
+				logHandshakeGiveUp(c, state)
+			}
+			log.Fatal(srv.ServeTLS(l, "", ""))
+		}
+		log.Fatal(srv.Serve(l))
 		wg.Done()
 	}()
 
@@ -43,6 +113,34 @@ func requestHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Println("\n url:", req.URL.String())
 	fmt.Println("hdrs:", req.Header)
 
+	// For a request with "Expect: 100-continue", the server sends the 100 Continue when
+	// the body is first read. ?continue-delay=<duration> delays that, and
+	// ?continue=never withholds it: the body is never read, and the response only comes
+	// after ?continue-wait=<duration>. The default of 4s is as long as a response can
+	// wait here and still beat the server's 5s WriteTimeout.
+	if req.Header.Get("Expect") == "100-continue" {
+		if req.URL.Query().Get("continue") == "never" {
+			wait, err := time.ParseDuration(req.URL.Query().Get("continue-wait"))
+			if err != nil {
+				wait = 4 * time.Second
+			}
+			fmt.Println("withholding 100 Continue for", wait)
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				fmt.Println("gave up withholding 100 Continue:", req.Context().Err())
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("this is the response from the server, sent without reading the body"))
+			return
+		}
+		if delay, err := time.ParseDuration(req.URL.Query().Get("continue-delay")); err == nil {
+			fmt.Println("delaying 100 Continue:", delay)
+			time.Sleep(delay)
+		}
+	}
+
 	body, err := io.ReadAll(req.Body)
 	defer req.Body.Close()
 
@@ -51,19 +149,126 @@ func requestHandler(w http.ResponseWriter, req *http.Request) {
 
 	if err != nil {
 		fmt.Printf("body read error: %v\n", err)
+		events.record(req.RemoteAddr, "body read error after %d bytes: %v", len(body), err)
+	} else {
+		events.record(req.RemoteAddr, "body read (%d bytes)", len(body))
 	}
 	fmt.Println("body:", string(body))
 
+	// ?sleep=<duration> makes the handler slow
+	if sleep, err := time.ParseDuration(req.URL.Query().Get("sleep")); err == nil {
+		fmt.Println("handler sleeping:", sleep)
+		time.Sleep(sleep)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("this is the response from the server"))
 
 	fmt.Printf("total time: %v; time since body read:%v\n", time.Since(startTime), time.Since(readTime))
 }
 
+// dripHandler sends a chunked response a piece at a time, flushing each one.
+// ?chunks=<n> (default 10), ?size=<bytes> (default 1), and ?interval=<duration>
+// (default 1s) control it. The server's WriteTimeout still applies to the whole
+// response.
+func dripHandler(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	chunks, err := strconv.Atoi(q.Get("chunks"))
+	if err != nil {
+		chunks = 10
+	}
+	size, err := strconv.Atoi(q.Get("size"))
+	if err != nil || size < 1 {
+		size = 1
+	}
+	interval, err := time.ParseDuration(q.Get("interval"))
+	if err != nil {
+		interval = time.Second
+	}
+
+	fmt.Printf("\ndripping %d chunks of %d bytes every %v\n", chunks, size, interval)
+	startTime := time.Now()
+
+	chunk := bytes.Repeat([]byte("x"), size)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for i := 0; i < chunks; i++ {
+		if i != 0 {
+			time.Sleep(interval)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			fmt.Printf("drip write error after %d chunks (%v): %v\n", i, time.Since(startTime), err)
+			return
+		}
+		// Flushing sends each write as its own chunk
+		w.(http.Flusher).Flush()
+	}
+
+	fmt.Println("drip done:", time.Since(startTime))
+}
+
+// hijackHandler takes over the connection and misbehaves, for testing how the client
+// copes with a broken server. ?send= is what to send first: nothing (the default),
+// "status" (just a status line), "partial" (a status line and headers without the
+// blank line that ends them), or "garbage" (bytes that aren't HTTP). Then it stalls
+// for ?stall=<duration> (default 5s) and ends with ?end=: "close" (the default),
+// "reset", or "hang" (leave the connection open until the client closes it).
+func hijackHandler(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	stall, err := time.ParseDuration(q.Get("stall"))
+	if err != nil {
+		stall = 5 * time.Second
+	}
+
+	var send string
+	switch q.Get("send") {
+	case "status":
+		send = "HTTP/1.1 200 OK\r\n"
+	case "partial":
+		send = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 100\r\n"
+	case "garbage":
+		send = "\x00\xff not http at all \x1b[0m\r\n\r\n"
+	}
+
+	c, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		fmt.Println("hijack failed:", err)
+		return
+	}
+	defer c.Close()
+	// The server's deadlines would otherwise still apply
+	c.SetDeadline(time.Time{})
+
+	fmt.Printf("\nhijacked connection from %v; sending %q, then stalling for %v\n", c.RemoteAddr(), send, stall)
+	if send != "" {
+		if _, err := c.Write([]byte(send)); err != nil {
+			fmt.Println("hijack write error:", err)
+			return
+		}
+	}
+	time.Sleep(stall)
+
+	switch q.Get("end") {
+	case "reset":
+		fmt.Println("resetting hijacked connection")
+		// With a zero linger, close sends a RST rather than a FIN
+		if tc := tcpConn(c); tc != nil {
+			tc.SetLinger(0)
+		}
+	case "hang":
+		fmt.Println("hanging hijacked connection until the client leaves")
+		io.Copy(io.Discard, c)
+	default:
+		fmt.Println("closing hijacked connection")
+	}
+}
+
 func statusLoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		srrw := &statusRecorderResponseWriter{ResponseWriter: w}
+		events.record(req.RemoteAddr, "handler started for %s %s", req.Method, req.URL.Path)
 		next.ServeHTTP(srrw, req)
+		events.record(req.RemoteAddr, "handler done, status %d", srrw.Status)
 
 		if srrw.Status == 503 {
 			fmt.Println("responded with status: 503 REQUEST TIMEOUT", srrw.Status)
@@ -84,6 +289,16 @@ func (r *statusRecorderResponseWriter) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+func (r *statusRecorderResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (r *statusRecorderResponseWriter) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 /*
 func (r *statusRecorderResponseWriter) Write(b []byte) (int, error) {
 	// We're going to flush (chunk) each byte in an attempt to de-buffer the write, but it doesn't seem to work
@@ -101,3 +316,30 @@ func (r *statusRecorderResponseWriter) Write(b []byte) (int, error) {
 	return totalN, nil
 }
 */
+
+// rejectLoggingListener logs when the server itself rejects a request with 431 Request
+// Header Fields Too Large, which never reaches a handler.
+type rejectLoggingListener struct {
+	net.Listener
+}
+
+func (l *rejectLoggingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rejectLoggingConn{Conn: c, start: time.Now()}, nil
+}
+
+type rejectLoggingConn struct {
+	net.Conn
+	start time.Time
+}
+
+func (c *rejectLoggingConn) Write(b []byte) (int, error) {
+	if bytes.HasPrefix(b, []byte("HTTP/1.1 431")) {
+		fmt.Printf("\nrejected request from %v with 431 (headers too large) after %v\n", c.RemoteAddr(), time.Since(c.start))
+		events.record(c.RemoteAddr().String(), "rejected request with 431 (headers too large)")
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,106 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// netemConfig is the network impairment applied to accepted connections.
+type netemConfig struct {
+	// latency is added to each read and write
+	latency time.Duration
+	// bandwidth caps each direction, in bytes per second; 0 is unlimited
+	bandwidth int
+	// resetChance is the probability that any read or write resets the connection
+	resetChance float64
+}
+
+func (c netemConfig) enabled() bool {
+	return c.latency > 0 || c.bandwidth > 0 || c.resetChance > 0
+}
+
+// netemListener applies network impairment to the connections it accepts, so that
+// client timeout behaviour can be studied locally without tc/netem privileges.
+type netemListener struct {
+	net.Listener
+	cfg netemConfig
+}
+
+func (l *netemListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &netemConn{Conn: c, cfg: l.cfg}, nil
+}
+
+type netemConn struct {
+	net.Conn
+	cfg netemConfig
+}
+
+func (c *netemConn) Read(b []byte) (int, error) {
+	if err := c.maybeReset("read"); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	c.delay(n)
+	return n, err
+}
+
+func (c *netemConn) Write(b []byte) (int, error) {
+	if err := c.maybeReset("write"); err != nil {
+		return 0, err
+	}
+	c.delay(len(b))
+	return c.Conn.Write(b)
+}
+
+// delay sleeps for the latency plus the time n bytes take at the bandwidth cap.
+func (c *netemConn) delay(n int) {
+	d := c.cfg.latency
+	if c.cfg.bandwidth > 0 {
+		d += time.Duration(n) * time.Second / time.Duration(c.cfg.bandwidth)
+	}
+	time.Sleep(d)
+}
+
+// maybeReset randomly aborts the connection with a RST.
+func (c *netemConn) maybeReset(op string) error {
+	if c.cfg.resetChance <= 0 || rand.Float64() >= c.cfg.resetChance {
+		return nil
+	}
+	fmt.Printf("netem: resetting connection from %v on %s\n", c.RemoteAddr(), op)
+	if tc := tcpConn(c.Conn); tc != nil {
+		// With a zero linger, close sends a RST rather than a FIN
+		tc.SetLinger(0)
+	}
+	c.Conn.Close()
+	return fmt.Errorf("netem: connection reset")
+}
+
+// tcpConn unwraps our listener wrappers to find the TCP connection, or returns nil if
+// there isn't one.
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch wc := c.(type) {
+		case *net.TCPConn:
+			return wc
+		case *netemConn:
+			c = wc.Conn
+		case *rejectLoggingConn:
+			c = wc.Conn
+		case *handshakeTimingConn:
+			c = wc.Conn
+		case *tls.Conn:
+			c = wc.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowHandler sends its response slowly, one stage at a time, for testing an HTTP
+// client's timeouts rather than the server's. ?status-delay=<duration> delays the
+// status line, ?header-delay=<duration> delays the header block after it, and
+// ?chunk-delay=<duration> delays each of ?chunks=<n> (default 5) body chunks of
+// ?size=<bytes> (default 1). Setting them separately tells a client's response header
+// timeout (like Go's Transport.ResponseHeaderTimeout) from its overall timeout (like
+// http.Client.Timeout). If the client gives up, the stage it gave up at is logged.
+func slowHandler(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	delay := func(name string) time.Duration {
+		d, _ := time.ParseDuration(q.Get(name))
+		return d
+	}
+	statusDelay, headerDelay, chunkDelay := delay("status-delay"), delay("header-delay"), delay("chunk-delay")
+	chunks, err := strconv.Atoi(q.Get("chunks"))
+	if err != nil || chunks < 0 {
+		chunks = 5
+	}
+	size, err := strconv.Atoi(q.Get("size"))
+	if err != nil || size < 1 {
+		size = 1
+	}
+
+	c, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		fmt.Println("hijack failed:", err)
+		return
+	}
+	defer c.Close()
+	// The server's deadlines would otherwise still apply
+	c.SetDeadline(time.Time{})
+	addr := c.RemoteAddr().String()
+	fmt.Printf("\nslow response to %v: status line after %v, headers after %v more, then %d chunks every %v\n",
+		addr, statusDelay, headerDelay, chunks, chunkDelay)
+
+	// The request has been read, so the client sending anything more, or closing,
+	// ends the wait: it has given up
+	gone := make(chan error, 1)
+	go func() {
+		_, err := buf.ReadByte()
+		gone <- err
+	}()
+	start := time.Now()
+	outcome := clientOutcome{At: start, Client: clientName(addr, req.UserAgent()), Query: req.URL.RawQuery, Phase: "complete"}
+	defer func() {
+		outcome.AfterSeconds = time.Since(start).Seconds()
+		clients.record(outcome)
+	}()
+	// stage waits for d and then sends s, unless the client gives up first
+	stage := func(name string, d time.Duration, s string) bool {
+		select {
+		case err := <-gone:
+			elapsed := time.Since(start).Round(time.Millisecond)
+			fmt.Printf("client %v gave up after %v, waiting for %s (%v)\n", addr, elapsed, name, err)
+			events.record(addr, "client gave up after %v, waiting for %s", elapsed, name)
+			outcome.Stage, outcome.Phase = name, "body"
+			if !strings.HasPrefix(name, "body") && name != "the end of the body" {
+				outcome.Phase = "headers"
+			}
+			return false
+		case <-time.After(d):
+		}
+		if _, err := c.Write([]byte(s)); err != nil {
+			fmt.Printf("slow write of %s to %v failed: %v\n", name, addr, err)
+			outcome.Stage, outcome.Phase = name, "error"
+			return false
+		}
+		return true
+	}
+
+	if !stage("the status line", statusDelay, "HTTP/1.1 200 OK\r\n") ||
+		!stage("the headers", headerDelay, "Content-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n") {
+		return
+	}
+	chunk := fmt.Sprintf("%x\r\n%s\r\n", size, strings.Repeat("x", size))
+	for i := 0; i < chunks; i++ {
+		if !stage(fmt.Sprintf("body chunk %d of %d", i+1, chunks), chunkDelay, chunk) {
+			return
+		}
+	}
+	if stage("the end of the body", chunkDelay, "0\r\n\r\n") {
+		fmt.Printf("slow response to %v done after %v\n", addr, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// clientOutcome is how a client dealt with one slow response: whether it waited for
+// all of it, or which stage it gave up at.
+type clientOutcome struct {
+	At time.Time `json:"at"`
+	// Client is the client's IP address and User-Agent
+	Client string `json:"client"`
+	// Query is the slow response's settings
+	Query string `json:"query"`
+	// Phase is "headers" or "body" if the client gave up waiting for that part of the
+	// response, "complete" if it read the whole response, or "error" if the server
+	// couldn't send it
+	Phase string `json:"phase"`
+	// Stage is the stage the client gave up at, like "body chunk 3 of 5"
+	Stage        string  `json:"stage,omitempty"`
+	AfterSeconds float64 `json:"afterSeconds"`
+}
+
+// maxClientOutcomes is how many of each client's most recent outcomes are kept.
+const maxClientOutcomes = 100
+
+// clientLog holds the outcomes of slow responses, keyed by client, so that what each
+// client's timeouts seem to be can be summarized.
+type clientLog struct {
+	mu        sync.Mutex
+	byClient  map[string][]clientOutcome
+	file      *os.File
+	fileError bool
+}
+
+var clients = &clientLog{byClient: map[string][]clientOutcome{}}
+
+// clientName identifies a client by its IP address and User-Agent, since one host can
+// run several clients.
+func clientName(addr, userAgent string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if userAgent == "" {
+		userAgent = "no User-Agent"
+	}
+	return host + " (" + userAgent + ")"
+}
+
+// record adds an outcome, writing it to the -client-log file, if there is one, and
+// prints the client's verdict so far.
+func (l *clientLog) record(o clientOutcome) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	outcomes := append(l.byClient[o.Client], o)
+	if len(outcomes) > maxClientOutcomes {
+		outcomes = outcomes[len(outcomes)-maxClientOutcomes:]
+	}
+	l.byClient[o.Client] = outcomes
+	if l.file != nil && !l.fileError {
+		b, _ := json.Marshal(o)
+		if _, err := l.file.Write(append(b, '\n')); err != nil {
+			fmt.Println("client log write failed:", err)
+			l.fileError = true
+		}
+	}
+	fmt.Printf("verdict for %s: %s\n", o.Client, strings.Join(clientVerdict(l.byClient[o.Client]), "; "))
+}
+
+// clientVerdict sums up a client's outcomes as what its timeouts seem to be.
+// Giving up before the headers arrive points to a response header timeout (or an
+// overall timeout shorter than the delay); giving up during the body points to an
+// overall timeout.
+func clientVerdict(outcomes []clientOutcome) []string {
+	var headerGiveUps, bodyGiveUps []float64
+	var longestComplete float64
+	for _, o := range outcomes {
+		switch o.Phase {
+		case "headers":
+			headerGiveUps = append(headerGiveUps, o.AfterSeconds)
+		case "body":
+			bodyGiveUps = append(bodyGiveUps, o.AfterSeconds)
+		case "complete":
+			if o.AfterSeconds > longestComplete {
+				longestComplete = o.AfterSeconds
+			}
+		}
+	}
+	var res []string
+	if len(headerGiveUps) > 0 {
+		res = append(res, "gave up waiting for the headers after "+secondsRange(headerGiveUps)+" (a response header timeout, or a shorter overall one)")
+	}
+	if len(bodyGiveUps) > 0 {
+		res = append(res, "gave up during the body after "+secondsRange(bodyGiveUps)+" (an overall timeout)")
+	}
+	if longestComplete > 0 {
+		res = append(res, fmt.Sprintf("read a whole response that took %.3fs", longestComplete))
+	}
+	if len(res) == 0 {
+		res = append(res, "no slow responses finished")
+	}
+	return res
+}
+
+// secondsRange formats durations in seconds as one value or as the range they span.
+func secondsRange(secs []float64) string {
+	sort.Float64s(secs)
+	if secs[len(secs)-1]-secs[0] < 0.05 {
+		return fmt.Sprintf("%.3fs", secs[0])
+	}
+	return fmt.Sprintf("%.3fs to %.3fs", secs[0], secs[len(secs)-1])
+}
+
+// clientSummary is a client's outcomes and verdict, as /clients returns them.
+type clientSummary struct {
+	Client   string          `json:"client"`
+	Verdict  []string        `json:"verdict"`
+	Outcomes []clientOutcome `json:"outcomes"`
+}
+
+// ServeHTTP returns each client's outcomes and verdict as JSON.
+func (l *clientLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	l.mu.Lock()
+	res := []clientSummary{}
+	for client, outcomes := range l.byClient {
+		res = append(res, clientSummary{Client: client, Verdict: clientVerdict(outcomes), Outcomes: outcomes})
+	}
+	l.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Client < res[j].Client })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,113 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+// selfSignedCert makes a throwaway certificate for localhost.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// handshakeTimingListener records when each connection was accepted, so that TLS
+// handshake progress can be logged relative to it.
+type handshakeTimingListener struct {
+	net.Listener
+}
+
+func (l *handshakeTimingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeTimingConn{Conn: c, accepted: time.Now()}, nil
+}
+
+type handshakeTimingConn struct {
+	net.Conn
+	accepted time.Time
+}
+
+// handshakeTimingConfig returns a TLS config that logs how long each handshake takes:
+// when the ClientHello has arrived and when the handshake is done.
+func handshakeTimingConfig(cert tls.Certificate) *tls.Config {
+	base := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		hc, ok := underlyingConn(hello.Conn).(*handshakeTimingConn)
+		if !ok {
+			return nil, nil
+		}
+		fmt.Printf("\nTLS ClientHello from %v after %v\n", hc.RemoteAddr(), time.Since(hc.accepted))
+
+		// A per-connection config lets us see when this connection's handshake is done
+		connCfg := base.Clone()
+		connCfg.VerifyConnection = func(tls.ConnectionState) error {
+			fmt.Printf("TLS handshake with %v done after %v\n", hc.RemoteAddr(), time.Since(hc.accepted))
+			return nil
+		}
+		return connCfg, nil
+	}
+	return cfg
+}
+
+// logHandshakeGiveUp is an http.Server.ConnState hook that logs when a connection is
+// closed before its TLS handshake finished, which is the stdlib giving up on a stalled
+// handshake (or the client going away).
+func logHandshakeGiveUp(c net.Conn, state http.ConnState) {
+	tc, ok := c.(*tls.Conn)
+	if !ok || state != http.StateClosed || tc.ConnectionState().HandshakeComplete {
+		return
+	}
+	hc, ok := underlyingConn(tc.NetConn()).(*handshakeTimingConn)
+	if !ok {
+		return
+	}
+	fmt.Printf("\nTLS handshake with %v abandoned after %v\n", hc.RemoteAddr(), time.Since(hc.accepted))
+}
+
+// underlyingConn unwraps the listener wrappers that may be around a handshakeTimingConn.
+func underlyingConn(c net.Conn) net.Conn {
+	for {
+		switch wc := c.(type) {
+		case *netemConn:
+			c = wc.Conn
+		case *rejectLoggingConn:
+			c = wc.Conn
+		default:
+			return c
+		}
+	}
+}
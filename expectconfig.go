@@ -0,0 +1,218 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configDirective maps a server config directive to the audit probe it governs.
+type configDirective struct {
+	name  string
+	re    *regexp.Regexp
+	probe string
+	// unit is what a bare number is in, for servers that allow them
+	unit time.Duration
+}
+
+// serverConfigDirectives are the timeout directives read from each kind of server
+// config. Each regexp captures the directive's value.
+var serverConfigDirectives = map[string][]configDirective{
+	"nginx": {
+		{"client_header_timeout", regexp.MustCompile(`^client_header_timeout\s+([^;]+);`), "header read timeout", time.Second},
+		{"client_body_timeout", regexp.MustCompile(`^client_body_timeout\s+([^;]+);`), "body read timeout", time.Second},
+		{"send_timeout", regexp.MustCompile(`^send_timeout\s+([^;]+);`), "response write timeout", time.Second},
+		// A second value is only the Keep-Alive header's timeout
+		{"keepalive_timeout", regexp.MustCompile(`^keepalive_timeout\s+(\S+?)(?:\s+\S+)?;`), "idle timeout", time.Second},
+	},
+	"haproxy": {
+		{"timeout http-request", regexp.MustCompile(`^timeout\s+http-request\s+(\S+)`), "header read timeout", time.Millisecond},
+		{"timeout http-keep-alive", regexp.MustCompile(`^timeout\s+http-keep-alive\s+(\S+)`), "idle timeout", time.Millisecond},
+	},
+	"envoy": {
+		{"request_headers_timeout", regexp.MustCompile(`^request_headers_timeout:\s*"?([^"\s]+)`), "header read timeout", 0},
+		// The listener's, under common_http_protocol_options, which is assumed to come
+		// before any cluster's
+		{"idle_timeout", regexp.MustCompile(`^idle_timeout:\s*"?([^"\s]+)`), "idle timeout", 0},
+		{"stream_idle_timeout", regexp.MustCompile(`^stream_idle_timeout:\s*"?([^"\s]+)`), "body read timeout", 0},
+	},
+}
+
+// configExpectations reads the timeouts set in a server config file, given as
+// kind:path where kind is nginx, haproxy, or envoy, as expected results of the
+// audit probes. from says which directive each came from. Only the first setting of
+// each directive is used, so per-server or per-location overrides aren't seen, and
+// directives that aren't set aren't expected to have their default values.
+//
+// An AWS load balancer's settings can be used instead, given as alb:<arn>, or a
+// CloudFront distribution's, given as cloudfront:<id>. atLeast marks the expected
+// results that are only a minimum.
+func configExpectations(spec string) (expect map[string]time.Duration, from map[string]string, atLeast map[string]bool, err error) {
+	kind, filename, ok := strings.Cut(spec, ":")
+	if ok && kind == "alb" {
+		expect, from, err = albExpectations(filename)
+		return expect, from, nil, err
+	}
+	if ok && kind == "cloudfront" {
+		return cloudFrontExpectations(filename)
+	}
+	directives := serverConfigDirectives[kind]
+	if !ok || directives == nil {
+		return nil, nil, nil, fmt.Errorf("bad server config %q; want nginx:<file>, haproxy:<file>, envoy:<file>, alb:<arn>, or cloudfront:<id>", spec)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open server config %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	expect, from = map[string]time.Duration{}, map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, d := range directives {
+			match := d.re.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			if _, ok := from[d.probe]; ok {
+				continue
+			}
+			want, err := parseConfigDuration(match[1], d.unit)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("got bad %s timeout in %q: %q; %w", kind, filename, line, err)
+			}
+			if want == 0 && kind == "nginx" {
+				// keepalive_timeout 0 turns keep-alive off, rather than the timeout
+				continue
+			}
+			expect[d.probe] = want
+			from[d.probe] = kind + " " + d.name
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return expect, from, nil, nil
+}
+
+// parseConfigDuration parses a duration from a server config, like "60s", "1m 30s",
+// or a bare number in unit.
+func parseConfigDuration(s string, unit time.Duration) (time.Duration, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if n, err := strconv.ParseFloat(s, 64); err == nil && unit != 0 {
+		return time.Duration(n * float64(unit)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// albAttributes is the output of aws elbv2 describe-load-balancer-attributes.
+type albAttributes struct {
+	Attributes []struct {
+		Key   string
+		Value string
+	}
+}
+
+// albExpectations fetches the idle timeout of the AWS Application Load Balancer with
+// the given ARN, using the aws command (so its usual credentials and region apply).
+// The ALB's other timeouts are towards its targets, which the audit doesn't see.
+func albExpectations(arn string) (expect map[string]time.Duration, from map[string]string, err error) {
+	out, err := exec.Command("aws", "elbv2", "describe-load-balancer-attributes", "--load-balancer-arn", arn, "--output", "json").Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, nil, fmt.Errorf("failed to fetch load balancer attributes: %w", err)
+	}
+	var attrs albAttributes
+	if err := json.Unmarshal(out, &attrs); err != nil {
+		return nil, nil, fmt.Errorf("bad load balancer attributes: %w", err)
+	}
+
+	expect, from = map[string]time.Duration{}, map[string]string{}
+	for _, a := range attrs.Attributes {
+		if a.Key != "idle_timeout.timeout_seconds" {
+			continue
+		}
+		secs, err := strconv.Atoi(a.Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad load balancer %s: %q", a.Key, a.Value)
+		}
+		expect["idle timeout"] = time.Duration(secs) * time.Second
+		from["idle timeout"] = "ALB " + a.Key
+	}
+	return expect, from, nil
+}
+
+// cloudFrontDistributionConfig is the part of the output of aws cloudfront
+// get-distribution-config that has the origins' timeouts.
+type cloudFrontDistributionConfig struct {
+	DistributionConfig struct {
+		Origins struct {
+			Items []struct {
+				Id                 string
+				CustomOriginConfig *struct {
+					OriginReadTimeout      int
+					OriginKeepaliveTimeout int
+				}
+			}
+		}
+	}
+}
+
+// cloudFrontExpectations fetches the origin timeouts of a CloudFront distribution,
+// given as <id>, or <id>/<origin id> if it has more than one custom origin, using the
+// aws command. They're for auditing the origin: CloudFront reuses an idle connection
+// to it for up to OriginKeepaliveTimeout, so the origin's idle timeout should be at
+// least that, or CloudFront will sometimes send a request on a connection that's
+// being closed and give a 502. OriginReadTimeout is how long CloudFront waits for a
+// response, which none of the probes measure, so it isn't checked.
+func cloudFrontExpectations(spec string) (expect map[string]time.Duration, from map[string]string, atLeast map[string]bool, err error) {
+	id, originID, _ := strings.Cut(spec, "/")
+	out, err := exec.Command("aws", "cloudfront", "get-distribution-config", "--id", id, "--output", "json").Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, nil, nil, fmt.Errorf("failed to fetch distribution config: %w", err)
+	}
+	var cfg cloudFrontDistributionConfig
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		return nil, nil, nil, fmt.Errorf("bad distribution config: %w", err)
+	}
+
+	// S3 origins have no CustomOriginConfig, and no timeouts to set
+	var custom []string
+	keepalive := 0
+	for _, o := range cfg.DistributionConfig.Origins.Items {
+		if o.CustomOriginConfig == nil || (originID != "" && o.Id != originID) {
+			continue
+		}
+		custom = append(custom, o.Id)
+		keepalive = o.CustomOriginConfig.OriginKeepaliveTimeout
+	}
+	switch {
+	case len(custom) == 0 && originID != "":
+		return nil, nil, nil, fmt.Errorf("distribution %s has no custom origin %q", id, originID)
+	case len(custom) == 0:
+		return nil, nil, nil, fmt.Errorf("distribution %s has no custom origins", id)
+	case len(custom) > 1:
+		return nil, nil, nil, fmt.Errorf("distribution %s has %d custom origins (%s); give one as cloudfront:%s/<origin id>",
+			id, len(custom), strings.Join(custom, ", "), id)
+	}
+
+	expect = map[string]time.Duration{"idle timeout": time.Duration(keepalive) * time.Second}
+	from = map[string]string{"idle timeout": "CloudFront OriginKeepaliveTimeout"}
+	atLeast = map[string]bool{"idle timeout": true}
+	return expect, from, atLeast, nil
+}
@@ -0,0 +1,65 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withFakeAWS puts an aws command on PATH that prints out.
+func withFakeAWS(t *testing.T, out string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake aws command is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "out.json"), []byte(out), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\ncat " + filepath.Join(dir, "out.json") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "aws"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+const testDistributionConfig = `{
+  "ETag": "E2QWRUHEXAMPLE",
+  "DistributionConfig": {
+    "Origins": {
+      "Quantity": 3,
+      "Items": [
+        {"Id": "assets", "DomainName": "assets.s3.amazonaws.com", "S3OriginConfig": {"OriginAccessIdentity": ""}},
+        {"Id": "api", "DomainName": "api.example.com", "CustomOriginConfig": {"OriginReadTimeout": 30, "OriginKeepaliveTimeout": 20}},
+        {"Id": "web", "DomainName": "web.example.com", "CustomOriginConfig": {"OriginReadTimeout": 60, "OriginKeepaliveTimeout": 5}}
+      ]
+    }
+  }
+}`
+
+func TestCloudFrontExpectations(t *testing.T) {
+	withFakeAWS(t, testDistributionConfig)
+
+	expect, from, atLeast, err := configExpectations("cloudfront:E1EXAMPLE/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect["idle timeout"] != 20*time.Second || !atLeast["idle timeout"] || from["idle timeout"] != "CloudFront OriginKeepaliveTimeout" {
+		t.Errorf("got %v, %v, %v; want an idle timeout of at least 20s", expect, from, atLeast)
+	}
+	if len(expect) != 1 {
+		t.Errorf("got expectations for %d probes; want only the idle timeout", len(expect))
+	}
+
+	if _, _, _, err := configExpectations("cloudfront:E1EXAMPLE"); err == nil || !strings.Contains(err.Error(), "api, web") {
+		t.Errorf("two custom origins without one named: err = %v", err)
+	}
+	if _, _, _, err := configExpectations("cloudfront:E1EXAMPLE/assets"); err == nil {
+		t.Errorf("S3 origin accepted")
+	}
+}
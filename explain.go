@@ -0,0 +1,59 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import "fmt"
+
+// explainMode is set by -explain to annotate report lines with the server settings
+// that likely govern them.
+var explainMode bool
+
+// Topics that report lines can be explained by.
+const (
+	explainHeaderRead    = "header read"
+	explainBodyRead      = "body read"
+	explainWholeRequest  = "whole request"
+	explainPerRead       = "per read"
+	explainWrite         = "write"
+	explainHandler       = "handler"
+	explainIdle          = "idle"
+	explainTTFB          = "ttfb"
+	explainReset         = "reset"
+	explainHeaderSize    = "header size"
+	explainCloseNotify   = "close notify"
+	explainStalledReader = "stalled reader"
+)
+
+var explanations = map[string]string{
+	explainHeaderRead: "the time allowed to send the request headers: ReadHeaderTimeout (or ReadTimeout) in Go, " +
+		"client_header_timeout in nginx, RequestReadTimeout header= in Apache",
+	explainBodyRead: "the time allowed to send the request body: ReadTimeout in Go, client_body_timeout in nginx, " +
+		"RequestReadTimeout body= in Apache",
+	explainWholeRequest: "a single deadline from the start of the request, however steadily it's sent: Go's ReadTimeout " +
+		"(Apache's RequestReadTimeout also has a maximum)",
+	explainPerRead: "a timer reset by each read, so a slow but steady sender is never cut off: nginx's client_body_timeout, " +
+		"Apache's Timeout, or MinRate in RequestReadTimeout",
+	explainWrite: "the time allowed to write the response: WriteTimeout in Go (which also covers the handler, from the end " +
+		"of the request headers), send_timeout in nginx (per write), Timeout in Apache",
+	explainHandler: "the time allowed for the application to produce a response: http.TimeoutHandler in Go, " +
+		"proxy_read_timeout in nginx (as a 504), ProxyTimeout in Apache",
+	explainIdle: "how long a keep-alive connection may sit unused between requests: IdleTimeout in Go (ReadTimeout if it's " +
+		"unset), keepalive_timeout in nginx, KeepAliveTimeout in Apache",
+	explainTTFB: "time for the server to read the request and start responding; if it's long, an upstream or handler is " +
+		"slow, and a handler or proxy timeout would bound it",
+	explainReset: "a RST rather than a FIN usually means unread data was left in the server's receive buffer when it " +
+		"closed, or a middlebox killed the connection",
+	explainHeaderSize: "the largest request header block accepted: MaxHeaderBytes in Go (1MB by default, plus 4KB), " +
+		"large_client_header_buffers in nginx, LimitRequestFieldSize in Apache",
+	explainCloseNotify: "a TLS close_notify before the FIN means the server closed deliberately at the TLS layer; without " +
+		"one, the connection was closed underneath TLS (like Go's deadline-driven closes)",
+	explainStalledReader: "how long the server waits on a client that stops reading the response: WriteTimeout in Go, " +
+		"send_timeout in nginx, Timeout in Apache",
+}
+
+// explain prints an explanation of topic, if explainMode is set.
+func explain(topic string) {
+	if explainMode {
+		fmt.Println("    ↳ " + explanations[topic])
+	}
+}
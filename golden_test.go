@@ -0,0 +1,80 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Run "go test -run Golden -update" to rewrite the golden files after a deliberate
+// change to an output format.
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenRunMetadata is run metadata that doesn't vary between machines and runs, so
+// that outputs that embed it can be compared.
+func goldenRunMetadata() *runMetadata {
+	return &runMetadata{
+		ToolVersion: "(devel)",
+		GoVersion:   "go1.18",
+		OS:          "linux/amd64",
+		StartedAt:   time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC),
+		Settings:    map[string]string{"MaxResponseBytes": "1024"},
+	}
+}
+
+// checkGolden compares the file that a test wrote with its golden file in testdata.
+func checkGolden(t *testing.T, got string, golden string) {
+	t.Helper()
+	b, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", golden)
+	if *updateGolden {
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("%s differs from %s (run with -update if the change is deliberate):\n%s", got, path, b)
+	}
+}
+
+func TestAuditSARIFGolden(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.sarif")
+	results := []auditResult{{
+		target: "api.example.com:443",
+		tags:   map[string]string{"team": "edge"},
+		conn:   &connMetadata{LocalAddress: "192.0.2.1:50000", RemoteAddress: "198.51.100.7:443"},
+		findings: []auditFinding{
+			{probe: "header read timeout", outcome: "closed", after: 10 * time.Second, margin: 500 * time.Millisecond, severity: severityInfo},
+			{probe: "idle timeout", outcome: "none found", note: "kept open for 2m0s", severity: severityMedium,
+				hasExpected: true, expected: time.Minute, expectedAtLeast: true},
+			{probe: "body read timeout", err: errors.New("connection refused")},
+		},
+	}}
+	if err := writeAuditSARIF(filename, goldenRunMetadata(), results); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, filename, "audit.sarif.golden")
+}
+
+func TestAdviceFileGolden(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "advice.json")
+	advice := idleTimeoutAdvice(4500*time.Millisecond, 5*time.Second)
+	advice.addBracket(idleBracket{alive: 4500 * time.Millisecond, dead: 5 * time.Second, samples: 1})
+	advice.Run = goldenRunMetadata()
+	printAdvice(advice, testParams{adviceFile: filename})
+	checkGolden(t, filename, "advice.json.golden")
+}
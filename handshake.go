@@ -0,0 +1,332 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxHandshakeCapture is the most of the server's handshake that's kept for parsing
+// its ServerHello, which comes first.
+const maxHandshakeCapture = 16 * 1024
+
+// tlsExtensionNames names the TLS extensions a server might send.
+var tlsExtensionNames = map[uint16]string{
+	0:     "server_name",
+	5:     "status_request",
+	10:    "supported_groups",
+	11:    "ec_point_formats",
+	13:    "signature_algorithms",
+	16:    "alpn",
+	18:    "signed_certificate_timestamp",
+	21:    "padding",
+	22:    "encrypt_then_mac",
+	23:    "extended_master_secret",
+	35:    "session_ticket",
+	41:    "pre_shared_key",
+	43:    "supported_versions",
+	44:    "cookie",
+	51:    "key_share",
+	65281: "renegotiation_info",
+}
+
+// helloRetryRandom is the ServerHello random that marks a HelloRetryRequest (RFC 8446
+// section 4.1.3).
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// serverHello is what's visible in the server's first handshake message.
+type serverHello struct {
+	// extensions are the extensions' names (or numbers, for unknown ones), in the
+	// order sent
+	extensions []string
+	// retried is true if the server first sent a HelloRetryRequest, asking for
+	// another key share
+	retried bool
+}
+
+// parseServerHello finds the ServerHello in the start of the server's side of a
+// handshake (TLS records as received) and returns its extensions.
+func parseServerHello(data []byte) (serverHello, error) {
+	var res serverHello
+	// Handshake messages can span records, so put the handshake records back together
+	var msgs []byte
+	for len(data) >= 5 && data[0] == 22 {
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			break
+		}
+		msgs = append(msgs, data[5:5+n]...)
+		data = data[5+n:]
+	}
+
+	for len(msgs) >= 4 {
+		typ, n := msgs[0], int(msgs[1])<<16|int(msgs[2])<<8|int(msgs[3])
+		if len(msgs) < 4+n {
+			break
+		}
+		body := msgs[4 : 4+n]
+		msgs = msgs[4+n:]
+		if typ != 2 {
+			continue
+		}
+		// version, random, session ID, cipher suite, compression method, extensions
+		if len(body) < 35 {
+			return res, errors.New("short ServerHello")
+		}
+		if bytes.Equal(body[2:34], helloRetryRandom) {
+			res.retried = true
+			continue
+		}
+		rest := body[35+int(body[34]):]
+		if len(rest) < 5 {
+			// No extensions at all
+			return res, nil
+		}
+		exts := rest[5:]
+		res.extensions = nil
+		for len(exts) >= 4 {
+			typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+			name, ok := tlsExtensionNames[typ]
+			if !ok {
+				name = fmt.Sprintf("%d", typ)
+			}
+			res.extensions = append(res.extensions, name)
+			if len(exts) < 4+n {
+				break
+			}
+			exts = exts[4+n:]
+		}
+		return res, nil
+	}
+	return res, errors.New("no ServerHello found")
+}
+
+// ticketRecorder is a tls.ClientSessionCache that only notes whether the server
+// issued a session ticket. No sessions are resumed, so each connection's handshake
+// is a full one.
+type ticketRecorder struct {
+	mu     sync.Mutex
+	issued bool
+}
+
+func (r *ticketRecorder) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return nil, false
+}
+
+func (r *ticketRecorder) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if cs == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.issued = true
+}
+
+func (r *ticketRecorder) ticketIssued() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.issued
+}
+
+// printHandshakeDetails prints what the TLS handshake shows of the server beyond the
+// certificates: OCSP stapling, SCTs, ALPN, and the ServerHello's extensions. They
+// often identify the middlebox that terminated TLS.
+func printHandshakeDetails(conn *conn) {
+	tc, ok := conn.c.(*tls.Conn)
+	if !ok {
+		return
+	}
+	state := tc.ConnectionState()
+	version, ok := tlsVersionNames[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	fmt.Printf("%s, %s", version, tls.CipherSuiteName(state.CipherSuite))
+	if state.NegotiatedProtocol != "" {
+		fmt.Printf(", ALPN %s", state.NegotiatedProtocol)
+	}
+	fmt.Println()
+	if hash, _, err := ja3(conn.raw.clientHello); err == nil {
+		fmt.Printf("our ClientHello: JA3 %s\n", hash)
+	}
+	fmt.Printf("OCSP stapled: %s; SCTs in handshake: %d\n", yesNo(len(state.OCSPResponse) > 0), len(state.SignedCertificateTimestamps))
+
+	hello, err := parseServerHello(conn.raw.handshake)
+	if err != nil {
+		fmt.Println(yellow("couldn't read the ServerHello:"), err)
+	} else {
+		exts := strings.Join(hello.extensions, ", ")
+		if exts == "" {
+			exts = "none"
+		}
+		if state.Version == tls.VersionTLS13 {
+			exts += " (TLS 1.3 encrypts the rest)"
+		}
+		fmt.Println("ServerHello extensions:", exts)
+		if hello.retried {
+			fmt.Println("the server sent a HelloRetryRequest, asking for a different key share")
+		}
+	}
+	if state.Version < tls.VersionTLS13 {
+		fmt.Println("session ticket issued:", yesNo(conn.tickets.ticketIssued()))
+	}
+}
+
+// printSessionTicket reports whether a TLS 1.3 server issued a session ticket, which
+// it does after the handshake, so it's only known once the response has been read.
+func printSessionTicket(conn *conn) {
+	if tc, ok := conn.c.(*tls.Conn); ok && tc.ConnectionState().Version == tls.VersionTLS13 {
+		fmt.Printf(cyan("TLS session ticket issued: %s\n"), yesNo(conn.tickets.ticketIssued()))
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// clientHelloProfiles are the ClientHello shapes that ClientHello can pick, by name,
+// as changes to the TLS config. Without a replacement TLS stack, Go can't send a
+// browser's exact ClientHello (GREASE, extension order, and the TLS 1.3 cipher suites
+// are out of its control), but the ciphers and curves are what many anti-bot layers
+// look at first.
+var clientHelloProfiles = map[string]func(*tls.Config){
+	"go": func(*tls.Config) {},
+	"browser": func(c *tls.Config) {
+		// Chrome's order, less the suites Go doesn't implement. HTTP/2 can't be
+		// offered, since the request is sent as HTTP/1.1.
+		c.CipherSuites = []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		}
+		c.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+		c.NextProtos = []string{"http/1.1"}
+	},
+	"tls12": func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+	},
+}
+
+// clientHelloProfileNames lists the ClientHello profiles, for messages.
+func clientHelloProfileNames() string {
+	var names []string
+	for name := range clientHelloProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ja3 is the JA3 fingerprint of a ClientHello, found in the start of the client's
+// side of a handshake, as the MD5 hash and the string it's the hash of. GREASE values
+// are left out, as JA3 does.
+func ja3(data []byte) (hash, full string, err error) {
+	if len(data) < 9 || data[0] != 22 || data[5] != 1 {
+		return "", "", errors.New("no ClientHello found")
+	}
+	n := int(data[6])<<16 | int(data[7])<<8 | int(data[8])
+	if len(data) < 9+n {
+		return "", "", errors.New("ClientHello is split across records")
+	}
+	b := data[9 : 9+n]
+
+	next := func(lenBytes int) []byte {
+		if len(b) < lenBytes {
+			b = nil
+			return nil
+		}
+		var l int
+		for _, c := range b[:lenBytes] {
+			l = l<<8 | int(c)
+		}
+		if len(b) < lenBytes+l {
+			b = nil
+			return nil
+		}
+		v := b[lenBytes : lenBytes+l]
+		b = b[lenBytes+l:]
+		return v
+	}
+	if len(b) < 34 {
+		return "", "", errors.New("short ClientHello")
+	}
+	version := binary.BigEndian.Uint16(b)
+	b = b[34:]
+	next(1) // session ID
+	ciphers := next(2)
+	next(1) // compression methods
+	exts := next(2)
+
+	var extIDs, curves, pointFormats []string
+	for len(exts) >= 4 {
+		typ, l := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+l {
+			break
+		}
+		body := exts[4 : 4+l]
+		exts = exts[4+l:]
+		if isGREASE(typ) {
+			continue
+		}
+		extIDs = append(extIDs, fmt.Sprint(typ))
+		switch {
+		case typ == 10 && len(body) >= 2:
+			curves = uint16List(body[2:])
+		case typ == 11 && len(body) >= 1:
+			for _, f := range body[1:] {
+				pointFormats = append(pointFormats, fmt.Sprint(f))
+			}
+		}
+	}
+
+	full = strings.Join([]string{
+		fmt.Sprint(version),
+		strings.Join(uint16List(ciphers), "-"),
+		strings.Join(extIDs, "-"),
+		strings.Join(curves, "-"),
+		strings.Join(pointFormats, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(full))
+	return hex.EncodeToString(sum[:]), full, nil
+}
+
+// uint16List is the decimal values of a list of big-endian uint16s, without GREASE.
+func uint16List(b []byte) []string {
+	var res []string
+	for ; len(b) >= 2; b = b[2:] {
+		if v := binary.BigEndian.Uint16(b); !isGREASE(v) {
+			res = append(res, fmt.Sprint(v))
+		}
+	}
+	return res
+}
+
+// isGREASE is true for the reserved values that clients send to keep servers
+// tolerant of unknown ones (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,260 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchRecord is one Watch run, as a line of JSON in the WatchHistory file.
+type watchRecord struct {
+	Time time.Time `json:"time"`
+	// AliveSeconds and DeadSeconds are the idle timeout bracket, as from
+	// bracketIdleTimeout; either is zero if there wasn't one
+	AliveSeconds float64 `json:"aliveSeconds"`
+	DeadSeconds  float64 `json:"deadSeconds"`
+	// MarginSeconds and LowConfidence are from the runs since the last change,
+	// combined (see combineIdleBrackets), as is Samples, the number of them. They're
+	// unset unless both ends of the bracket were found.
+	MarginSeconds float64 `json:"marginSeconds,omitempty"`
+	LowConfidence bool    `json:"lowConfidence,omitempty"`
+	Samples       int     `json:"samples,omitempty"`
+	// Error is set instead if the probe failed
+	Error string `json:"error,omitempty"`
+}
+
+// addBracket records b, the bracket combined from the runs up to and including r's.
+func (r *watchRecord) addBracket(b idleBracket) {
+	if _, margin, ok := b.estimate(); ok {
+		r.MarginSeconds = margin.Seconds()
+		r.LowConfidence = b.lowConfidence()
+		r.Samples = b.samples
+	}
+}
+
+// appendWatchRecord adds a Watch run to the history in filename.
+func appendWatchRecord(filename string, rec watchRecord) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(rec)
+}
+
+// readWatchHistory reads the Watch runs in filename.
+func readWatchHistory(filename string) ([]watchRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []watchRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec watchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// estimate is the run's idle timeout: the middle of its bracket. ok is false if the
+// probe failed, and none is true if no timeout was found.
+func (r watchRecord) estimate() (d time.Duration, none, ok bool) {
+	switch {
+	case r.Error != "":
+		return 0, false, false
+	case r.DeadSeconds == 0:
+		return 0, true, true
+	}
+	return time.Duration((r.AliveSeconds + r.DeadSeconds) / 2 * float64(time.Second)).Round(time.Millisecond), false, true
+}
+
+// heatmapBucket collects the runs in one time slot.
+type heatmapBucket struct {
+	estimates []time.Duration
+	none      int
+	failed    int
+}
+
+func (b *heatmapBucket) add(r watchRecord) {
+	d, none, ok := r.estimate()
+	switch {
+	case !ok:
+		b.failed++
+	case none:
+		b.none++
+	default:
+		b.estimates = append(b.estimates, d)
+	}
+}
+
+func (b *heatmapBucket) runs() int {
+	return len(b.estimates) + b.none + b.failed
+}
+
+// median is the bucket's typical idle timeout. none is true if most successful runs
+// found no timeout.
+func (b *heatmapBucket) median() (d time.Duration, none bool) {
+	if b.none > len(b.estimates) {
+		return 0, true
+	}
+	if len(b.estimates) == 0 {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), b.estimates...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2], false
+}
+
+// value describes the bucket's typical idle timeout.
+func (b *heatmapBucket) value() string {
+	d, none := b.median()
+	switch {
+	case none:
+		return "no idle timeout"
+	case d == 0:
+		return "probes failed"
+	default:
+		return fmt.Sprintf("~%v", d)
+	}
+}
+
+// describe summarizes the bucket.
+func (b *heatmapBucket) describe() string {
+	d, _ := b.median()
+	s := b.value() + fmt.Sprintf(" (%d runs", b.runs())
+	if b.failed > 0 && d != 0 {
+		s += fmt.Sprintf(", %d failed", b.failed)
+	}
+	return s + ")"
+}
+
+// glyph is the bucket's heatmap cell, compared with the usual timeout.
+func (b *heatmapBucket) glyph(usual time.Duration, usualNone bool) string {
+	if b.runs() == 0 {
+		return " "
+	}
+	d, none := b.median()
+	switch {
+	case none && usualNone, !none && d != 0 && !usualNone && meetsExpectation(d, usual):
+		return "."
+	case none:
+		return "∞"
+	case d == 0:
+		return "!"
+	case usualNone || d < usual:
+		return "-"
+	default:
+		return "+"
+	}
+}
+
+// newHeatmapFlagSet defines the heatmap subcommand's flags.
+func newHeatmapFlagSet() (fs *flag.FlagSet, utc *bool) {
+	fs = flag.NewFlagSet("heatmap", flag.ExitOnError)
+	utc = fs.Bool("utc", false, "bucket by UTC instead of local time")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: httptimeout heatmap [flags] <watch-history-file>")
+		fs.PrintDefaults()
+	}
+	return fs, utc
+}
+
+// runHeatmap implements the heatmap subcommand, which buckets the idle timeouts
+// recorded by Watch with WatchHistory by day of the week and hour of the day, to show
+// patterns like a shorter timeout during a nightly load balancer reload.
+func runHeatmap(args []string) {
+	fs, utc := newHeatmapFlagSet()
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	recs, err := readWatchHistory(fs.Arg(0))
+	if err != nil {
+		fmt.Println(red("failed to read history:"), err)
+		os.Exit(1)
+	}
+	if len(recs) == 0 {
+		fmt.Println("no runs in", fs.Arg(0))
+		return
+	}
+
+	loc, zone := time.Local, "local time"
+	if *utc {
+		loc, zone = time.UTC, "UTC"
+	}
+	var all heatmapBucket
+	var byHour [24]heatmapBucket
+	var byDayHour [7][24]heatmapBucket
+	for _, r := range recs {
+		t := r.Time.In(loc)
+		all.add(r)
+		byHour[t.Hour()].add(r)
+		byDayHour[t.Weekday()][t.Hour()].add(r)
+	}
+	usual, usualNone := all.median()
+
+	first, last := recs[0].Time.In(loc), recs[len(recs)-1].Time.In(loc)
+	fmt.Printf("idle timeout by time of week (%s), %d runs from %s to %s; usually %s\n\n",
+		zone, len(recs), first.Format("2006-01-02 15:04"), last.Format("2006-01-02 15:04"), all.value())
+
+	fmt.Print("     ")
+	for h := 0; h < 24; h++ {
+		fmt.Printf("%3d", h)
+	}
+	fmt.Println()
+	// Start the week on Monday
+	for i := 1; i <= 7; i++ {
+		day := time.Weekday(i % 7)
+		fmt.Printf("%-5s", day.String()[:3])
+		for h := 0; h < 24; h++ {
+			fmt.Printf("%3s", byDayHour[day][h].glyph(usual, usualNone))
+		}
+		fmt.Println()
+	}
+	fmt.Println("\n  . usual   - shorter   + longer   ∞ no timeout   ! probes failed   (blank: no runs)")
+
+	// Slots that differ from the usual, by hour across the week and then by the hour
+	// of a particular day, for patterns that only happen on some days
+	var diffs []string
+	for h := range byHour {
+		if g := byHour[h].glyph(usual, usualNone); g != "." && g != " " {
+			diffs = append(diffs, fmt.Sprintf("%02d:00-%02d:00 (all days): %s", h, (h+1)%24, byHour[h].describe()))
+		}
+	}
+	for i := 1; i <= 7; i++ {
+		day := time.Weekday(i % 7)
+		for h := 0; h < 24; h++ {
+			b := &byDayHour[day][h]
+			if g := b.glyph(usual, usualNone); g != "." && g != " " && byHour[h].glyph(usual, usualNone) == "." {
+				diffs = append(diffs, fmt.Sprintf("%s %02d:00-%02d:00: %s", day, h, (h+1)%24, b.describe()))
+			}
+		}
+	}
+	fmt.Println()
+	if len(diffs) == 0 {
+		fmt.Println(cyan("the idle timeout was the same at all times seen"))
+		return
+	}
+	fmt.Println(yellow("differs from usual at:"))
+	for _, d := range diffs {
+		fmt.Println("  " + d)
+	}
+}
@@ -0,0 +1,104 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+//go:embed config-example.txt
+var configExample string
+
+// helpCompletion explains how to install a completion script.
+const helpCompletion = `Completion covers subcommands, flags, CDN names, scenario names, and help topics.
+To enable it for the current shell:
+
+  bash:  source <(httptimeout completion bash)
+  zsh:   source <(httptimeout completion zsh)
+  fish:  httptimeout completion fish | source
+
+To enable it for good, add that line to ~/.bashrc, ~/.zshrc, or
+~/.config/fish/config.fish.`
+
+// helpTopic is something that "httptimeout help <topic>" explains.
+type helpTopic struct {
+	name    string
+	summary string
+	print   func()
+}
+
+var helpTopics = []helpTopic{
+	{"config", "the config file format, with every option", func() { fmt.Print(configExample) }},
+	{"audit", "the audit subcommand's flags", func() {
+		fs, _ := newAuditFlagSet()
+		printFlagSetUsage(fs)
+	}},
+	{"demo", "the demo subcommand's flags", func() {
+		fs, _, _ := newDemoFlagSet()
+		printFlagSetUsage(fs)
+	}},
+	{"heatmap", "the heatmap subcommand's flags", func() {
+		fs, _ := newHeatmapFlagSet()
+		printFlagSetUsage(fs)
+	}},
+	{"scenarios", "the built-in scenarios", func() {
+		fmt.Println("Usage: httptimeout scenarios list|describe|show [name]")
+		fmt.Println()
+		scenarios, _ := readScenarios()
+		for _, s := range scenarios {
+			fmt.Printf("  %-24s %s\n", s.name, s.summary())
+		}
+	}},
+	{"cdn", "the CDNs the audit recognizes, and what to know about each", func() {
+		for _, p := range cdnPresets {
+			fmt.Println(cyan(p.name))
+			for _, n := range p.notes {
+				fmt.Println("  " + n)
+			}
+		}
+	}},
+	{"explain", "which server settings govern each kind of timeout, as -explain shows", func() {
+		var topics []string
+		for t := range explanations {
+			topics = append(topics, t)
+		}
+		sort.Strings(topics)
+		for _, t := range topics {
+			fmt.Println(cyan(t))
+			fmt.Println(wrapText(explanations[t], 78) + "\n")
+		}
+	}},
+	{"completion", "shell completion for bash, zsh, and fish", func() { fmt.Println(helpCompletion) }},
+}
+
+// printFlagSetUsage prints the usage of a subcommand's flags to stdout.
+func printFlagSetUsage(fs *flag.FlagSet) {
+	fs.SetOutput(os.Stdout)
+	fs.Usage()
+}
+
+// runHelp implements the help subcommand.
+func runHelp(args []string) {
+	if len(args) == 1 {
+		for _, t := range helpTopics {
+			if t.name == args[0] {
+				t.print()
+				return
+			}
+		}
+		fmt.Printf(red("no help topic %q\n\n"), args[0])
+	}
+
+	fmt.Println("Usage: httptimeout [-explain] [-yes] [-i-own-this-target] <config-file.txt>")
+	fmt.Println("       httptimeout <subcommand> [flags] [args]")
+	fmt.Println("       httptimeout help <topic>")
+	fmt.Println()
+	fmt.Println("Topics:")
+	for _, t := range helpTopics {
+		fmt.Printf("  %-12s %s\n", t.name, t.summary)
+	}
+}
@@ -0,0 +1,315 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// idleProbeResolution is how narrow the idle timeout bracket gets before probing stops.
+const idleProbeResolution = 500 * time.Millisecond
+
+// idleProbeResponseTimeout is how long a probe waits for a response to its request.
+const idleProbeResponseTimeout = 10 * time.Second
+
+// runIdleProbe brackets the server's keep-alive idle timeout and prints the result.
+func runIdleProbe(params testParams) {
+	fmt.Printf("probing idle timeout of %s between %v and %v\n\n", params.host, params.idleProbeMin, params.idleProbeMax)
+
+	var first firstConnRecorder
+	params.onDial = first.record
+	alive, dead, err := bracketIdleTimeout(params, os.Stdout)
+	if err != nil {
+		fmt.Println(red("probe failed:"), err)
+		return
+	}
+	bracket := idleBracket{alive: alive, dead: dead, samples: 1}
+	fmt.Println()
+	fmt.Println(cyan(describeIdleBracket(bracket)))
+	explain(explainIdle)
+	if params.statsd != "" {
+		sendIdleMetrics(params, alive, dead)
+	}
+	fmt.Println()
+	advice := idleTimeoutAdvice(alive, dead)
+	advice.addBracket(bracket)
+	advice.Run = newRunMetadata(params.settings())
+	advice.Run.Connection = first.meta
+	printAdvice(advice, params)
+
+	if params.idleRaceAttempts > 0 {
+		fmt.Println()
+		if dead == 0 {
+			fmt.Println(yellow("no idle timeout was found, so there's no race window to measure"))
+			return
+		}
+		runIdleRace(params, alive+(dead-alive)/2)
+	}
+}
+
+// runIdleWatch re-runs the idle probe every params.watch, printing only when the
+// result changes, so that drift in the server's configuration gets noticed. The runs
+// since the last change are combined for the history, to narrow the bracket.
+func runIdleWatch(params testParams) {
+	fmt.Printf("watching idle timeout of %s every %v\n\n", params.host, params.watch)
+
+	var prevAlive, prevDead time.Duration
+	var prevBracket idleBracket
+	var runs []idleBracket
+	first := true
+	for ; ; time.Sleep(params.watch) {
+		start := time.Now()
+		alive, dead, err := bracketIdleTimeout(params, io.Discard)
+		now := time.Now().Format(time.RFC3339)
+
+		// Brackets from separate runs differ a little, so only call it a change if
+		// they don't overlap
+		changed := err == nil && (first ||
+			(dead != 0 && dead <= prevAlive) ||
+			(prevDead != 0 && alive >= prevDead) ||
+			(dead == 0) != (prevDead == 0) ||
+			(alive == 0) != (prevAlive == 0))
+		if changed {
+			runs = nil
+		}
+		if err == nil {
+			runs = append(runs, idleBracket{alive: alive, dead: dead, samples: 1})
+		}
+
+		if params.watchHistory != "" {
+			rec := watchRecord{Time: start, AliveSeconds: alive.Seconds(), DeadSeconds: dead.Seconds()}
+			if err != nil {
+				rec.Error = err.Error()
+			} else {
+				rec.addBracket(combineIdleBrackets(runs))
+			}
+			if err := appendWatchRecord(params.watchHistory, rec); err != nil {
+				fmt.Println(now, red("failed to write history:"), err)
+			} else if params.uploadURI != "" {
+				uploadResult(params.uploadURI, params.watchHistory, params.host)
+			}
+		}
+		if err != nil {
+			fmt.Println(now, red("probe failed:"), err)
+			continue
+		}
+		if params.statsd != "" {
+			sendIdleMetrics(params, alive, dead)
+		}
+
+		if changed {
+			bracket := idleBracket{alive: alive, dead: dead, samples: 1}
+			if first {
+				fmt.Println(now, cyan(describeIdleBracket(bracket)))
+			} else {
+				fmt.Println(now, yellow("changed: "+describeIdleBracket(bracket)))
+				notify(params.notifySinks, notification{
+					Source:  "watch",
+					Time:    time.Now(),
+					Text:    fmt.Sprintf("httptimeout watch: idle timeout of %s changed", params.host),
+					Details: []string{"was: " + describeIdleBracket(prevBracket), "now: " + describeIdleBracket(bracket)},
+				})
+			}
+		}
+		first = false
+		prevAlive, prevDead = alive, dead
+		prevBracket = combineIdleBrackets(runs)
+	}
+}
+
+// bracketIdleTimeout probes the server's keep-alive idle timeout, writing progress to
+// out. Each probe uses a new connection: a HEAD request, an idle gap, and then another
+// HEAD. Gaps double from the configured minimum until a probe fails, and the bracket
+// is then narrowed by bisection. This doesn't rely on seeing the server's close, which
+// may be lost. alive is the longest gap that still worked and dead is the shortest
+// that didn't; either is zero if there wasn't one.
+func bracketIdleTimeout(params testParams, out io.Writer) (alive, dead time.Duration, err error) {
+	req := headRequest(params)
+	gap := params.idleProbeMin
+	for {
+		fmt.Fprint(out, yellow(fmt.Sprintf("idle %v: ", gap)))
+		ok, closedAfter, err := probeIdleOnce(params, req, gap)
+		if err != nil {
+			fmt.Fprintln(out)
+			return 0, 0, err
+		}
+
+		if ok {
+			fmt.Fprintln(out, "still worked")
+			alive = gap
+		} else if closedAfter > alive {
+			fmt.Fprintln(out, "closed by server after", closedAfter.Round(time.Millisecond))
+			dead = closedAfter.Round(time.Millisecond)
+		} else {
+			fmt.Fprintln(out, "dead")
+			dead = gap
+		}
+
+		if dead == 0 {
+			if gap == params.idleProbeMax {
+				break
+			}
+			gap *= 2
+			if gap > params.idleProbeMax {
+				gap = params.idleProbeMax
+			}
+		} else if alive == 0 || dead-alive <= idleProbeResolution {
+			break
+		} else {
+			gap = (alive + (dead-alive)/2).Round(time.Millisecond)
+		}
+	}
+	return alive, dead, nil
+}
+
+// idleBracket is the idle timeout bracket from one or more runs of
+// bracketIdleTimeout.
+type idleBracket struct {
+	alive, dead time.Duration
+	// samples is how many runs it's from
+	samples int
+	// disagree is set if the runs' brackets didn't overlap, so that it spans them all
+	disagree bool
+}
+
+// estimate is the middle of the bracket, and how far the timeout could be from it.
+// ok is false unless both ends were found.
+func (b idleBracket) estimate() (mid, margin time.Duration, ok bool) {
+	if b.alive == 0 || b.dead == 0 {
+		return 0, 0, false
+	}
+	margin = (b.dead - b.alive) / 2
+	return b.alive + margin, margin, true
+}
+
+// lowConfidence is true if the bracket rests on one probe per gap, where a single
+// lost packet or slow response can move it, or on runs that don't agree.
+func (b idleBracket) lowConfidence() bool {
+	return b.samples < 2 || b.disagree
+}
+
+// combineIdleBrackets narrows the brackets from several runs to where they overlap.
+// If they don't all overlap, the result spans them instead, and is low confidence.
+func combineIdleBrackets(runs []idleBracket) idleBracket {
+	var c idleBracket
+	for i, r := range runs {
+		c.samples += r.samples
+		if i == 0 || r.alive > c.alive {
+			c.alive = r.alive
+		}
+		if i == 0 || (r.dead != 0 && (c.dead == 0 || r.dead < c.dead)) {
+			c.dead = r.dead
+		}
+	}
+	if c.dead == 0 || c.alive < c.dead {
+		return c
+	}
+	c.disagree = true
+	for i, r := range runs {
+		if i == 0 || r.alive < c.alive {
+			c.alive = r.alive
+		}
+		if r.dead == 0 || (c.dead != 0 && r.dead > c.dead) {
+			c.dead = r.dead
+		}
+	}
+	return c
+}
+
+// describeIdleBracket describes an idle timeout bracket.
+func describeIdleBracket(b idleBracket) string {
+	mid, margin, ok := b.estimate()
+	switch {
+	case b.dead == 0:
+		return fmt.Sprintf("idle timeout is longer than %v", b.alive)
+	case !ok:
+		return fmt.Sprintf("idle timeout is shorter than %v", b.dead)
+	}
+	var confidence string
+	switch {
+	case b.disagree:
+		confidence = fmt.Sprintf("low confidence: %d runs disagree", b.samples)
+	case b.samples < 2:
+		confidence = "low confidence: one probe per gap"
+	default:
+		confidence = fmt.Sprintf("from %d runs", b.samples)
+	}
+	return fmt.Sprintf("idle timeout is between %v (still worked) and %v (dead): ~%v ±%v (%s)",
+		b.alive, b.dead, mid, margin, confidence)
+}
+
+// probeIdleOnce is idleProbeOnce, as a variable so that tests can put a fake server
+// behind bracketIdleTimeout.
+var probeIdleOnce = idleProbeOnce
+
+// idleProbeOnce makes a request on a new connection, waits gap, and then makes another.
+// alive is true if the second request got a response. If the server was seen to close
+// the connection during the gap, closedAfter is how far into the gap that happened.
+// err is only set if the probe couldn't be made at all.
+func idleProbeOnce(params testParams, req string, gap time.Duration) (alive bool, closedAfter time.Duration, err error) {
+	conn, err := dial(params)
+	if err != nil {
+		return false, 0, err
+	}
+	defer conn.c.Close()
+
+	if _, err := conn.c.Write([]byte(req)); err != nil {
+		return false, 0, fmt.Errorf("first request write failed: %w", err)
+	}
+	if _, err := readResponseHead(conn); err != nil {
+		return false, 0, fmt.Errorf("first request got no response: %w", err)
+	}
+
+	if slept := sleepWatchConn(gap, conn, false); slept < gap {
+		return false, slept, nil
+	}
+
+	if _, err := conn.c.Write([]byte(req)); err != nil {
+		return false, 0, nil
+	}
+	head, err := readResponseHead(conn)
+	if err != nil {
+		return false, 0, nil
+	}
+	// A server may send a 408 when it times out the connection, which we'd only read now
+	if bytes.HasPrefix(head, []byte("HTTP/1.1 408")) || bytes.HasPrefix(head, []byte("HTTP/1.0 408")) {
+		return false, 0, nil
+	}
+	return true, 0, nil
+}
+
+// readResponseHead reads a response up to the end of its headers.
+func readResponseHead(conn *conn) ([]byte, error) {
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	deadline := time.Now().Add(idleProbeResponseTimeout)
+	var head []byte
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		b, err := readByte(conn, deadline)
+		if err != nil {
+			return head, err
+		}
+		head = append(head, b)
+	}
+	return head, nil
+}
+
+// headRequest builds a minimal HEAD request for the path and Host of the configured request.
+func headRequest(params testParams) string {
+	_, path := params.requestLine()
+	if path == "" {
+		path = "/"
+	}
+	hostHeader := params.host
+	for _, h := range params.headers {
+		if strings.HasPrefix(strings.ToLower(h.val), "host:") {
+			hostHeader = strings.TrimSpace(h.val[len("host:"):])
+		}
+	}
+	return fmt.Sprintf("HEAD %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, hostHeader)
+}
@@ -0,0 +1,139 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeIdleServer stands in for a server with the given idle timeout (none if zero).
+// If announce is set, it reports when it closed, as a server whose FIN is seen does.
+type fakeIdleServer struct {
+	timeout  time.Duration
+	announce bool
+	err      error
+	// gaps are the gaps probed, in order
+	gaps []time.Duration
+}
+
+func (s *fakeIdleServer) probe(params testParams, req string, gap time.Duration) (bool, time.Duration, error) {
+	s.gaps = append(s.gaps, gap)
+	if s.err != nil {
+		return false, 0, s.err
+	}
+	if s.timeout == 0 || gap < s.timeout {
+		return true, 0, nil
+	}
+	if s.announce {
+		return false, s.timeout, nil
+	}
+	return false, 0, nil
+}
+
+// withFakeIdleServer runs bracketIdleTimeout between min and max against s.
+func withFakeIdleServer(t *testing.T, s *fakeIdleServer, min, max time.Duration) (alive, dead time.Duration, err error) {
+	t.Helper()
+	saved := probeIdleOnce
+	probeIdleOnce = s.probe
+	defer func() { probeIdleOnce = saved }()
+	params := testParams{host: "localhost:8585", idleProbeMin: min, idleProbeMax: max}
+	return bracketIdleTimeout(params, io.Discard)
+}
+
+func TestBracketIdleTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{1500 * time.Millisecond, 7300 * time.Millisecond, 30 * time.Second, 59 * time.Second} {
+		s := &fakeIdleServer{timeout: timeout}
+		alive, dead, err := withFakeIdleServer(t, s, time.Second, time.Minute)
+		if err != nil {
+			t.Fatalf("timeout %v: %v", timeout, err)
+		}
+		if !(alive < timeout && timeout <= dead) {
+			t.Errorf("timeout %v: bracket %v to %v doesn't contain it", timeout, alive, dead)
+		}
+		if dead-alive > idleProbeResolution {
+			t.Errorf("timeout %v: bracket %v to %v is wider than %v", timeout, alive, dead, idleProbeResolution)
+		}
+		var idle time.Duration
+		for _, g := range s.gaps {
+			idle += g
+		}
+		if worst := idleProbeWorstCase(time.Second, time.Minute); idle > worst {
+			t.Errorf("timeout %v: spent %v idle, more than the worst case of %v", timeout, idle, worst)
+		}
+	}
+}
+
+func TestBracketIdleTimeoutEdges(t *testing.T) {
+	tests := []struct {
+		name        string
+		server      fakeIdleServer
+		alive, dead time.Duration
+	}{
+		// Every gap up to max works
+		{"no timeout", fakeIdleServer{}, 8 * time.Second, 0},
+		// Even the shortest gap fails, so there's nothing known to work
+		{"shorter than min", fakeIdleServer{timeout: 500 * time.Millisecond}, 0, time.Second},
+		// A seen close gives the top of the bracket exactly, rather than the gap
+		{"announced close", fakeIdleServer{timeout: 3 * time.Second, announce: true}, 2500 * time.Millisecond, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		alive, dead, err := withFakeIdleServer(t, &tt.server, time.Second, 8*time.Second)
+		if err != nil || alive != tt.alive || dead != tt.dead {
+			t.Errorf("%s: got %v, %v, %v; want %v, %v", tt.name, alive, dead, err, tt.alive, tt.dead)
+		}
+	}
+
+	failing := &fakeIdleServer{err: errors.New("connection refused")}
+	if _, _, err := withFakeIdleServer(t, failing, time.Second, 8*time.Second); err == nil {
+		t.Errorf("probe failure wasn't returned")
+	}
+}
+
+func TestCombineIdleBrackets(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name string
+		runs []idleBracket
+		want idleBracket
+	}{
+		{"one run", []idleBracket{{alive: 12 * s, dead: 14 * s, samples: 1}},
+			idleBracket{alive: 12 * s, dead: 14 * s, samples: 1}},
+		{"overlapping runs narrow", []idleBracket{{alive: 12 * s, dead: 14 * s, samples: 1}, {alive: 13 * s, dead: 15 * s, samples: 1}},
+			idleBracket{alive: 13 * s, dead: 14 * s, samples: 2}},
+		{"disjoint runs span", []idleBracket{{alive: 12 * s, dead: 13 * s, samples: 1}, {alive: 14 * s, dead: 15 * s, samples: 1}},
+			idleBracket{alive: 12 * s, dead: 15 * s, samples: 2, disagree: true}},
+		{"no timeout", []idleBracket{{alive: 30 * s, samples: 1}, {alive: 30 * s, samples: 1}},
+			idleBracket{alive: 30 * s, samples: 2}},
+	}
+	for _, tt := range tests {
+		if got := combineIdleBrackets(tt.runs); got != tt.want {
+			t.Errorf("%s: combineIdleBrackets() = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIdleBracketConfidence(t *testing.T) {
+	one := idleBracket{alive: 12 * time.Second, dead: 14 * time.Second, samples: 1}
+	mid, margin, ok := one.estimate()
+	if !ok || mid != 13*time.Second || margin != time.Second {
+		t.Errorf("estimate() = %v, %v, %v; want 13s, 1s, true", mid, margin, ok)
+	}
+	if !one.lowConfidence() {
+		t.Errorf("a single run isn't low confidence")
+	}
+	if two := combineIdleBrackets([]idleBracket{one, one}); two.lowConfidence() {
+		t.Errorf("two agreeing runs are low confidence")
+	}
+	if _, _, ok := (idleBracket{alive: 30 * time.Second, samples: 1}).estimate(); ok {
+		t.Errorf("estimate() ok without a dead end")
+	}
+
+	var a poolAdvice
+	a.addBracket(one)
+	if a.ServerIdleTimeout != "13s" || a.Margin != "1s" || !a.LowConfidence {
+		t.Errorf("advice = %+v; want 13s ±1s, low confidence", a)
+	}
+}
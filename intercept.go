@@ -0,0 +1,110 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// localTerminationRTT is a TCP connect time too short for a host that isn't on
+	// the local network, suggesting that something nearby accepted the connection
+	localTerminationRTT = 2 * time.Millisecond
+	// handshakeRelayed is how long a TLS handshake takes, after a connect that fast,
+	// if it was relayed on to somewhere further away
+	handshakeRelayed = 10 * time.Millisecond
+)
+
+// interceptionIssuers are (lower-cased) parts of the issuer names of the CAs that
+// intercepting proxies and security products use to re-sign certificates.
+var interceptionIssuers = []string{
+	"zscaler", "bluecoat", "blue coat", "fortinet", "fortigate", "palo alto", "netskope",
+	"umbrella", "forcepoint", "websense", "sophos", "mitmproxy", "charles proxy",
+	"do_not_trust", "fiddler", "kaspersky", "avast", "eset ssl filter", "barracuda",
+	"check point", "untangle", "smoothwall", "lightspeed", "securly", "mcafee web gateway",
+}
+
+// interceptionHeaders are (lower-cased) prefixes of response header names that
+// forward proxies add.
+var interceptionHeaders = []string{"x-bluecoat", "x-squid", "x-zscaler", "x-netskope", "x-fortigate", "proxy-connection"}
+
+// interceptionSigns returns the signs that a transparent middlebox handled the
+// connection instead of (or in front of) the target: a plaintext answer where TLS was
+// expected, a certificate from an interception CA or not for the target, a connect
+// too fast for the target's distance, or proxy headers in the response.
+func interceptionSigns(params testParams, conn *conn) []string {
+	var signs []string
+	host, port, _ := net.SplitHostPort(params.host)
+	serverName := host
+	if params.serverName != "" {
+		serverName = params.serverName
+	}
+
+	if conn.tlsRefused && port == "443" {
+		signs = append(signs, "the server answered in plaintext on port 443, where TLS was expected (an intercepting proxy, or a captive portal)")
+	}
+
+	if tc, ok := conn.c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		for _, cert := range state.PeerCertificates {
+			issuer := strings.ToLower(cert.Issuer.String())
+			for _, name := range interceptionIssuers {
+				if strings.Contains(issuer, name) {
+					signs = append(signs, fmt.Sprintf("a certificate was issued by %q, which looks like an interception CA", cert.Issuer.String()))
+					break
+				}
+			}
+		}
+		if len(state.PeerCertificates) > 0 && net.ParseIP(serverName) == nil {
+			if err := state.PeerCertificates[0].VerifyHostname(serverName); err != nil {
+				signs = append(signs, fmt.Sprintf("the certificate isn't for %s: %v", serverName, err))
+			}
+		}
+	}
+
+	remote, _, _ := net.SplitHostPort(conn.c.RemoteAddr().String())
+	if !isLocalHost(params.host) && !isLocalHost(remote) && conn.rtt < localTerminationRTT {
+		sign := fmt.Sprintf("the TCP connect took %v, too fast for a host that isn't local, so something nearby may have accepted it", conn.rtt)
+		if conn.handshakeDuration > handshakeRelayed {
+			sign += fmt.Sprintf(" (and the TLS handshake, at %v, went further)", conn.handshakeDuration.Round(time.Millisecond))
+		}
+		signs = append(signs, sign)
+	}
+
+	if end := bytes.Index(conn.response, []byte("\r\n\r\n")); end >= 0 {
+		for _, line := range strings.Split(string(conn.response[:end]), "\r\n")[1:] {
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+			for _, prefix := range interceptionHeaders {
+				if strings.HasPrefix(name, prefix) {
+					signs = append(signs, fmt.Sprintf("the response has the header %s, which forward proxies add", name))
+				}
+			}
+			if (name == "via" || name == "server") && strings.Contains(strings.ToLower(value), "squid") {
+				signs = append(signs, fmt.Sprintf("the response's %s header names Squid: %q", name, value))
+			}
+		}
+	}
+	return signs
+}
+
+// printInterception warns if the connection seems to have been intercepted, in which
+// case the timeouts seen are the middlebox's rather than the target's.
+func printInterception(params testParams, conn *conn) {
+	signs := interceptionSigns(params, conn)
+	if len(signs) == 0 {
+		return
+	}
+	fmt.Println(yellow("a transparent proxy may be intercepting the connection, so the timeouts seen may be its own:"))
+	for _, s := range signs {
+		fmt.Println(yellow("  " + s))
+	}
+}
@@ -0,0 +1,93 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Modes that open many connections at once look like an attack from the other end,
+// and are one against a server that isn't ours. They're refused unless the target is
+// local, listed in allowedTargetsEnv, or -i-own-this-target is given. Probes that use
+// one connection at a time aren't restricted.
+
+// allowedTargetsEnv names the environment variable listing the targets that modes
+// opening many connections can be run against: host names, "*.example.com" for a
+// domain's hosts, or CIDR ranges, separated by commas or spaces.
+const allowedTargetsEnv = "HTTPTIMEOUT_ALLOWED_TARGETS"
+
+// interlockMaxPool is the largest IdlePool that can be run against any target.
+const interlockMaxPool = 50
+
+// ownTarget is set by -i-own-this-target, to skip the allowlist.
+var ownTarget bool
+
+// targetAllowed is true if modes that open many connections can be run against host
+// (host:port, or a bare host).
+func targetAllowed(host string) bool {
+	if ownTarget || isLocalHost(host) {
+		return true
+	}
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	h = strings.ToLower(strings.TrimSuffix(h, "."))
+	ip := net.ParseIP(h)
+	for _, entry := range strings.FieldsFunc(os.Getenv(allowedTargetsEnv), func(r rune) bool { return r == ',' || r == ' ' }) {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if domain := strings.TrimPrefix(entry, "*."); domain != entry {
+			if strings.HasSuffix(h, "."+domain) {
+				return true
+			}
+			continue
+		}
+		if eh, _, err := net.SplitHostPort(entry); err == nil {
+			entry = eh
+		}
+		if h == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTargetAllowed returns an error if host isn't allowed (see targetAllowed) to
+// have what describes done to it.
+func checkTargetAllowed(host, what string) error {
+	if targetAllowed(host) {
+		return nil
+	}
+	return fmt.Errorf("%s isn't local or listed in %s, and %s may be taken for an attack; "+
+		"if you're allowed to test it, list it there or pass -i-own-this-target", host, allowedTargetsEnv, what)
+}
+
+// checkParamsAllowed checks the modes in params that open many connections at once
+// against the allowlist. Kubernetes targets are reached with the user's own kubectl
+// access, so they're taken to be allowed.
+func checkParamsAllowed(params testParams) error {
+	if params.host == "" {
+		return nil
+	}
+	if params.idleRaceAttempts > 0 {
+		conns := params.idleRaceAttempts * len(idleRaceOffsets)
+		if err := checkTargetAllowed(params.host, fmt.Sprintf("IdleRace's %d connections at once", conns)); err != nil {
+			return err
+		}
+	}
+	if params.idlePoolSize > interlockMaxPool {
+		if err := checkTargetAllowed(params.host, fmt.Sprintf("an IdlePool of %d connections", params.idlePoolSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import "testing"
+
+func TestTargetAllowed(t *testing.T) {
+	t.Setenv(allowedTargetsEnv, "staging.example.com, *.internal.example.org,203.0.113.0/24 api.example.net:8443")
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost:8585", true},
+		{"10.1.2.3:443", true},
+		{"staging.example.com:443", true},
+		{"STAGING.example.com.:443", true},
+		{"prod.example.com:443", false},
+		{"a.internal.example.org:443", true},
+		{"a.b.internal.example.org", true},
+		{"internal.example.org:443", false},
+		{"evilinternal.example.org:443", false},
+		{"203.0.113.9:443", true},
+		{"198.51.100.9:443", false},
+		{"api.example.net:443", true},
+		{"example.net:443", false},
+	}
+	for _, tt := range tests {
+		if got := targetAllowed(tt.host); got != tt.want {
+			t.Errorf("targetAllowed(%q) = %v; want %v", tt.host, got, tt.want)
+		}
+	}
+
+	ownTarget = true
+	defer func() { ownTarget = false }()
+	if !targetAllowed("prod.example.com:443") {
+		t.Errorf("-i-own-this-target didn't allow a target")
+	}
+}
+
+func TestCheckParamsAllowed(t *testing.T) {
+	t.Setenv(allowedTargetsEnv, "")
+	tests := []struct {
+		name   string
+		params testParams
+		ok     bool
+	}{
+		{"single connection", testParams{host: "example.com:443"}, true},
+		{"IdleProbe", testParams{host: "example.com:443", idleProbeMin: 1, idleProbeMax: 2}, true},
+		{"IdleRace", testParams{host: "example.com:443", idleRaceAttempts: 1}, false},
+		{"IdleRace locally", testParams{host: "127.0.0.1:8585", idleRaceAttempts: 10}, true},
+		{"small IdlePool", testParams{host: "example.com:443", idlePoolSize: interlockMaxPool}, true},
+		{"large IdlePool", testParams{host: "example.com:443", idlePoolSize: interlockMaxPool + 1}, false},
+		{"Kubernetes", testParams{k8sTarget: "default/svc:80", idleRaceAttempts: 10}, true},
+	}
+	for _, tt := range tests {
+		if err := checkParamsAllowed(tt.params); (err == nil) != tt.ok {
+			t.Errorf("%s: checkParamsAllowed() = %v; want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
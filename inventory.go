@@ -0,0 +1,305 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readInventory reads a file of audit targets. Targets are separated by blank lines;
+// each starts with its host:port, which can be followed by settings for that target:
+//
+//	Path: /health
+//	Header: Authorization: Bearer xyz
+//	SNI: api.example.com
+//	Expect: header read timeout: 10s
+//	ExpectConfig: nginx:/etc/nginx/nginx.conf
+//	Tag: team=payments
+//
+// Header and Tag can be repeated. Tags label the target's results in every output,
+// for grouping the results of a large inventory. Expect gives the expected result of
+// a probe, or "none" if no timeout is expected, so that the audit can check the
+// server matches its intended configuration. ExpectConfig reads expected results
+// from the timeouts set in a server config; a later Expect overrides one from it.
+// defaultPath is used for targets without a Path. A file ending in .csv is read as a
+// CSV instead (see readInventoryCSV).
+func readInventory(filename, defaultPath string) ([]auditTarget, error) {
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		return readInventoryCSV(filename, defaultPath)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory file %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	pathRegexp := regexp.MustCompile(`^Path:\s*(\S+)`)
+	headerRegexp := regexp.MustCompile(`^Header:\s*(.+)`)
+	sniRegexp := regexp.MustCompile(`^SNI:\s*(\S+)`)
+	expectRegexp := regexp.MustCompile(`^Expect:\s*(.+):\s*(\S+)\s*$`)
+	expectConfigRegexp := regexp.MustCompile(`^ExpectConfig:\s*(\S+)`)
+	tagRegexp := regexp.MustCompile(`^Tag:\s*([^=\s]+)\s*=\s*(.*)$`)
+
+	var targets []auditTarget
+	var cur *auditTarget
+	scanner := bufio.NewScanner(f)
+	for firstLine := true; scanner.Scan(); firstLine = false {
+		lineStr := strings.TrimSuffix(scanner.Text(), "\r")
+		if firstLine {
+			lineStr = strings.TrimPrefix(lineStr, "\ufeff")
+		}
+		lineStr = strings.TrimSpace(lineStr)
+
+		if lineStr == "" {
+			cur = nil
+			continue
+		}
+		if strings.HasPrefix(lineStr, "#") {
+			// comment
+			continue
+		}
+
+		if cur == nil {
+			targets = append(targets, auditTarget{host: lineStr, path: defaultPath})
+			cur = &targets[len(targets)-1]
+			continue
+		}
+
+		if match := pathRegexp.FindStringSubmatch(lineStr); match != nil {
+			cur.path = match[1]
+		} else if match := headerRegexp.FindStringSubmatch(lineStr); match != nil {
+			cur.headers = append(cur.headers, match[1])
+		} else if match := sniRegexp.FindStringSubmatch(lineStr); match != nil {
+			cur.serverName = match[1]
+		} else if match := tagRegexp.FindStringSubmatch(lineStr); match != nil {
+			cur.setTag(match[1], strings.TrimSpace(match[2]))
+		} else if match := expectConfigRegexp.FindStringSubmatch(lineStr); match != nil {
+			if err := cur.expectConfig(match[1]); err != nil {
+				return nil, err
+			}
+		} else if match := expectRegexp.FindStringSubmatch(lineStr); match != nil {
+			if err := cur.setExpect(strings.TrimSpace(match[1]), match[2]); err != nil {
+				return nil, fmt.Errorf("got bad inventory Expect: %q: %w", lineStr, err)
+			}
+		} else {
+			return nil, fmt.Errorf("got unexpected inventory line for %s: %q", cur.host, lineStr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets in inventory file %q", filename)
+	}
+	return targets, nil
+}
+
+// readInventoryCSV reads a CSV file of audit targets, one per row, for inventories
+// exported from a spreadsheet or a CMDB. The first row names the columns:
+//
+//	host,path,sni,header,expect:idle timeout,team,environment
+//	api.example.com:443,/health,,Authorization: Bearer xyz,none,payments,prod
+//
+// Only host is required. The header column can be repeated, expect:<probe> columns
+// are like Expect lines, and expect-config is like ExpectConfig. Every other column
+// is a tag, named by the column. Empty cells are ignored.
+func readInventoryCSV(filename, defaultPath string) ([]auditTarget, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory file %q: %w", filename, err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	columns, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory CSV header: %w", err)
+	}
+	hostColumn := -1
+	for i, c := range columns {
+		c = strings.TrimSpace(strings.TrimPrefix(c, "\ufeff"))
+		columns[i] = c
+		if c == "host" {
+			hostColumn = i
+		}
+		if strings.HasPrefix(c, "expect:") && !isAuditProbe(strings.TrimSpace(strings.TrimPrefix(c, "expect:"))) {
+			return nil, fmt.Errorf("got unknown probe in inventory CSV column %q", c)
+		}
+	}
+	if hostColumn < 0 {
+		return nil, fmt.Errorf("inventory CSV has no host column")
+	}
+
+	var targets []auditTarget
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read inventory CSV: %w", err)
+		}
+		t := auditTarget{host: strings.TrimSpace(row[hostColumn]), path: defaultPath}
+		if t.host == "" {
+			line, _ := r.FieldPos(hostColumn)
+			return nil, fmt.Errorf("inventory CSV line %d has no host", line)
+		}
+		for i, c := range columns {
+			cell := strings.TrimSpace(row[i])
+			if cell == "" || i == hostColumn {
+				continue
+			}
+			switch {
+			case c == "path":
+				t.path = cell
+			case c == "sni":
+				t.serverName = cell
+			case c == "header":
+				t.headers = append(t.headers, cell)
+			case c == "expect-config":
+				err = t.expectConfig(cell)
+			case strings.HasPrefix(c, "expect:"):
+				err = t.setExpect(strings.TrimSpace(strings.TrimPrefix(c, "expect:")), cell)
+			default:
+				t.setTag(c, cell)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("got bad inventory CSV %s for %s: %w", c, t.host, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets in inventory file %q", filename)
+	}
+	return targets, nil
+}
+
+// setTag sets one of the target's tags.
+func (t *auditTarget) setTag(name, value string) {
+	if t.tags == nil {
+		t.tags = map[string]string{}
+	}
+	t.tags[name] = value
+}
+
+// setExpect sets the expected result of a probe: a duration, or "none" for no
+// timeout.
+func (t *auditTarget) setExpect(probe, value string) error {
+	if !isAuditProbe(probe) {
+		return fmt.Errorf("unknown probe %q", probe)
+	}
+	var want time.Duration
+	if value != "none" {
+		var err error
+		if want, err = time.ParseDuration(value); err != nil || want <= 0 {
+			return fmt.Errorf("want a duration or none, got %q", value)
+		}
+	}
+	if t.expect == nil {
+		t.expect = map[string]time.Duration{}
+	}
+	t.expect[probe] = want
+	delete(t.expectFrom, probe)
+	delete(t.expectAtLeast, probe)
+	return nil
+}
+
+// expectConfig sets the expected results from the timeouts in a server config, given
+// as <server>:<file>.
+func (t *auditTarget) expectConfig(arg string) error {
+	expect, from, atLeast, err := configExpectations(arg)
+	if err != nil {
+		return err
+	}
+	if t.expect == nil {
+		t.expect = map[string]time.Duration{}
+	}
+	if t.expectFrom == nil {
+		t.expectFrom = map[string]string{}
+	}
+	if t.expectAtLeast == nil {
+		t.expectAtLeast = map[string]bool{}
+	}
+	for probe, want := range expect {
+		t.expect[probe], t.expectFrom[probe], t.expectAtLeast[probe] = want, from[probe], atLeast[probe]
+	}
+	return nil
+}
+
+// formatTags formats tags as "name=value" pairs, sorted by name.
+func formatTags(tags map[string]string) string {
+	var pairs []string
+	for name, value := range tags {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// printTagSummary prints, for each value of each tag, how many targets have it and
+// how their findings came out, so that a matrix run can be read by team or
+// environment. It prints nothing if no target is tagged.
+func printTagSummary(results []auditResult) {
+	type tally struct{ targets, high, medium, unmet, failed int }
+	tallies := map[string]*tally{}
+	for _, r := range results {
+		for name, value := range r.tags {
+			key := name + "=" + value
+			t := tallies[key]
+			if t == nil {
+				t = &tally{}
+				tallies[key] = t
+			}
+			t.targets++
+			for _, f := range r.findings {
+				switch {
+				case f.err != nil:
+					t.failed++
+				case f.severity == severityHigh:
+					t.high++
+				case f.severity == severityMedium:
+					t.medium++
+				}
+				if f.hasExpected && !f.metExpected {
+					t.unmet++
+				}
+			}
+		}
+	}
+	if len(tallies) == 0 {
+		return
+	}
+	var keys []string
+	for key := range tallies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Println(cyan("by tag:"))
+	for _, key := range keys {
+		t := tallies[key]
+		fmt.Printf("  %-24s %d target(s): %d high, %d medium, %d unmet expectation(s), %d failed probe(s)\n",
+			key, t.targets, t.high, t.medium, t.unmet, t.failed)
+	}
+	fmt.Println()
+}
+
+// isAuditProbe says whether name is the name of one of the audit probes.
+func isAuditProbe(name string) bool {
+	for _, p := range auditProbes {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
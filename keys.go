@@ -0,0 +1,173 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPollInterval is how often a wait checks for keypresses.
+const keyPollInterval = 100 * time.Millisecond
+
+// keyHelp lists the keys that adjust an interactive run.
+const keyHelp = "keys: s skip this sleep, e extend this sleep (or keep reading past MaxResponseBytes), a abort this phase"
+
+// keys is how keypresses reach a running request; it's nil if the run isn't
+// interactive, and all of its methods do nothing then.
+var keys *keyControl
+
+// keyControl reads single keypresses from the terminal while a request runs, and
+// holds them until the code that's sleeping or pacing acts on them.
+type keyControl struct {
+	mu sync.Mutex
+	// phase is the part of the request under way: "headers", "body", or "response"
+	phase   string
+	skip    bool
+	extend  int
+	aborted bool
+	// restore is the terminal's settings from before, as "stty -g" printed them
+	restore string
+}
+
+// startKeys starts reading keys, once for the whole process, so that a retried
+// request doesn't leave a second reader taking its keypresses. Keys are only read
+// between resume and stop, which put the terminal into single-keypress mode and back.
+// It returns nil if stdin isn't a terminal or its mode can't be read (stty is used,
+// so that there are no dependencies).
+func startKeys() *keyControl {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil
+	}
+	k := &keyControl{restore: strings.TrimSpace(saved)}
+
+	// Ctrl-C would otherwise leave the terminal without echo
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		k.stop()
+		os.Exit(130)
+	}()
+
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(b); err != nil {
+				return
+			} else if n == 1 {
+				k.press(b[0])
+			}
+		}
+	}()
+	return k
+}
+
+// stty runs stty on the terminal.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// resume puts the terminal into single-keypress mode, for a request's run.
+func (k *keyControl) resume() {
+	if k == nil {
+		return
+	}
+	stty("-icanon", "-echo", "min", "1")
+}
+
+// stop restores the terminal's mode. The keys are still read, but only reach us
+// once a line is entered, until resume.
+func (k *keyControl) stop() {
+	if k == nil {
+		return
+	}
+	stty(k.restore)
+}
+
+func (k *keyControl) press(b byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch b {
+	case 's', 'S':
+		k.skip = true
+	case 'e', 'E':
+		k.extend++
+	case 'a', 'A':
+		k.aborted = true
+	}
+}
+
+// startPhase begins a new phase of the request ("headers", "body", or "response"),
+// which clears an abort and any keypress that nothing acted on.
+func (k *keyControl) startPhase(phase string) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.phase, k.skip, k.extend, k.aborted = phase, false, 0, false
+}
+
+// inResponse is true once the response is being read, where extending means
+// reading for longer rather than sleeping for longer.
+func (k *keyControl) inResponse() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.phase == "response"
+}
+
+// takeSkip is true, once, if the user asked to skip the current sleep.
+func (k *keyControl) takeSkip() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	skip := k.skip
+	k.skip = false
+	return skip
+}
+
+// takeExtend is how many times the user asked to extend the current wait since
+// the last call.
+func (k *keyControl) takeExtend() int {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	n := k.extend
+	k.extend = 0
+	return n
+}
+
+// phaseAborted is true if the user aborted the current phase.
+func (k *keyControl) phaseAborted() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.aborted
+}
+
+// keyNote prints what a keypress changed.
+func keyNote(conn *conn, format string, args ...interface{}) {
+	fmt.Println(timestamp(conn) + cyan("[key] "+fmt.Sprintf(format, args...)))
+}
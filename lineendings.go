@@ -0,0 +1,52 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// lineEnder returns a function that gives the line ending for each successive line
+// of the request head, going by params.lineEndings: CRLF (the default), bare LF, or
+// "mixed", which alternates between them starting with CRLF.
+func (p testParams) lineEnder() func() string {
+	line := 0
+	return func() string {
+		line++
+		switch {
+		case p.lineEndings == "lf", p.lineEndings == "mixed" && line%2 == 0:
+			return "\n"
+		default:
+			return "\r\n"
+		}
+	}
+}
+
+// printLineEndingReport reports how the server handled a request head sent with
+// non-CRLF line endings. A strict server rejects them, ideally as soon as it sees
+// one; a lenient one accepts them; and one that doesn't see the end of the headers
+// in them waits for more until its header timeout.
+func printLineEndingReport(conn *conn, readErr error, lineEndings string) {
+	if lineEndings == "" || lineEndings == "crlf" {
+		return
+	}
+
+	status := responseStatus(conn.response)
+	switch {
+	case status == "400":
+		into := conn.firstByteTime.Sub(conn.firstWriteTime).Round(time.Millisecond)
+		if conn.requestSentTime.IsZero() || conn.firstByteTime.Before(conn.requestSentTime) {
+			fmt.Printf(cyan("the server rejected %s line endings %v into the request, before it was fully sent (strict, and it rejects as it parses)\n"), lineEndings, into)
+		} else {
+			fmt.Printf(cyan("the server rejected %s line endings once the request was sent (strict)\n"), lineEndings)
+		}
+	case status != "":
+		fmt.Printf(cyan("the server accepted %s line endings (lenient), responding %s\n"), lineEndings, status)
+	case readErr == io.EOF || (readErr != nil && !isTimeout(readErr)):
+		fmt.Printf(cyan("the connection %s without a response to %s line endings\n"), describeEnd(readErr), lineEndings)
+	default:
+		fmt.Printf(cyan("the server didn't respond to %s line endings; it may not have seen the end of the headers in them, and be waiting for more\n"), lineEndings)
+	}
+}
@@ -0,0 +1,38 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// lingerProbeInterval is how often a byte is written to probe a lingering close.
+const lingerProbeInterval = 50 * time.Millisecond
+
+// printLingerClose measures how long the server keeps reading (and discarding) what
+// we send after it has closed its side of the connection, before it resets it. This
+// is a lingering close, like Apache's and Go's: it gives the client time to read the
+// response before a RST (from unread data) could destroy it. A server that resets
+// sooner can lose its response to a client still uploading a large body.
+//
+// It must be called after the server's FIN was seen, and writes to the connection
+// for up to max.
+func printLingerClose(conn *conn, max time.Duration) {
+	fin := conn.readEndTime
+	start := time.Now()
+	var written int
+	for time.Since(start) < max {
+		if _, err := conn.c.Write([]byte("x")); err != nil {
+			// The RST came in response to an earlier write, within an interval of it
+			drained := time.Since(fin).Round(time.Millisecond)
+			fmt.Printf(cyan("server drained %d bytes for ~%v after its FIN before it %s (lingering close; ±%v)\n"),
+				written, drained, describeEnd(err), lingerProbeInterval)
+			return
+		}
+		written++
+		time.Sleep(lingerProbeInterval)
+	}
+	fmt.Printf(cyan("server was still accepting bytes %v after its FIN (%d written); it may be draining indefinitely\n"),
+		time.Since(fin).Round(time.Millisecond), written)
+}
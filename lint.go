@@ -0,0 +1,172 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// lintMaxSleep is longer than any timeout a server plausibly has, so a sleep this
+	// long is probably a typo (like "10m" for "10s")
+	lintMaxSleep = 15 * time.Minute
+	// lintMaxRuntime is longer than a scenario should take to run
+	lintMaxRuntime = time.Hour
+	// lintMaxThirdPartyRuntime and lintMinThirdPartyWatch are the limits past which
+	// settings are aggressive enough to bother someone else's server, whose operators
+	// may take them for an attack (see also interlockMaxPool)
+	lintMaxThirdPartyRuntime = 10 * time.Minute
+	lintMinThirdPartyWatch   = 5 * time.Minute
+)
+
+// runLint implements the lint subcommand, which warns about common mistakes in
+// configs. It exits with status 1 if there were any.
+func runLint(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: httptimeout lint <config-file.txt>...")
+		os.Exit(2)
+	}
+	var warned bool
+	for _, filename := range args {
+		params, err := readConfig(filename)
+		if err != nil {
+			fmt.Printf("%s: %s\n", filename, red(err.Error()))
+			warned = true
+			continue
+		}
+		for _, w := range lintConfig(params) {
+			fmt.Printf("%s: %s\n", filename, yellow(w))
+			warned = true
+		}
+	}
+	if warned {
+		os.Exit(1)
+	}
+}
+
+// lintConfig returns warnings about params.
+func lintConfig(p testParams) []string {
+	var warnings []string
+	warnf := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	for _, s := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"header sleep", p.maxHeaderSleep()},
+		{"HeaderEndSleep", p.headerEndSleep},
+		{"BodyStartSleep", p.bodyStartSleep},
+		{"PerByteBodySleep", p.perByteBodySleep},
+		{"PerByteResponseReadSleep", p.perByteResponseReadSleep},
+	} {
+		if s.d > lintMaxSleep {
+			warnf("%s of %v is longer than any plausible timeout (a typo?)", s.name, s.d)
+		}
+	}
+
+	method, _ := p.requestLine()
+	isProbe := p.idleProbeMax != 0 || p.idlePoolSize != 0 || p.tarpitBytes != 0 || p.closeCompare
+	if method == "" {
+		warnf("no request line")
+	} else if !isProbe {
+		var host, contentLength string
+		for _, h := range p.headers[1:] {
+			name, value, _ := strings.Cut(h.val, ":")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "host":
+				host = strings.TrimSpace(value)
+			case "content-length":
+				contentLength = strings.TrimSpace(value)
+			}
+		}
+		if host == "" {
+			warnf("no Host header, which HTTP/1.1 requires; most servers reject the request with a 400 before any timeout")
+		}
+		if contentLength != "" && !hasTemplate(contentLength) && !hasTemplate(p.body) {
+			if n, err := strconv.Atoi(contentLength); err != nil || n != len(p.body) {
+				warnf("Content-Length is %s but the body is %d bytes (BodyTrailingNewline and BodyEscapes change its length); the server will wait for more, or see the rest as another request", contentLength, len(p.body))
+			}
+		}
+	}
+
+	runtime, exact := p.minRuntime()
+	about := "at least "
+	if exact {
+		about = "about "
+	}
+	if runtime > lintMaxRuntime {
+		warnf("pacing will take %s%v to complete", about, runtime.Round(time.Minute))
+	}
+
+	if p.host != "" && !targetAllowed(p.host) {
+		switch {
+		case p.idleRaceAttempts > 0:
+			warnf("%s isn't local or in %s, so IdleRace's %d connections at once will be refused without -i-own-this-target", p.host, allowedTargetsEnv, p.idleRaceAttempts*len(idleRaceOffsets))
+		case runtime > lintMaxThirdPartyRuntime:
+			warnf("%s isn't local, and holding a connection to it for %s%v may be taken for an attack; make sure you're allowed to test it", p.host, about, runtime.Round(time.Minute))
+		case p.idlePoolSize > interlockMaxPool:
+			warnf("%s isn't local or in %s, so an IdlePool of %d connections will be refused without -i-own-this-target", p.host, allowedTargetsEnv, p.idlePoolSize)
+		case p.watch != 0 && p.watch < lintMinThirdPartyWatch:
+			warnf("%s isn't local, and probing it every %v may be taken for an attack; make sure you're allowed to test it", p.host, p.watch)
+		}
+	}
+	return warnings
+}
+
+// maxHeaderSleep is the longest sleep between header lines.
+func (p testParams) maxHeaderSleep() time.Duration {
+	var max time.Duration
+	for _, h := range p.headers {
+		if h.sleep > max {
+			max = h.sleep
+		}
+	}
+	return max
+}
+
+// minRuntime is the least time that sending the request (and reading the response,
+// if its length is limited) will take, from the sleeps. It's not exact if some sleeps
+// are multiples of the RTT, which isn't known yet, or if the response read is paced
+// without a limit.
+func (p testParams) minRuntime() (d time.Duration, exact bool) {
+	exact = p.perByteBodySleepRTTs == 0 && p.headerEndSleepRTTs == 0 && p.bodyStartSleepRTTs == 0 &&
+		p.perByteResponseReadSleepRTTs == 0
+	for _, h := range p.headers {
+		d += h.sleep
+		exact = exact && h.sleepRTTs == 0
+	}
+	d += p.headerEndSleep + p.bodyStartSleep
+	if len(p.body) > 1 {
+		d += time.Duration(len(p.body)-1) * p.perByteBodySleep
+	}
+	if p.perByteResponseReadSleep != 0 {
+		if p.maxResponseBytes != 0 && p.closeAtMaxResponseBytes {
+			d += time.Duration(p.maxResponseBytes-1) * p.perByteResponseReadSleep
+		} else {
+			exact = false
+		}
+	}
+	return d, exact
+}
+
+// isLocalHost is true if host (host:port) is this machine or on a private network,
+// which is presumably the user's own.
+func isLocalHost(host string) bool {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	if h == "localhost" || strings.HasSuffix(h, ".localhost") || strings.HasSuffix(h, ".local") ||
+		strings.HasSuffix(h, ".internal") || strings.HasSuffix(h, ".svc") || strings.Contains(h, ".svc.") {
+		return true
+	}
+	ip := net.ParseIP(h)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
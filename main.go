@@ -3,75 +3,303 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"regexp"
 	"strings"
 	"syscall"
 	"time"
 )
 
-type header struct {
-	val   string
-	sleep time.Duration
-}
-
-type testParams struct {
-	host string
-	// For automatic Content-Length header, exclude that header
-	headers          []header
-	body             string
-	perByteBodySleep time.Duration
-
-	// This doesn't work yet! There seems to be some read buffering happening internally
-	// and our one-byte-at-a-time slow reading isn't working.
-	perByteResponseReadSleep time.Duration
-}
-
 type conn struct {
 	c   net.Conn
 	sc  syscall.Conn
 	tcp *net.TCPConn
+
+	// raw is the TCP connection underneath TLS, if any
+	raw *eofTrackingConn
+	// tickets notes whether the server issued a TLS session ticket
+	tickets *ticketRecorder
+	// handshakeDuration is how long the TLS handshake took
+	handshakeDuration time.Duration
+	// tlsRefused is set if the server answered the TLS handshake with plaintext,
+	// and the connection fell back to it
+	tlsRefused bool
+
+	// connectTime is when the TCP connection was established
+	connectTime time.Time
+	// rtt is roughly the round trip time, measured as how long the TCP connect took
+	rtt time.Duration
+
+	firstWriteTime time.Time
+	lastWriteTime  time.Time
+	// maxWriteGap is the longest pause between two of our writes
+	maxWriteGap time.Duration
+	// bytesWritten is the number of request bytes written
+	bytesWritten int
+	// maxWriteTime is the longest a single write took
+	maxWriteTime time.Duration
+	// writeBlocked is the total time spent in writes that blocked because the server
+	// wasn't taking our data. The first of those started at firstStallTime, after
+	// firstStallOffset bytes had been written.
+	writeBlocked     time.Duration
+	firstStallTime   time.Time
+	firstStallOffset int
+	// requestSentTime is when the whole request was written; zero if it wasn't
+	requestSentTime time.Time
+	lastReadTime    time.Time
+	// readEndTime is when the error that ended reading was seen
+	readEndTime time.Time
+	// lastAliveTime is the last time the connection was known to be open
+	lastAliveTime time.Time
+	// closeUncertainty is how long before readEndTime the connection may really have
+	// ended, because we weren't watching it then
+	closeUncertainty time.Duration
+
+	// Response bytes (and any read error) that arrived while we were still writing
+	// the request. slowRead consumes these before reading from the connection.
+	early    []byte
+	earlyErr error
+	// writeErr is a write-side failure (like a reset) seen by watchWrite while we
+	// were sleeping between writes, at writeErrTime
+	writeErr     error
+	writeErrTime time.Time
+	// sleepSkipped is set when a keypress cut the last sleepWatchConn short
+	sleepSkipped bool
+
+	firstByteTime time.Time
+	// maxReadGap is the longest time between two response bytes
+	maxReadGap time.Duration
+
+	// response is the response bytes received, up to maxResponseBytes
+	response []byte
+	// responseLen is the number of response bytes received
+	responseLen int
+	// shownLen is the number of response bytes printed
+	shownLen int
+	// responseFile gets every response byte, if set
+	responseFile *responseSaver
+	// maxResponseBytes limits how much of the response is kept and shown, if non-zero
+	maxResponseBytes int
+	// arrivals are the most recent bursts of response bytes
+	arrivals []arrival
+	// traceRecords is set to note how the request's writes went out as TLS records
+	traceRecords bool
+	// writeStrategy is how writes are turned into syscalls; pending is what the
+	// buffered strategy is holding
+	writeStrategy string
+	pending       []byte
 }
 
+// errStopAfter stops the request from being sent at the point given by StopAfter.
+var errStopAfter = errors.New("stopped by StopAfter")
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: httptimeout <config-file.txt>")
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		runAudit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "demo" {
+		runDemo(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scenarios" {
+		runScenarios(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "heatmap" {
+		runHeatmap(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		runLint(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		runWizard(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "help" {
+		runHelp(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		runCompletion(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "__complete" {
+		runComplete(os.Args[2:])
 		return
 	}
 
-	params, err := readConfig(os.Args[1])
+	newMainFlagSet(flag.CommandLine)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: httptimeout [-explain] [-yes] [-i-own-this-target] <config-file.txt>")
+		fmt.Println("       httptimeout audit [flags] <host:port>")
+		fmt.Println("       httptimeout audit [flags] -inventory <file>")
+		fmt.Println("       httptimeout demo [flags]")
+		fmt.Println("       httptimeout heatmap [flags] <watch-history-file>")
+		fmt.Println("       httptimeout scenarios list|describe|show [name]")
+		fmt.Println("       httptimeout init [config-file.txt]")
+		fmt.Println("       httptimeout lint <config-file.txt>...")
+		fmt.Println("       httptimeout help [topic]")
+		return
+	}
+
+	params, err := readConfig(flag.Arg(0))
 	if err != nil {
 		panic(fmt.Sprintf("config read failed: %v", err))
 	}
+	if err := checkParamsAllowed(params); err != nil {
+		fmt.Println(red("not running:"), err)
+		os.Exit(1)
+	}
+	// Missing credentials would otherwise only show up once the request is about to
+	// be sent, after connecting and any baseline request
+	if _, _, err := params.signingKeys(); err != nil {
+		fmt.Println(red("not running:"), err)
+		os.Exit(1)
+	}
+	if params.resolver != "" {
+		if params, err = resolveHost(params, params.resolver); err != nil {
+			panic(err.Error())
+		}
+	}
+	if params.sshBastion != "" || params.k8sTarget != "" {
+		var t *tunnel
+		if params.sshBastion != "" {
+			params, t, err = startSSHTunnel(params, params.sshBastion)
+		} else {
+			params, t, err = startK8sTunnel(params, params.k8sTarget)
+		}
+		if err != nil {
+			panic(err.Error())
+		}
+		defer t.close()
+	}
+	confirmLongRun(params)
+	fmt.Println()
 
-	var conn conn
+	if params.watch != 0 {
+		runIdleWatch(params)
+		return
+	}
+	if params.idleProbeMax != 0 {
+		runIdleProbe(params)
+		return
+	}
+	if params.idlePoolSize != 0 {
+		runIdlePool(params)
+		return
+	}
+	if params.closeCompare {
+		runCloseCompare(params)
+		return
+	}
+	if params.tarpitBytes != 0 {
+		runTarpitProbe(params)
+		return
+	}
 
-	// Attempt TLS and then fall back to unencrypted
-	c, tlsErr := tls.Dial("tcp", params.host, &tls.Config{})
-	if tlsErr == nil {
-		conn.c = c
-		conn.sc = c.NetConn().(syscall.Conn)
-		conn.tcp = c.NetConn().(*net.TCPConn)
-		fmt.Println("TLS connection to", params.host)
-	} else if strings.Contains(tlsErr.Error(), "does not look like a TLS handshake") {
-		c, err := net.DialTimeout("tcp", params.host, 3*time.Second)
+	var base *baseline
+	if params.baseline {
+		b, err := runBaseline(params)
 		if err != nil {
-			panic(fmt.Sprintf("net.DialTimeout failed: %v", err))
+			panic(err.Error())
 		}
-		conn.c = c
-		conn.sc = c.(syscall.Conn)
-		conn.tcp = c.(*net.TCPConn)
-		fmt.Println("non-TLS connection to", params.host)
+		base = &b
+		fmt.Printf(cyan("baseline (the request at normal speed, on its own connection): connect RTT %v, first response byte after %v, headers after %v\n\n"),
+			b.rtt, b.ttfb, b.head)
+	}
+
+	keys = startKeys()
+	first := runRequest(params, base)
+	if params.retryEarlyFailure && first.diedEarly() {
+		fmt.Println()
+		fmt.Printf(yellow("the connection failed %v after it was made (%s); retrying once, since first connections can be anomalous\n\n"),
+			first.endedAfter.Round(time.Millisecond), first.ending())
+		second := runRequest(params, base)
+		fmt.Println()
+		compareAttempts(first, second)
+	}
+}
+
+// runRequest connects and sends the request, reading and reporting on the response.
+// base is the baseline run, if there was one.
+func runRequest(params testParams, base *baseline) attempt {
+	if params.preflight == "new" {
+		pc, err := dial(params)
+		if err != nil {
+			panic(err.Error())
+		}
+		fmt.Println("CORS preflight, on its own connection:")
+		if err := runPreflight(params, pc, false); err != nil {
+			fmt.Println(red(err.Error()))
+		}
+		pc.c.Close()
+		fmt.Println()
+	}
+
+	conn, err := dial(params)
+	if err != nil {
+		panic(err.Error())
+	}
+	if conn.raw != nil {
+		fmt.Println("TLS connection to", params.host)
+		printCertChain(conn)
+		printHandshakeDetails(conn)
 	} else {
-		panic(fmt.Sprintf("tls.Dial failed: %v", tlsErr))
+		fmt.Println("non-TLS connection to", params.host)
 	}
+	fmt.Println("connect RTT:", conn.rtt)
+	printMaxSegment(conn, params.maxSegment)
 	fmt.Println()
 
+	if params.preflight == "same" {
+		fmt.Println("CORS preflight, on this connection:")
+		if err := runPreflight(params, conn, true); err != nil {
+			panic(err.Error())
+		}
+		fmt.Println()
+	}
+
+	params = params.scaledToRTT(conn.rtt)
+
+	conn.maxResponseBytes = params.maxResponseBytes
+	conn.writeStrategy = params.writeStrategy
+	if params.writeStrategy != "" {
+		fmt.Printf("write strategy: %s\n\n", describeWriteStrategy(params.writeStrategy))
+	}
+	if params.traceRecords {
+		if conn.raw == nil {
+			fmt.Println(yellow("the connection isn't TLS, so TraceRecords has no records to trace"))
+			fmt.Println()
+		} else {
+			conn.traceRecords = true
+		}
+	}
+
+	if params.responseFile != "" {
+		saver, err := newResponseSaver(params.responseFile)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create response file: %v", err))
+		}
+		conn.responseFile = saver
+		defer func() {
+			if err := saver.Close(); err != nil {
+				fmt.Println(red("failed to write response file:"), err)
+			} else {
+				fmt.Println(cyan(saver.describe()))
+			}
+		}()
+	}
+
 	conn.tcp.SetNoDelay(true)
 	conn.tcp.SetReadBuffer(1)
 	conn.tcp.SetWriteBuffer(1)
@@ -79,266 +307,319 @@ func main() {
 	// Note that we could test the idle timeout by not closing the connection and sending keep-alives, but then
 	defer conn.c.Close()
 
-	startTime := time.Now()
-
-	gotContentLength := false
-	for _, h := range params.headers {
-		if h.sleep != 0 {
-			if err != nil {
-				fmt.Println("skipping sleep:", h.sleep)
-				continue
-			}
+	if keys != nil {
+		keys.resume()
+		defer keys.stop()
+		fmt.Println(keyHelp)
+		fmt.Println()
+	}
+	var baselineHead []byte
+	if base != nil {
+		baselineHead = base.responseHead
+	}
+	if params, err = params.expanded(baselineHead); err != nil {
+		panic(err.Error())
+	}
+	r := &run{params: params, conn: conn, eol: params.lineEnder()}
+	for _, st := range requestSteps(params) {
+		st.run(r)
+	}
+	startTime, headerTime, bodyTime, readErr := r.startTime, r.headerTime, r.bodyTime, r.readErr
 
-			fmt.Println(yellow("sleeping"), h.sleep)
-			if slept := sleepWatchConn(h.sleep, conn); slept < h.sleep {
-				fmt.Println(red("interrupted after"), slept)
-				err = fmt.Errorf("headers sleep interrupted")
-			}
+	if conn.firstByteTime.IsZero() {
+		fmt.Println(cyan("no response bytes received"))
+	} else if ttfb := conn.firstByteTime.Sub(bodyTime); ttfb < 0 {
+		fmt.Printf(cyan("first response byte arrived %v before the request was fully sent\n"), -ttfb)
+	} else {
+		if base != nil {
+			fmt.Printf(cyan("time to first response byte: %v (baseline %v)\n"), ttfb, base.ttfb)
 		} else {
-			if strings.HasPrefix(strings.ToLower(h.val), "content-length:") {
-				gotContentLength = true
-			}
-			err = write(err, conn.c, h.val+"\r\n")
+			fmt.Printf(cyan("time to first response byte: %v\n"), ttfb)
 		}
+		explain(explainTTFB)
 	}
-	if !gotContentLength {
-		line := fmt.Sprintf("Content-Length: %d", len(params.body))
-		err = write(err, conn.c, line+"\r\n")
-
+	if conn.shownLen < conn.responseLen {
+		fmt.Printf(cyan("received %d response bytes; only the first %d were shown\n"), conn.responseLen, conn.shownLen)
 	}
-	err = write(err, conn.c, "\r\n")
-
-	headerTime := time.Now()
-	fmt.Printf(cyan("time to send headers: %v\n\n"), headerTime.Sub(startTime))
-
-	if err == nil {
-		if !slowWrite(conn, params.perByteBodySleep, []byte(params.body)) {
-			fmt.Println(red("\nbody write interrupted"))
+	if !conn.lastReadTime.IsZero() {
+		fmt.Printf(cyan("time to read response bytes (first to last): %v\n"), conn.lastReadTime.Sub(conn.firstByteTime))
+		if params.perByteResponseReadSleep > 0 {
+			// Once the buffers are full, the server can only send as fast as we read
+			fmt.Printf(cyan("longest gap between response bytes: %v\n"), conn.maxReadGap)
 		}
-	} else {
-		fmt.Println("skipping body write")
 	}
+	printSocketState(conn, "end of response")
+	fmt.Println()
 
-	bodyTime := time.Now()
-	fmt.Printf(cyan("time to send body: %v\n\n"), bodyTime.Sub(headerTime))
-
-	// Attempt to read the response no matter if the writing was interrupted
-	ok, lastReadTime := slowRead(conn, params.perByteResponseReadSleep)
-	if !ok {
-		fmt.Println(red("response read interrupted"))
+	printCloseReport(conn, readErr)
+	method, _ := params.requestLine()
+	printPartialResponse(conn, method, readErr)
+	if params.lingerProbe != 0 && readErr == io.EOF {
+		printLingerClose(conn, params.lingerProbe)
 	}
-
-	fmt.Printf(cyan("time to read response bytes: %v\n"), lastReadTime.Sub(bodyTime))
-	fmt.Printf(cyan("time from last read until close/error (~idle timeout): %v\n"), time.Since(lastReadTime))
-}
-
-func red(s string) string {
-	return fmt.Sprintf("\033[91m%s\033[0m", s)
-}
-
-func yellow(s string) string {
-	return fmt.Sprintf("\033[93m%s\033[0m", s)
+	printClassification(conn, readErr)
+	printLineEndingReport(conn, readErr, params.lineEndings)
+	if method, _ := params.requestLine(); method == "HEAD" {
+		printHeadBodyCheck(conn)
+	}
+	printAltSvc(conn)
+	printSessionTicket(conn)
+	printInterception(params, conn)
+	printResponseTrailers(conn)
+	if params.serverEvents != "" {
+		fmt.Println()
+		printMergedTimeline(conn, readErr, params.serverEvents)
+	}
+	if params.statsd != "" {
+		sendRunMetrics(params, conn, startTime, headerTime, bodyTime)
+	}
+	return newAttempt(conn, r)
 }
 
-func cyan(s string) string {
-	return fmt.Sprintf("\033[96m%s\033[0m", s)
-}
+// requestSleep sleeps partway through sending the request, watching for the server
+// ending the connection, unless currErr shows the request was already interrupted.
+// topic is what to explain if the sleep is interrupted.
+func requestSleep(currErr error, conn *conn, sleep time.Duration, topic string) error {
+	if currErr != nil {
+		fmt.Println("skipping sleep:", sleep)
+		return currErr
+	}
 
-func sleepWatchConn(sleep time.Duration, conn conn) time.Duration {
-	increment := 100 * time.Millisecond
+	if keys.phaseAborted() {
+		fmt.Println("skipping sleep (phase aborted):", sleep)
+		return nil
+	}
 
-	start := time.Now()
-	for time.Since(start) < sleep {
-		time.Sleep(increment)
-		if err := connCheck(conn.sc); err != nil {
-			break
-		}
+	fmt.Println(timestamp(conn)+yellow("sleeping"), sleep)
+	slept := sleepWatchConn(sleep, conn, true)
+	if conn.sleepSkipped {
+		keyNote(conn, "sleep cut short after %v", slept.Round(time.Millisecond))
+		return nil
 	}
-	return time.Since(start)
+	if slept < sleep {
+		fmt.Println(timestamp(conn)+red("interrupted after"), slept)
+		explain(topic)
+		return fmt.Errorf("request sleep interrupted")
+	}
+	fmt.Println(timestamp(conn) + yellow("done sleeping"))
+	return nil
 }
 
-func slowWrite(conn conn, perByteSleep time.Duration, b []byte) bool {
-	for i := 0; i < len(b); i++ {
-		if i != 0 {
-			// If we try to use sleepWatchConn here it won't have the desired effect.
-			// sleepWatchConn checks if the read side of the connection is open, but we're
-			// writing. We might be able to write even if reading is broken and might not
-			// be able to write even if read is working.
-			time.Sleep(perByteSleep)
+// dialTCP connects to addr, resolving its host first so that rtt is the time the TCP
+// connect took: timing the whole Dial would add the DNS lookup, and any addresses
+// that failed before one answered. The addresses are tried in the resolver's order.
+func dialTCP(dialer *net.Dialer, addr string) (c net.Conn, rtt time.Duration, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
 		}
-
-		fmt.Print(string(b[i]))
-		n, err := conn.c.Write(b[i : i+1])
-		if err != nil || n != 1 {
-			return false
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.String())
 		}
 	}
-	fmt.Println()
-	return true
+	for _, ip := range ips {
+		start := time.Now()
+		if c, err = dialer.Dial("tcp", net.JoinHostPort(ip, port)); err == nil {
+			return c, time.Since(start), nil
+		}
+	}
+	return nil, 0, err
 }
 
-func slowRead(conn conn, perByteSleep time.Duration) (bool, time.Time) {
-	// Read HTTP readers will look at Content-Length or chunk size and know when they're
-	// done reading. But this is a dumb byte reader that will keep trying to read until
-	// the idle timeout forcibly kicks it off.
-
-	incoming := make(chan byte)
-	readErr := make(chan error)
-	go func() {
-		buf := make([]byte, 1)
-		first := true
-		for {
-			if !first {
-				sleepWatchConn(perByteSleep, conn)
-			}
-			first = false
-
-			_, err := conn.c.Read(buf)
-			if err != nil {
-				readErr <- err
-				return
-			}
+// dial connects to params.host, attempting TLS and then falling back to unencrypted.
+// If there's a pre-TLS exchange, it's made first and TLS is required.
+func dial(params testParams) (*conn, error) {
+	var conn conn
+	host, preTLS := params.host, params.preTLS
+	addr := host
+	if params.dialHost != "" {
+		addr = params.dialHost
+	}
 
-			incoming <- buf[0]
-		}
-	}()
-
-	var lastByteTime time.Time
-	var needNewline bool
-outer:
-	for {
-		select {
-		case err := <-readErr:
-			if err == io.EOF {
-				break outer
-			}
-			if needNewline {
-				fmt.Println()
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	if params.receiveBuffer > 0 || params.maxSegment > 0 {
+		dialer.Control = func(network, address string, rc syscall.RawConn) error {
+			if params.receiveBuffer > 0 {
+				if err := setReceiveBuffer(rc, params.receiveBuffer); err != nil {
+					return err
+				}
 			}
-			fmt.Println("read error:", err)
-			return false, time.Time{}
-		case b := <-incoming:
-			fmt.Print(string(b))
-			lastByteTime = time.Now()
-			needNewline = true
-		case <-time.After(10 * time.Second):
-			if needNewline {
-				fmt.Println()
+			if params.maxSegment > 0 {
+				if err := setMaxSegment(rc, params.maxSegment); err != nil {
+					return fmt.Errorf("failed to set TCP_MAXSEG to %d: %w", params.maxSegment, err)
+				}
 			}
-			needNewline = false
-			fmt.Println(yellow("10 seconds with no bytes read (waiting for idle timeout?)"))
+			return nil
 		}
 	}
-	fmt.Println()
 
-	return true, lastByteTime
-}
-
-func write(currErr error, w io.Writer, s string) error {
-	if currErr != nil {
-		fmt.Printf("skipping %q\n", s)
-		return currErr
+	if params.connPacer != nil {
+		params.connPacer.wait()
 	}
-
-	fmt.Print(s)
-	n, err := w.Write([]byte(s))
+	c, rtt, err := dialTCP(&dialer, addr)
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return nil, fmt.Errorf("dial failed: %w", err)
+	}
+	conn.connectTime = time.Now()
+	conn.rtt = rtt
+	serverName, _, _ := net.SplitHostPort(host)
+	if params.serverName != "" {
+		serverName = params.serverName
 	}
-	if n != len(s) {
-		err = fmt.Errorf("wrote wrong length: %d vs %d", n, len(s))
-		fmt.Println(err)
-		return err
+	// We track EOF on the raw connection so that we can tell whether the server sent
+	// a TLS close_notify before closing.
+	raw := &eofTrackingConn{Conn: c, capturing: true}
+	if len(preTLS) > 0 {
+		if err := preTLSExchange(c, preTLS); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("pre-TLS exchange failed: %w", err)
+		}
+	}
+	config, err := tlsConfig(params, serverName)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn.tickets = &ticketRecorder{}
+	config.ClientSessionCache = conn.tickets
+	tc := tls.Client(raw, config)
+	handshakeStart := time.Now()
+	tlsErr := tc.Handshake()
+	conn.handshakeDuration = time.Since(handshakeStart)
+	raw.capturing = false
+	if tlsErr == nil {
+		conn.c = tc
+		conn.raw = raw
+		conn.sc = c.(syscall.Conn)
+		conn.tcp = c.(*net.TCPConn)
+	} else if strings.Contains(tlsErr.Error(), "does not look like a TLS handshake") && (len(params.pins) > 0 || params.caCertFile != "") {
+		// Falling back would send the request, and any credentials in it, in the clear
+		c.Close()
+		return nil, fmt.Errorf("server answered the TLS handshake in plaintext, but TLS is required with Pin or CACert: %w", tlsErr)
+	} else if len(preTLS) == 0 && strings.Contains(tlsErr.Error(), "does not look like a TLS handshake") {
+		c.Close()
+		if params.connPacer != nil {
+			params.connPacer.wait()
+		}
+		c, rtt, err := dialTCP(&dialer, addr)
+		if err != nil {
+			return nil, fmt.Errorf("dial failed: %w", err)
+		}
+		conn.connectTime = time.Now()
+		conn.rtt = rtt
+		conn.c = c
+		conn.sc = c.(syscall.Conn)
+		conn.tcp = c.(*net.TCPConn)
+		conn.tlsRefused = true
+		conn.handshakeDuration = 0
+	} else {
+		c.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", tlsErr)
 	}
 
-	return nil
+	if params.onDial != nil {
+		params.onDial(&conn)
+	}
+	return &conn, nil
 }
 
-func readConfig(filename string) (testParams, error) {
-	// Open the file for reading
-	f, err := os.Open(filename)
+// printMaxSegment prints the connection's MSS, and what was asked for with MSS, if
+// anything. It prints nothing where the MSS can't be read.
+func printMaxSegment(conn *conn, asked int) {
+	mss, err := maxSegment(conn.sc)
 	if err != nil {
-		return testParams{}, fmt.Errorf("failed to open config file %q: %w", filename, err)
-	}
-	defer f.Close()
-
-	sleepRegexp := regexp.MustCompile(`^sleep (\S+)`)
-	perByteBodySleepRegexp := regexp.MustCompile(`^PerByteBodySleep:\s*(\S+)`)
-	perByteResponseReadSleepRegexp := regexp.MustCompile(`^PerByteResponseReadSleep:\s*(\S+)`)
-
-	var res testParams
-	phase := "host"
-
-	reader := bufio.NewReader(f)
-	for {
-		// Read the next line
-		line, isPrefix, err := reader.ReadLine()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return testParams{}, err
-		} else if isPrefix {
-			// TODO: read full
-			return testParams{}, fmt.Errorf("config line too long")
+		if asked > 0 {
+			fmt.Println(yellow(fmt.Sprintf("couldn't read the MSS (asked for %d): %v", asked, err)))
 		}
+		return
+	}
+	switch {
+	case asked == 0:
+		fmt.Println("MSS:", mss)
+	case mss == asked:
+		fmt.Printf("MSS: %d (as asked)\n", mss)
+	default:
+		// Linux has a floor, and the server's MSS or TCP options can take it lower
+		fmt.Printf("MSS: %d %s\n", mss, yellow(fmt.Sprintf("(asked for %d)", asked)))
+	}
+}
 
-		lineStr := string(line)
-
-		if lineStr == "" {
-			switch phase {
-			case "host":
-				phase = "headers"
-			case "headers":
-				phase = "byte-sleeps"
-			case "byte-sleeps":
-				phase = "body"
+// preTLSTimeout is how long to wait for each expected pre-TLS response.
+const preTLSTimeout = 10 * time.Second
+
+// preTLSExchange sends and reads the plaintext that comes before the TLS handshake
+// (like a STARTTLS command). Each expected response is read through to the end of
+// the line it appears on. Reads are a byte at a time so that nothing belonging to
+// the handshake is consumed.
+func preTLSExchange(c net.Conn, steps []preTLSStep) error {
+	defer c.SetReadDeadline(time.Time{})
+
+	for _, step := range steps {
+		if step.send != "" {
+			fmt.Printf("pre-TLS send: %q\n", step.send)
+			if _, err := c.Write([]byte(step.send)); err != nil {
+				return err
 			}
-			continue
 		}
-
-		if strings.HasPrefix(lineStr, "#") {
-			// comment
+		if step.expect == "" {
 			continue
 		}
 
-		switch phase {
-		case "host":
-			res.host = lineStr
-		case "headers":
-			if match := sleepRegexp.FindStringSubmatch(lineStr); match != nil {
-				sleep, err := time.ParseDuration(match[1])
-				if err != nil {
-					return testParams{}, fmt.Errorf("got bad header sleep in config: %q; %w", lineStr, err)
-				}
-				res.headers = append(res.headers, header{sleep: sleep})
-			} else {
-				res.headers = append(res.headers, header{val: lineStr})
-			}
-		case "byte-sleeps":
-			if match := perByteBodySleepRegexp.FindStringSubmatch(lineStr); match != nil {
-				sleep, err := time.ParseDuration(match[1])
-				if err != nil {
-					return testParams{}, fmt.Errorf("got bad PerByteBodySleep in config: %q; %w", lineStr, err)
-				}
-				res.perByteBodySleep = sleep
-			} else if match := perByteResponseReadSleepRegexp.FindStringSubmatch(lineStr); match != nil {
-				sleep, err := time.ParseDuration(match[1])
-				if err != nil {
-					return testParams{}, fmt.Errorf("got bad PerByteResponseReadSleep in config: %q; %w", lineStr, err)
-				}
-				res.perByteResponseReadSleep = sleep
-			} else {
-				return testParams{}, fmt.Errorf("got unexpected byte-sleep: %q", lineStr)
-			}
-
-		case "body":
-			if res.body != "" {
-				res.body += "\n"
+		c.SetReadDeadline(time.Now().Add(preTLSTimeout))
+		var got []byte
+		var buf [1]byte
+		for !strings.Contains(string(got), step.expect) || got[len(got)-1] != '\n' {
+			if _, err := c.Read(buf[:]); err != nil {
+				return fmt.Errorf("waiting for %q, got %q: %w", step.expect, got, err)
 			}
-			res.body += lineStr
+			got = append(got, buf[0])
 		}
+		fmt.Printf("pre-TLS received: %q\n", got)
 	}
+	return nil
+}
 
-	return res, nil
+// eofTrackingConn records whether a read from the wrapped connection returned EOF.
+// While capturing is set, it also keeps what's read in handshake, and the first
+// write in clientHello, for printHandshakeDetails.
+type eofTrackingConn struct {
+	net.Conn
+	sawEOF    bool
+	capturing bool
+	handshake []byte
+	// clientHello is our first write, captured along with handshake
+	clientHello []byte
+	// written counts the TLS records written after the handshake
+	written recordMark
+}
+
+func (c *eofTrackingConn) Write(b []byte) (int, error) {
+	if c.capturing && c.clientHello == nil {
+		c.clientHello = append([]byte(nil), b...)
+	}
+	n, err := c.Conn.Write(b)
+	if !c.capturing {
+		c.countRecords(b[:n])
+	}
+	return n, err
+}
+
+func (c *eofTrackingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == io.EOF {
+		c.sawEOF = true
+	}
+	if c.capturing && len(c.handshake) < maxHandshakeCapture {
+		c.handshake = append(c.handshake, b[:n]...)
+	}
+	return n, err
 }
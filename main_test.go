@@ -0,0 +1,37 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	dialer := net.Dialer{Timeout: time.Second}
+	// By name, so that there's a lookup for the RTT to leave out; if localhost is ::1
+	// first, that's refused and 127.0.0.1 tried next
+	c, rtt, err := dialTCP(&dialer, net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if rtt <= 0 || rtt > time.Second {
+		t.Errorf("rtt = %v", rtt)
+	}
+	if got := c.RemoteAddr().String(); got != l.Addr().String() {
+		t.Errorf("connected to %s; want %s", got, l.Addr())
+	}
+
+	if _, _, err := dialTCP(&dialer, "localhost"); err == nil {
+		t.Errorf("address without a port accepted")
+	}
+}
@@ -0,0 +1,179 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportSchemaVersion is the version of the structured output: the AdviceFile JSON
+// and the properties added to SARIF. Adding a field doesn't change it, so consumers
+// must ignore fields they don't know. Removing, renaming, or changing the meaning of
+// a field does, and schema/advice.schema.json must be updated to match.
+const reportSchemaVersion = 1
+
+// runMetadata describes the run that produced a structured report, so that results
+// shared later can be reproduced and compared.
+type runMetadata struct {
+	ToolVersion string    `json:"toolVersion"`
+	GoVersion   string    `json:"goVersion"`
+	OS          string    `json:"os"`
+	StartedAt   time.Time `json:"startedAt"`
+	// Settings are the effective settings of the run, defaults included
+	Settings map[string]string `json:"settings"`
+	// Connection is the first connection made, for reports about a single target
+	Connection *connMetadata `json:"connection,omitempty"`
+}
+
+// connMetadata describes a connection to the target.
+type connMetadata struct {
+	LocalAddress  string       `json:"localAddress"`
+	RemoteAddress string       `json:"remoteAddress"`
+	TLS           *tlsMetadata `json:"tls,omitempty"`
+}
+
+// tlsMetadata is what was negotiated in a TLS handshake.
+type tlsMetadata struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	ServerName  string `json:"serverName"`
+	ALPN        string `json:"alpn,omitempty"`
+	// Certificates is the chain the server presented, leaf first
+	Certificates []certMetadata `json:"certificates,omitempty"`
+	OCSPStapled  bool           `json:"ocspStapled"`
+	SCTs         int            `json:"scts"`
+	// JA3 is the fingerprint of our ClientHello
+	JA3 string `json:"ja3,omitempty"`
+	// ServerHelloExtensions are the extensions in the ServerHello, in order
+	ServerHelloExtensions []string `json:"serverHelloExtensions,omitempty"`
+}
+
+// runStartTime is when the tool started.
+var runStartTime = time.Now()
+
+// newRunMetadata makes the metadata for this run, with the given effective settings.
+func newRunMetadata(settings map[string]string) *runMetadata {
+	return &runMetadata{
+		ToolVersion: toolVersion(),
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS + "/" + runtime.GOARCH,
+		StartedAt:   runStartTime,
+		Settings:    settings,
+	}
+}
+
+// toolVersion is the module version the tool was built from, with the VCS revision
+// if it was built from a checkout.
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "+dirty"
+			}
+		}
+	}
+	if revision != "" {
+		version += " " + revision + modified
+	}
+	return version
+}
+
+// tlsVersionNames names the TLS versions that tls.Config can negotiate.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// describeConn captures the addresses and any TLS details of conn.
+func describeConn(conn *conn) *connMetadata {
+	m := &connMetadata{
+		LocalAddress:  conn.c.LocalAddr().String(),
+		RemoteAddress: conn.c.RemoteAddr().String(),
+	}
+	if tc, ok := conn.c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		version, ok := tlsVersionNames[state.Version]
+		if !ok {
+			version = fmt.Sprintf("0x%04x", state.Version)
+		}
+		m.TLS = &tlsMetadata{
+			Version:     version,
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ServerName:  state.ServerName,
+			ALPN:        state.NegotiatedProtocol,
+
+			Certificates: describeCerts(state.PeerCertificates),
+			OCSPStapled:  len(state.OCSPResponse) > 0,
+			SCTs:         len(state.SignedCertificateTimestamps),
+		}
+		m.TLS.JA3, _, _ = ja3(conn.raw.clientHello)
+		if hello, err := parseServerHello(conn.raw.handshake); err == nil {
+			m.TLS.ServerHelloExtensions = hello.extensions
+		}
+	}
+	return m
+}
+
+// firstConnRecorder keeps the metadata of the first connection it's given. Its record
+// method is for testParams.onDial, which may be called from several probes at once.
+type firstConnRecorder struct {
+	once sync.Once
+	meta *connMetadata
+}
+
+func (r *firstConnRecorder) record(conn *conn) {
+	r.once.Do(func() { r.meta = describeConn(conn) })
+}
+
+// settings lists the effective settings of p that change what's sent or measured.
+// Settings that aren't in use are left out.
+func (p testParams) settings() map[string]string {
+	s := map[string]string{"host": p.host}
+	add := func(key string, set bool, value interface{}) {
+		if set {
+			s[key] = fmt.Sprint(value)
+		}
+	}
+	add("serverName", p.serverName != "", p.serverName)
+	add("resolver", p.resolver != "", p.resolver)
+	add("dialHost", p.dialHost != "", p.dialHost)
+	add("clientHello", p.clientHello != "", p.clientHello)
+	add("caCert", p.caCertFile != "", p.caCertFile)
+	add("pin", len(p.pins) > 0, strings.Join(p.pins, " "))
+	add("request", len(p.headers) > 0, fastRequest(p))
+	add("perByteBodySleep", p.perByteBodySleep != 0, p.perByteBodySleep)
+	add("headerEndSleep", p.headerEndSleep != 0, p.headerEndSleep)
+	add("bodyStartSleep", p.bodyStartSleep != 0, p.bodyStartSleep)
+	add("lineEndings", p.lineEndings != "", p.lineEndings)
+	add("perByteResponseReadSleep", p.perByteResponseReadSleep != 0, p.perByteResponseReadSleep)
+	add("receiveBuffer", p.receiveBuffer != 0, p.receiveBuffer)
+	add("maxSegment", p.maxSegment != 0, p.maxSegment)
+	add("stopAfter", p.stopAfter != "", p.stopAfter)
+	add("retryEarlyFailure", p.retryEarlyFailure, true)
+	add("preflight", p.preflight != "", p.preflight)
+	add("traceRecords", p.traceRecords, true)
+	add("writeStrategy", p.writeStrategy != "", p.writeStrategy)
+	add("idleProbe", p.idleProbeMax != 0, fmt.Sprintf("%v %v", p.idleProbeMin, p.idleProbeMax))
+	add("idleRace", p.idleRaceAttempts != 0, p.idleRaceAttempts)
+	add("idlePool", p.idlePoolSize != 0, fmt.Sprintf("%d %v", p.idlePoolSize, p.idlePoolReport))
+	add("hmac", p.hmacHeader != "", p.hmacHeader)
+	add("sigV4", p.sigV4Region != "", fmt.Sprintf("%s %s", p.sigV4Region, p.sigV4Service))
+	return s
+}
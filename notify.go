@@ -0,0 +1,108 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notifyTimeout is how long to wait for a notification sink to accept a post.
+const notifyTimeout = 10 * time.Second
+
+// notification is a summary of results that need someone's attention, like an
+// audit's unmet expectations or a change seen by Watch. It's posted as is to a
+// generic webhook.
+type notification struct {
+	// Source is what produced it: "audit" or "watch"
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	// Text is a one-line summary, and Details has a line for each problem
+	Text    string   `json:"text"`
+	Details []string `json:"details,omitempty"`
+}
+
+// slackMessage is the payload for a Slack (or compatible) incoming webhook.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// notify posts n to each sink, which is a webhook URL, or "slack:" followed by the URL
+// of a Slack-compatible incoming webhook. Failures are printed rather than returned,
+// since they shouldn't stop whatever is being notified about.
+func notify(sinks []string, n notification) {
+	for _, sink := range sinks {
+		if err := postNotification(sink, n); err != nil {
+			fmt.Println(red("notification failed:"), err)
+		}
+	}
+}
+
+func postNotification(sink string, n notification) error {
+	var payload interface{} = n
+	url := sink
+	if strings.HasPrefix(sink, "slack:") {
+		url = strings.TrimPrefix(sink, "slack:")
+		text := n.Text
+		for _, d := range n.Details {
+			text += "\n• " + d
+		}
+		payload = slackMessage{Text: text}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// validNotifySink returns an error if sink isn't a webhook URL, with or without the
+// "slack:" prefix.
+func validNotifySink(sink string) error {
+	url := strings.TrimPrefix(sink, "slack:")
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("notification sink %q isn't a URL (optionally prefixed with slack:)", sink)
+	}
+	return nil
+}
+
+// auditNotification summarizes the findings that didn't meet their expectations, if
+// any did not.
+func auditNotification(results []auditResult) (notification, bool) {
+	n := notification{Source: "audit", Time: time.Now()}
+	for _, r := range results {
+		for _, f := range r.findings {
+			if !f.hasExpected || f.metExpected {
+				continue
+			}
+			want := "no timeout"
+			if f.expected != 0 {
+				want = f.expected.String()
+			}
+			target := r.target
+			if len(r.tags) > 0 {
+				target += " [" + formatTags(r.tags) + "]"
+			}
+			n.Details = append(n.Details, fmt.Sprintf("%s %s: %s (expected %s)", target, f.probe, f.outcome, want))
+		}
+	}
+	if len(n.Details) == 0 {
+		return n, false
+	}
+	n.Text = fmt.Sprintf("httptimeout audit: %d finding(s) didn't meet expectations", len(n.Details))
+	return n, true
+}
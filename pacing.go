@@ -0,0 +1,489 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// sleepWatchConn sleeps, stopping early if the connection is closed. If drain is
+// true, anything the server sends during the sleep is read and printed immediately
+// (otherwise it's left for a later read). In an interactive run, keypresses can cut
+// the sleep short (setting conn.sleepSkipped) or extend it.
+func sleepWatchConn(sleep time.Duration, conn *conn, drain bool) time.Duration {
+	increment := 100 * time.Millisecond
+
+	orig := sleep
+	conn.sleepSkipped = false
+	start := time.Now()
+	for time.Since(start) < sleep {
+		time.Sleep(increment)
+		readable, err := connCheck(conn.sc)
+		if err == nil && !readable {
+			// Buffered data could hide a close, so only an empty check shows we're open
+			conn.lastAliveTime = time.Now()
+		}
+		if drain && (readable || err != nil) {
+			// If the server is about to close on us, it may have sent an explanation
+			// first (like a 408). The close also can't be seen until that is read.
+			drainResponse(conn, increment)
+			if conn.earlyErr != nil {
+				break
+			}
+		} else if err != nil {
+			break
+		}
+
+		if keys.takeSkip() || keys.phaseAborted() {
+			conn.sleepSkipped = true
+			break
+		}
+		if !keys.inResponse() {
+			if n := keys.takeExtend(); n > 0 {
+				sleep += time.Duration(n) * orig
+				keyNote(conn, "sleep extended to %v", sleep)
+			}
+		}
+	}
+	return time.Since(start)
+}
+
+func slowWrite(conn *conn, perByteSleep time.Duration, b []byte) bool {
+	// One line per byte would break up the body, so the records and the buffered
+	// writes are summed up
+	var before recordMark
+	if conn.traceRecords {
+		before = conn.raw.written
+	}
+	written, writes := conn.bytesWritten, 0
+	defer func() {
+		n := conn.bytesWritten - written
+		if n > 0 && conn.writeStrategy == writeBuffered {
+			fmt.Println(timestamp(conn) + cyan(fmt.Sprintf("(sent %d body bytes in %d buffered writes)", n, writes)))
+		}
+		if n > 0 && conn.traceRecords {
+			fmt.Println(timestamp(conn) + cyan(describeRecords(conn, before, n, writes)))
+		}
+	}()
+	// There's a sleep between paced bytes, so each goes out on its own whatever the
+	// strategy; unpaced bytes are left for flushWrites
+	sendBuffered := func() bool {
+		if perByteSleep > 0 && conn.writeStrategy == writeCork {
+			if err := flushWrites(nil, conn, false); err != nil {
+				fmt.Println()
+				fmt.Println(red(err.Error()))
+				return false
+			}
+		}
+		if perByteSleep == 0 || len(conn.pending) == 0 {
+			return true
+		}
+		writes++
+		_, blocked, err := sendPending(conn)
+		if err != nil {
+			fmt.Println()
+			fmt.Println(err)
+			return false
+		}
+		if blocked > 0 {
+			fmt.Print(yellow(fmt.Sprintf(" [write blocked %v] ", blocked.Round(time.Millisecond))))
+		}
+		return true
+	}
+	for i := 0; i < len(b); i++ {
+		if i != 0 && !sendBuffered() {
+			return false
+		}
+		if i != 0 {
+			// If we try to use sleepWatchConn here it won't have the desired effect.
+			// sleepWatchConn checks if the read side of the connection is open, but we're
+			// writing. We might be able to write even if reading is broken and might not
+			// be able to write even if read is working.
+			// We do wait on a read, though, so that we notice a response that starts
+			// before we've finished sending the body. Once reading has ended, that
+			// wait watches for a write-side failure instead (see watchWrite).
+			waitBetweenWrites(conn, perByteSleep)
+			if conn.writeErr != nil {
+				fmt.Println()
+				fmt.Println(timestamp(conn) + red(fmt.Sprintf("connection failed for writes %v into the sleep, after %d request bytes: %v",
+					conn.writeErrTime.Sub(conn.lastWriteTime).Round(time.Millisecond), conn.bytesWritten, conn.writeErr)))
+				return false
+			}
+		}
+
+		if perByteSleep > 0 && keys.phaseAborted() {
+			fmt.Println()
+			keyNote(conn, "body pacing aborted; sending the remaining %d bytes at once", len(b)-i)
+			perByteSleep = 0
+		}
+
+		fmt.Print(string(b[i]))
+		if conn.writeStrategy == writeBuffered {
+			conn.pending = append(conn.pending, b[i])
+			continue
+		}
+		writes++
+		start := time.Now()
+		n, err := conn.c.Write(b[i : i+1])
+		if n > 0 {
+			if took, blocked := recordWrite(conn, start, time.Now(), n); blocked {
+				fmt.Print(yellow(fmt.Sprintf(" [write blocked %v] ", took.Round(time.Millisecond))))
+			}
+		}
+		if err != nil || n != 1 {
+			return false
+		}
+	}
+	if !sendBuffered() {
+		return false
+	}
+	fmt.Println()
+	return true
+}
+
+// waitBetweenWrites waits d between paced writes, reading any response bytes that
+// arrive (see readDuring). In an interactive run it checks for keypresses as it goes.
+func waitBetweenWrites(conn *conn, d time.Duration) {
+	if keys == nil {
+		readDuring(conn, d)
+		return
+	}
+	orig := d
+	start := time.Now()
+	for time.Since(start) < d && conn.writeErr == nil {
+		if keys.takeSkip() || keys.phaseAborted() {
+			return
+		}
+		if n := keys.takeExtend(); n > 0 {
+			d += time.Duration(n) * orig
+			keyNote(conn, "this byte's sleep extended to %v", d)
+		}
+		wait := d - time.Since(start)
+		if wait > keyPollInterval {
+			wait = keyPollInterval
+		}
+		readDuring(conn, wait)
+	}
+}
+
+// readEndPrecision is how quickly a read must fail for the connection to be considered
+// to have already ended before the read started.
+const readEndPrecision = time.Millisecond
+
+// readByte reads a single response byte, giving up at deadline. Read times are
+// recorded on conn.
+func readByte(conn *conn, deadline time.Time) (byte, error) {
+	var buf [1]byte
+	conn.c.SetReadDeadline(deadline)
+	start := time.Now()
+	_, err := conn.c.Read(buf[:])
+	now := time.Now()
+	if err != nil {
+		if isTimeout(err) {
+			conn.lastAliveTime = now
+		} else if conn.readEndTime.IsZero() {
+			conn.readEndTime = now
+			// If the read waited, the end arrived while we were watching. Otherwise it
+			// happened at some point since the connection was last known to be open.
+			if now.Sub(start) < readEndPrecision {
+				alive := conn.lastAliveTime
+				if alive.IsZero() {
+					alive = conn.connectTime
+				}
+				conn.closeUncertainty = now.Sub(alive)
+			}
+		}
+		return 0, err
+	}
+
+	if conn.firstByteTime.IsZero() {
+		conn.firstByteTime = now
+	} else if gap := now.Sub(conn.lastReadTime); gap > conn.maxReadGap {
+		conn.maxReadGap = gap
+	}
+	conn.lastReadTime = now
+	waited := now.Sub(start) >= readEndPrecision
+	if waited {
+		// The read waited for this byte, so nothing (including a close) was buffered
+		conn.lastAliveTime = now
+	}
+	recordArrival(conn, conn.responseLen, now, waited)
+	conn.responseLen++
+	if conn.responseFile != nil {
+		conn.responseFile.WriteByte(buf[0])
+	}
+	if conn.maxResponseBytes == 0 || len(conn.response) < conn.maxResponseBytes {
+		conn.response = append(conn.response, buf[0])
+	}
+	return buf[0], nil
+}
+
+// writeStallMin is how long a write must take to count as blocked. With our send
+// buffer nearly full it's normal to wait for an ACK, which takes about an RTT, so it
+// must also take at least two of those.
+const writeStallMin = 100 * time.Millisecond
+
+// recordWrite notes that a write of n bytes to conn started at start and finished at
+// now, and returns how long it took and whether it blocked.
+func recordWrite(conn *conn, start, now time.Time, n int) (took time.Duration, blocked bool) {
+	took = now.Sub(start)
+	if took > conn.maxWriteTime {
+		conn.maxWriteTime = took
+	}
+	blocked = took >= writeStallMin && took >= 2*conn.rtt
+	if blocked {
+		conn.writeBlocked += took
+		if conn.firstStallTime.IsZero() {
+			conn.firstStallTime, conn.firstStallOffset = start, conn.bytesWritten
+		}
+	}
+	conn.bytesWritten += n
+
+	if conn.firstWriteTime.IsZero() {
+		conn.firstWriteTime = now
+	} else if gap := now.Sub(conn.lastWriteTime); gap > conn.maxWriteGap {
+		conn.maxWriteGap = gap
+	}
+	conn.lastWriteTime = now
+	return took, blocked
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// readDuring waits for d while reading any response bytes that arrive, stashing
+// them for slowRead.
+func readDuring(conn *conn, d time.Duration) {
+	deadline := time.Now().Add(d)
+	if conn.earlyErr != nil {
+		watchWrite(conn, deadline)
+		return
+	}
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	for {
+		b, err := readByte(conn, deadline)
+		if err != nil {
+			if !isTimeout(err) {
+				conn.earlyErr = err
+				watchWrite(conn, deadline)
+			}
+			return
+		}
+		conn.early = append(conn.early, b)
+	}
+}
+
+// writeCheckInterval is how often watchWrite checks the connection.
+const writeCheckInterval = 100 * time.Millisecond
+
+// watchWrite waits until deadline, checking for the connection failing for writes.
+// It's used once reading has ended (like after the server's FIN), when a reset would
+// otherwise go unnoticed until our next write. A failure is recorded in
+// conn.writeErr, and the wait ends early.
+func watchWrite(conn *conn, deadline time.Time) {
+	for conn.writeErr == nil {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return
+		}
+		if wait > writeCheckInterval {
+			wait = writeCheckInterval
+		}
+		time.Sleep(wait)
+		if err := writeCheck(conn.sc); err != nil {
+			conn.writeErr, conn.writeErrTime = err, time.Now()
+		}
+	}
+}
+
+// drainResponse reads and prints whatever the server has sent, until the connection
+// ends or nothing arrives for quiet.
+func drainResponse(conn *conn, quiet time.Duration) {
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	if len(conn.early) > 0 {
+		printResponse(conn, conn.early)
+		conn.early = nil
+	}
+
+	var printed bool
+	for conn.earlyErr == nil {
+		b, err := readByte(conn, time.Now().Add(quiet))
+		if err != nil {
+			if !isTimeout(err) {
+				conn.earlyErr = err
+			}
+			break
+		}
+		printed = printResponse(conn, []byte{b}) || printed
+	}
+	if printed {
+		fmt.Println()
+	}
+}
+
+// printResponse prints response bytes, stopping once maxResponseBytes have been shown.
+// It returns true if anything was printed.
+func printResponse(conn *conn, b []byte) bool {
+	if conn.maxResponseBytes > 0 {
+		room := conn.maxResponseBytes - conn.shownLen
+		if room <= 0 {
+			return false
+		}
+		if len(b) > room {
+			b = b[:room]
+		}
+	}
+	fmt.Print(string(b))
+	conn.shownLen += len(b)
+	if conn.shownLen == conn.maxResponseBytes {
+		fmt.Print("\n" + yellow("(MaxResponseBytes reached; not showing more)"))
+	}
+	return len(b) > 0
+}
+
+// noDataReportInterval is how often slowRead reports that nothing has arrived.
+const noDataReportInterval = 10 * time.Second
+
+// slowRead reads and prints the response until the connection ends, returning the
+// error that ended it (io.EOF for a clean close). If stopAt is non-zero, it instead
+// stops with a nil error once that many response bytes have been read, as it does if
+// the user aborts the read with a keypress.
+func slowRead(conn *conn, perByteSleep time.Duration, stopAt int) error {
+	// Read HTTP readers will look at Content-Length or chunk size and know when they're
+	// done reading. But this is a dumb byte reader that will keep trying to read until
+	// the idle timeout forcibly kicks it off.
+
+	// Reads are done with a deadline rather than blocking in a goroutine, so that we
+	// can report silence without leaking a reader that is stuck in Read forever.
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	readStart := time.Now()
+	var needNewline bool
+
+	if len(conn.early) > 0 {
+		needNewline = printResponse(conn, conn.early)
+		conn.early = nil
+	}
+	if conn.earlyErr != nil {
+		if needNewline {
+			fmt.Println()
+		}
+		if conn.earlyErr != io.EOF {
+			fmt.Println("read error:", conn.earlyErr)
+		}
+		return conn.earlyErr
+	}
+
+	// Reads wait briefly in an interactive run, to notice keypresses, but silence is
+	// still only reported every noDataReportInterval
+	readWait := noDataReportInterval
+	if keys != nil {
+		readWait = keyPollInterval
+	}
+	lastReport := readStart
+
+	first := true
+	for {
+		if keys.phaseAborted() {
+			if needNewline {
+				fmt.Println()
+			}
+			keyNote(conn, "response read aborted")
+			return nil
+		}
+		if keys.takeExtend() > 0 && stopAt > 0 {
+			if needNewline {
+				fmt.Println()
+			}
+			needNewline = false
+			keyNote(conn, "reading on until the server closes the connection")
+			stopAt = 0
+		}
+		if stopAt > 0 && conn.responseLen >= stopAt {
+			fmt.Println()
+			return nil
+		}
+		if !first && perByteSleep > 0 {
+			sleepWatchConn(perByteSleep, conn, false)
+		}
+		first = false
+
+		b, err := readByte(conn, time.Now().Add(readWait))
+		if err != nil {
+			if isTimeout(err) {
+				since := readStart
+				if !conn.lastReadTime.IsZero() && conn.lastReadTime.After(since) {
+					since = conn.lastReadTime
+				}
+				if time.Since(since) < noDataReportInterval || time.Since(lastReport) < noDataReportInterval {
+					continue
+				}
+				lastReport = time.Now()
+				if needNewline {
+					fmt.Println()
+				}
+				needNewline = false
+				fmt.Println(yellow(fmt.Sprintf("no bytes read for %v (waiting for idle timeout?)", time.Since(since).Round(time.Millisecond))))
+				continue
+			}
+			if err == io.EOF {
+				break
+			}
+			if needNewline {
+				fmt.Println()
+			}
+			fmt.Println("read error:", err)
+			return err
+		}
+
+		needNewline = printResponse(conn, []byte{b}) || needNewline
+	}
+	fmt.Println()
+
+	return io.EOF
+}
+
+func write(currErr error, conn *conn, s string) error {
+	if currErr != nil {
+		fmt.Printf("skipping %q\n", s)
+		return currErr
+	}
+
+	fmt.Print(timestamp(conn), s)
+	if conn.writeStrategy == writeBuffered {
+		conn.pending = append(conn.pending, s...)
+		return nil
+	}
+	var before recordMark
+	if conn.traceRecords {
+		before = conn.raw.written
+	}
+	start := time.Now()
+	n, err := conn.c.Write([]byte(s))
+	if n > 0 {
+		if took, blocked := recordWrite(conn, start, time.Now(), n); blocked {
+			fmt.Println(yellow(fmt.Sprintf("(write blocked %v)", took.Round(time.Millisecond))))
+		}
+		if conn.traceRecords {
+			fmt.Println(timestamp(conn) + cyan(describeRecords(conn, before, n, 1)))
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if n != len(s) {
+		err = fmt.Errorf("wrote wrong length: %d vs %d", n, len(s))
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
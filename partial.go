@@ -0,0 +1,272 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxArrivals is how many bursts of response bytes are remembered, most recent
+	// first out, for relating offsets in the response to when they arrived
+	maxArrivals = 64
+	// partialTailBytes is how much of the end of a cut-off response is dumped in hex
+	partialTailBytes = 64
+	// partialArrivalsShown is how many of the last bursts of a cut-off response are
+	// listed
+	partialArrivalsShown = 5
+)
+
+// arrival is a burst of response bytes: ones that arrived together, after a read
+// that had to wait for them.
+type arrival struct {
+	offset int
+	at     time.Time
+}
+
+// recordArrival notes that the response byte at offset arrived at now. waited is
+// true if the read had to wait for it, which starts a new burst.
+func recordArrival(conn *conn, offset int, now time.Time, waited bool) {
+	if len(conn.arrivals) > 0 && !waited {
+		return
+	}
+	if len(conn.arrivals) == maxArrivals {
+		conn.arrivals = append(conn.arrivals[:0], conn.arrivals[1:]...)
+	}
+	conn.arrivals = append(conn.arrivals, arrival{offset: offset, at: now})
+}
+
+// partialResponse is how much of a response arrived, by its framing.
+type partialResponse struct {
+	// statusLine is the status line, if it arrived whole
+	statusLine string
+	// headEnd is the offset of the body, or -1 if the head didn't arrive whole
+	headEnd int
+	// headerLines is the number of whole header lines received
+	headerLines int
+	// cutLine is the start of the line the response was cut off in, in the head
+	cutLine string
+	// contentLength is the Content-Length, or -1 if there wasn't one
+	contentLength int64
+	// chunked is set for a chunked body; chunks is the number of whole chunks
+	// received, and the chunk it was cut off in had chunkGot of chunkSize bytes
+	chunked             bool
+	chunks              int
+	chunkGot, chunkSize int64
+	// inChunkSize is set if it was cut off in a chunk size line, and inTrailers if
+	// it was cut off after the last chunk
+	inChunkSize, inTrailers bool
+	complete                bool
+	// interim is the number of interim (1xx) responses before this one
+	interim int
+}
+
+// parsePartialResponse works out whether resp, the response to a method request, is
+// a whole response, going by its framing, and if not, where it was cut off. Interim
+// responses, like 100 Continue, are skipped over, and the final one judged. A body
+// without a Content-Length or chunking runs until the connection ends, so it's
+// always whole, and a response to HEAD has no body whatever its headers say.
+func parsePartialResponse(resp []byte, method string) partialResponse {
+	start := 0
+	for interim := 0; ; interim++ {
+		res := parseResponseAt(resp, start, method)
+		res.interim = interim
+		// After a 101, the connection isn't speaking HTTP any more
+		if res.headEnd < 0 || !strings.HasPrefix(res.status(), "1") || res.status() == "101" {
+			return res
+		}
+		start = res.headEnd
+	}
+}
+
+// status is the response's status code, if its status line arrived.
+func (res partialResponse) status() string {
+	return responseStatus([]byte(res.statusLine))
+}
+
+// parseResponseAt parses the response that starts at offset start in resp. Offsets
+// in the result are from the start of resp.
+func parseResponseAt(resp []byte, start int, method string) partialResponse {
+	res := partialResponse{headEnd: -1, contentLength: -1}
+	head := resp[start:]
+	if end := bytes.Index(head, []byte("\r\n\r\n")); end >= 0 {
+		res.headEnd = start + end + 4
+		head = head[:end+2]
+	}
+	lines := strings.Split(string(head), "\r\n")
+	// The last element is what's after the last CRLF: empty, or a cut-off line
+	if res.headEnd < 0 {
+		res.cutLine = lines[len(lines)-1]
+	}
+	lines = lines[:len(lines)-1]
+	if len(lines) == 0 {
+		return res
+	}
+	res.statusLine = lines[0]
+	res.headerLines = len(lines) - 1
+	if res.headEnd < 0 {
+		return res
+	}
+
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "content-length":
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				res.contentLength = n
+			}
+		case "transfer-encoding":
+			res.chunked = strings.Contains(strings.ToLower(value), "chunked")
+		}
+	}
+	status := res.status()
+	body := resp[res.headEnd:]
+	switch {
+	case strings.HasPrefix(status, "1") || status == "204" || status == "304" || strings.EqualFold(method, "HEAD"):
+		res.complete = true
+	case res.chunked:
+		res.parseChunks(body)
+	case res.contentLength >= 0:
+		res.complete = int64(len(body)) >= res.contentLength
+	default:
+		res.complete = true
+	}
+	return res
+}
+
+// parseChunks works through a chunked body, noting where it was cut off.
+func (res *partialResponse) parseChunks(body []byte) {
+	for {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			res.inChunkSize = true
+			return
+		}
+		sizeStr, _, _ := strings.Cut(string(body[:i]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			// Not chunked after all, so there's no telling where it should end
+			res.complete = true
+			return
+		}
+		body = body[i+2:]
+		if size == 0 {
+			break
+		}
+		if int64(len(body)) < size+2 {
+			res.chunkGot, res.chunkSize = int64(len(body)), size
+			if res.chunkGot > size {
+				// Only the CRLF after the data is missing
+				res.chunkGot = size
+			}
+			return
+		}
+		body = body[size+2:]
+		res.chunks++
+	}
+	_, res.complete = chunkedTrailers(append([]byte("0\r\n"), body...))
+	res.inTrailers = !res.complete
+}
+
+// printPartialResponse reports a response that the connection ended partway through:
+// how many bytes arrived, how much of its head and body that is, the last bytes in
+// hex, and when they arrived, so that the point it died at can be matched up with
+// the server's and proxies' logs.
+func printPartialResponse(conn *conn, method string, readErr error) {
+	if readErr == nil || conn.responseLen == 0 {
+		// We ended it ourselves, or there was nothing to cut off
+		return
+	}
+	if conn.responseLen > len(conn.response) {
+		fmt.Printf(cyan("connection ended at response byte offset %d; only the first %d bytes were kept, so whether the response was whole isn't known\n"), conn.responseLen, len(conn.response))
+		return
+	}
+	p := parsePartialResponse(conn.response, method)
+	if p.complete {
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf(red("response cut off after %d bytes (at offset 0x%x)\n"), conn.responseLen, conn.responseLen)
+	if p.interim > 0 {
+		fmt.Printf("  after %d interim (1xx) response(s)\n", p.interim)
+	}
+	switch {
+	case p.statusLine == "":
+		fmt.Printf("  the status line never completed: %q\n", p.cutLine)
+	case p.headEnd < 0:
+		fmt.Printf("  status line: %s\n", p.statusLine)
+		fmt.Printf("  headers: incomplete, after %d whole header line(s); cut off in %q\n", p.headerLines, p.cutLine)
+	default:
+		fmt.Printf("  status line: %s\n", p.statusLine)
+		fmt.Printf("  headers: complete, %d header line(s); the body starts at offset %d\n", p.headerLines, p.headEnd)
+		bodyLen := int64(conn.responseLen - p.headEnd)
+		switch {
+		case p.inTrailers:
+			fmt.Printf("  body: chunked, all %d chunk(s) received; cut off before the end of the trailers\n", p.chunks)
+		case p.inChunkSize:
+			fmt.Printf("  body: chunked, %d whole chunk(s) received; cut off in a chunk size line\n", p.chunks)
+		case p.chunked:
+			fmt.Printf("  body: chunked, %d whole chunk(s) received; cut off %d bytes into a %d-byte chunk\n", p.chunks, p.chunkGot, p.chunkSize)
+		default:
+			fmt.Printf("  body: %d of %d bytes (Content-Length); %d missing\n", bodyLen, p.contentLength, p.contentLength-bodyLen)
+		}
+	}
+
+	start := conn.responseLen - partialTailBytes
+	if start < 0 {
+		start = 0
+	}
+	fmt.Println("  last bytes received:")
+	printHexLines(conn.response[start:], start)
+
+	arrivals := conn.arrivals
+	if len(arrivals) > partialArrivalsShown {
+		arrivals = arrivals[len(arrivals)-partialArrivalsShown:]
+	}
+	fmt.Println("  when they arrived:")
+	for i, a := range arrivals {
+		end := conn.responseLen
+		if i+1 < len(arrivals) {
+			end = arrivals[i+1].offset
+		}
+		fmt.Printf("    bytes %d-%d at %.3fs\n", a.offset, end-1, a.at.Sub(conn.connectTime).Seconds())
+	}
+	if !conn.readEndTime.IsZero() {
+		fmt.Printf("    connection ended at %.3fs, %v after the last byte\n",
+			conn.readEndTime.Sub(conn.connectTime).Seconds(), conn.readEndTime.Sub(conn.lastReadTime).Round(time.Millisecond))
+	}
+}
+
+// printHexLines prints b as a hex dump, 16 bytes to a line, labelled with offsets
+// starting at offset.
+func printHexLines(b []byte, offset int) {
+	for len(b) > 0 {
+		n := 16
+		if len(b) < n {
+			n = len(b)
+		}
+		var hexPart, textPart strings.Builder
+		for i := 0; i < 16; i++ {
+			if i < n {
+				fmt.Fprintf(&hexPart, "%02x ", b[i])
+				if b[i] >= 0x20 && b[i] < 0x7f {
+					textPart.WriteByte(b[i])
+				} else {
+					textPart.WriteByte('.')
+				}
+			} else {
+				hexPart.WriteString("   ")
+			}
+		}
+		fmt.Printf("    %08x  %s |%s|\n", offset, hexPart.String(), textPart.String())
+		b, offset = b[n:], offset+n
+	}
+}
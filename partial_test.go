@@ -0,0 +1,38 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import "testing"
+
+func TestParsePartialResponse(t *testing.T) {
+	const cont = "HTTP/1.1 100 Continue\r\n\r\n"
+	tests := []struct {
+		name     string
+		method   string
+		resp     string
+		complete bool
+		headEnd  int
+		interim  int
+	}{
+		{"whole", "GET", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", true, 38, 0},
+		{"body cut off", "GET", "HTTP/1.1 200 OK\r\nContent-Length: 36\r\n\r\nok", false, 39, 0},
+		{"HEAD has no body", "HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 36\r\n\r\n", true, 39, 0},
+		{"HEAD head cut off", "HEAD", "HTTP/1.1 200 OK\r\nContent-Len", false, -1, 0},
+		{"204", "GET", "HTTP/1.1 204 No Content\r\n\r\n", true, 27, 0},
+		{"304 with Content-Length", "GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 36\r\n\r\n", true, 49, 0},
+		{"100 then whole 200", "POST", cont + "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", true, 25 + 38, 1},
+		{"100 then truncated 200", "POST", cont + "HTTP/1.1 200 OK\r\nContent-Length: 36\r\n\r\nok", false, 25 + 39, 1},
+		{"100 and nothing after", "POST", cont, false, -1, 1},
+		{"two interim responses", "POST", cont + "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n" + "HTTP/1.1 204 No Content\r\n\r\n", true, 25 + 44 + 27, 2},
+		{"101 ends HTTP", "GET", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x05", true, 56, 0},
+		{"chunked cut off", "GET", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nab", false, 47, 0},
+		{"no framing", "GET", "HTTP/1.0 200 OK\r\n\r\nuntil close", true, 19, 0},
+	}
+	for _, tt := range tests {
+		p := parsePartialResponse([]byte(tt.resp), tt.method)
+		if p.complete != tt.complete || p.headEnd != tt.headEnd || p.interim != tt.interim {
+			t.Errorf("%s: complete %v, headEnd %d, interim %d; want %v, %d, %d",
+				tt.name, p.complete, p.headEnd, p.interim, tt.complete, tt.headEnd, tt.interim)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// idlePoolOpenGap is the time between opening the pool's connections. It gives each
+// connection a different last-use time, so that expiry by age can be told apart from
+// expiry all at once. Close times within half of this count as the same.
+const idlePoolOpenGap = time.Second
+
+// idlePoolPollInterval is how often each pool connection is checked for a close.
+const idlePoolPollInterval = 100 * time.Millisecond
+
+// pooledConn is a connection in the idle pool.
+type pooledConn struct {
+	conn *conn
+	// usedTime is when the response to its request finished arriving
+	usedTime time.Time
+	// closedTime is when it was seen to be closed; zero if it's still open
+	closedTime time.Time
+	closeErr   error
+}
+
+// idle is how long the connection was idle before it was closed.
+func (pc pooledConn) idle() time.Duration {
+	return pc.closedTime.Sub(pc.usedTime).Round(time.Millisecond)
+}
+
+// runIdlePool opens a pool of keep-alive connections, each used for one request, and
+// then leaves them idle, reporting how many remain open every params.idlePoolReport.
+// This shows how the server or a load balancer in front of it expires a pool of idle
+// connections, which is what matters for tuning a client's connection pool.
+func runIdlePool(params testParams) {
+	fmt.Printf("opening %d idle connections to %s, %v apart\n\n", params.idlePoolSize, params.host, idlePoolOpenGap)
+
+	var first firstConnRecorder
+	params.onDial = first.record
+	req := headRequest(params)
+	start := time.Now()
+	pool := make([]*pooledConn, 0, params.idlePoolSize)
+	defer func() {
+		for _, pc := range pool {
+			pc.conn.c.Close()
+		}
+	}()
+	for i := 0; i < params.idlePoolSize; i++ {
+		if i > 0 {
+			time.Sleep(idlePoolOpenGap)
+		}
+		conn, err := dial(params)
+		if err != nil {
+			fmt.Println(red("connection failed:"), err)
+			return
+		}
+		pool = append(pool, &pooledConn{conn: conn})
+		if _, err := conn.c.Write([]byte(req)); err != nil {
+			fmt.Println(red("request write failed:"), err)
+			return
+		}
+		if _, err := readResponseHead(conn); err != nil {
+			fmt.Println(red("request got no response:"), err)
+			return
+		}
+		pool[i].usedTime = time.Now()
+	}
+
+	open := len(pool)
+	nextReport := time.Now().Add(params.idlePoolReport)
+	var closedSinceReport []string
+	for open > 0 {
+		time.Sleep(idlePoolPollInterval)
+		for i, pc := range pool {
+			if !pc.closedTime.IsZero() {
+				continue
+			}
+			if err := pollClosed(pc.conn); err != nil {
+				pc.closedTime, pc.closeErr = time.Now(), err
+				open--
+				closedSinceReport = append(closedSinceReport, fmt.Sprintf("#%d after %v idle", i+1, pc.idle()))
+			}
+		}
+
+		if now := time.Now(); now.After(nextReport) || open == 0 {
+			line := fmt.Sprintf("%v: %d of %d open", now.Sub(start).Round(time.Second), open, len(pool))
+			if len(closedSinceReport) > 0 {
+				fmt.Println(yellow(line + "; closed " + strings.Join(closedSinceReport, ", ")))
+			} else {
+				fmt.Println(line)
+			}
+			closedSinceReport = nil
+			nextReport = now.Add(params.idlePoolReport)
+		}
+	}
+
+	desc, minIdle, byAge := describePoolExpiry(pool)
+	fmt.Println()
+	fmt.Println(cyan(desc))
+	fmt.Println()
+
+	advice := idleTimeoutAdvice(0, minIdle)
+	if byAge {
+		advice.MaxIdleConnsPerHost = len(pool)
+		advice.Reasons = append(advice.Reasons, fmt.Sprintf("the server kept all %d idle connections until they timed out, so a pool of that many per host is safe (Go's default is 2)", len(pool)))
+	} else {
+		advice.Reasons = append(advice.Reasons, "the server doesn't expire idle connections by age alone, so a bigger idle pool won't help much")
+	}
+	advice.Run = newRunMetadata(params.settings())
+	advice.Run.Connection = first.meta
+	printAdvice(advice, params)
+}
+
+// pollClosed returns an error if conn has been closed by the server. Anything the
+// server sent first (like a 408) is discarded.
+func pollClosed(conn *conn) error {
+	defer conn.c.SetReadDeadline(time.Time{})
+
+	var buf [512]byte
+	for {
+		conn.c.SetReadDeadline(time.Now().Add(time.Millisecond))
+		if _, err := conn.c.Read(buf[:]); err != nil {
+			if isTimeout(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// describePoolExpiry characterizes how a pool of idle connections was expired.
+// minIdle is the shortest time a connection was idle before being closed, and byAge
+// is set if each was closed after the same idle time.
+func describePoolExpiry(pool []*pooledConn) (desc string, minIdle time.Duration, byAge bool) {
+	closed := make([]*pooledConn, len(pool))
+	copy(closed, pool)
+	sort.Slice(closed, func(i, j int) bool { return closed[i].closedTime.Before(closed[j].closedTime) })
+	first, last := closed[0], closed[len(closed)-1]
+
+	minIdle, maxIdle := first.idle(), first.idle()
+	for _, pc := range closed {
+		if pc.idle() < minIdle {
+			minIdle = pc.idle()
+		}
+		if pc.idle() > maxIdle {
+			maxIdle = pc.idle()
+		}
+	}
+
+	var resets int
+	for _, pc := range pool {
+		if errors.Is(pc.closeErr, syscall.ECONNRESET) {
+			resets++
+		}
+	}
+	how := "closed"
+	if resets == len(pool) {
+		how = "reset"
+	} else if resets > 0 {
+		how = fmt.Sprintf("closed (%d of them by reset)", resets)
+	}
+
+	switch spread := last.closedTime.Sub(first.closedTime); {
+	case maxIdle-minIdle <= idlePoolOpenGap/2:
+		return fmt.Sprintf("connections were %s oldest first, each after ~%v idle: a per-connection idle timeout", how, minIdle), minIdle, true
+	case spread <= idlePoolOpenGap/2:
+		return fmt.Sprintf("all %d connections were %s at once, after %v to %v idle: the pool is flushed together, not by each connection's age",
+			len(pool), how, minIdle, maxIdle), minIdle, false
+	default:
+		return fmt.Sprintf("connections were %s staggered over %v, after %v to %v idle: expiry isn't by idle time alone",
+			how, spread.Round(time.Millisecond), minIdle, maxIdle), minIdle, false
+	}
+}
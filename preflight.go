@@ -0,0 +1,204 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// preflightTimeout is the longest to wait for the response to a CORS preflight.
+const preflightTimeout = 10 * time.Second
+
+// corsSimpleMethods are the methods that don't need a preflight by themselves.
+var corsSimpleMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true}
+
+// corsUnlistedHeaders are the headers that a browser sets itself, which aren't
+// listed in Access-Control-Request-Headers.
+var corsUnlistedHeaders = map[string]bool{
+	"accept-charset": true, "accept-encoding": true, "connection": true, "content-length": true,
+	"cookie": true, "date": true, "dnt": true, "expect": true, "host": true, "keep-alive": true,
+	"origin": true, "referer": true, "te": true, "trailer": true, "transfer-encoding": true,
+	"upgrade": true, "user-agent": true, "via": true,
+}
+
+// corsSafelistedHeader says whether a request header can be sent cross-origin
+// without a preflight.
+func corsSafelistedHeader(name, value string) bool {
+	switch name {
+	case "accept", "accept-language", "content-language", "range":
+		return true
+	case "content-type":
+		mediaType, _, _ := strings.Cut(strings.ToLower(value), ";")
+		switch strings.TrimSpace(mediaType) {
+		case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+			return true
+		}
+	}
+	return false
+}
+
+// preflight is the CORS preflight that a browser would send before params' request.
+type preflight struct {
+	origin, method string
+	// headers are the names of the request's headers that need permission, lower
+	// case and sorted, as browsers send them
+	headers []string
+	// needed is false if a browser wouldn't send a preflight for this request
+	needed bool
+	// lines are the preflight's request line and header lines
+	lines []string
+}
+
+// newPreflight works out the preflight for params' request, from its method, Origin,
+// and headers.
+func newPreflight(params testParams) preflight {
+	method, target := params.requestLine()
+	p := preflight{method: method, needed: !corsSimpleMethods[method]}
+	var host string
+	requestLine := true
+	for _, h := range params.headers {
+		if !h.isLine() {
+			continue
+		}
+		if requestLine {
+			requestLine = false
+			continue
+		}
+		name, value, ok := strings.Cut(h.val, ":")
+		if !ok {
+			continue
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		switch {
+		case name == "origin":
+			p.origin = value
+		case name == "host":
+			host = h.val
+		case corsUnlistedHeaders[name] || strings.HasPrefix(name, "sec-") || strings.HasPrefix(name, "proxy-"):
+		case !corsSafelistedHeader(name, value):
+			p.headers = append(p.headers, name)
+			p.needed = true
+		}
+	}
+	sort.Strings(p.headers)
+
+	p.lines = []string{"OPTIONS " + target + " HTTP/1.1"}
+	if host != "" {
+		p.lines = append(p.lines, host)
+	}
+	p.lines = append(p.lines, "Accept: */*", "Origin: "+p.origin, "Access-Control-Request-Method: "+p.method)
+	if len(p.headers) > 0 {
+		p.lines = append(p.lines, "Access-Control-Request-Headers: "+strings.Join(p.headers, ","))
+	}
+	return p
+}
+
+// runPreflight sends the preflight for params' request on conn and reads its
+// response, reporting whether a browser would then go on to send the request. The
+// writes and reads aren't counted as part of the request's. If reuse is set, the
+// request is to follow on conn, and it's an error if the server won't allow that.
+func runPreflight(params testParams, conn *conn, reuse bool) error {
+	p := newPreflight(params)
+	if !p.needed {
+		fmt.Println(yellow("a browser wouldn't send a preflight for this request (its method and headers are all CORS-safelisted); sending one anyway"))
+	}
+	var req strings.Builder
+	for _, line := range p.lines {
+		fmt.Println(timestamp(conn) + line)
+		req.WriteString(line + "\r\n")
+	}
+	fmt.Println(timestamp(conn))
+	req.WriteString("\r\n")
+	start := time.Now()
+	if _, err := conn.c.Write([]byte(req.String())); err != nil {
+		return fmt.Errorf("preflight write failed: %w", err)
+	}
+
+	defer conn.c.SetReadDeadline(time.Time{})
+	conn.c.SetReadDeadline(start.Add(preflightTimeout))
+	var resp []byte
+	var framed partialResponse
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.c.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if framed = parsePartialResponse(resp, "OPTIONS"); framed.complete && framed.headEnd >= 0 {
+			break
+		}
+		if err != nil {
+			fmt.Print(string(resp))
+			return fmt.Errorf("preflight response not received whole after %v: %w", time.Since(start).Round(time.Millisecond), err)
+		}
+	}
+	took := time.Since(start)
+	fmt.Print(string(resp))
+	if !bytes.HasSuffix(resp, []byte("\n")) {
+		fmt.Println()
+	}
+	fmt.Printf(cyan("preflight answered in %v with %s\n"), took, responseStatus(resp))
+	for _, problem := range p.check(resp[:framed.headEnd]) {
+		fmt.Println(yellow("  " + problem))
+	}
+
+	keepAlive := true
+	for _, line := range strings.Split(string(resp[:framed.headEnd]), "\r\n")[1:] {
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "connection") && strings.Contains(strings.ToLower(value), "close") {
+			keepAlive = false
+		}
+	}
+	if framed.contentLength < 0 && !framed.chunked && responseStatus(resp) != "204" {
+		// The body runs until the connection closes
+		keepAlive = false
+	}
+	if reuse && !keepAlive {
+		return fmt.Errorf("the server won't keep the connection open after the preflight; use Preflight: new")
+	}
+	return nil
+}
+
+// check returns the reasons, if any, that a browser wouldn't send the request after
+// a preflight response with the given head.
+func (p preflight) check(head []byte) []string {
+	var problems []string
+	if status := responseStatus(head); len(status) != 3 || status[0] != '2' {
+		problems = append(problems, "the preflight response isn't a 2xx, so a browser would stop here")
+	}
+	allow := map[string]string{}
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			allow[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+
+	origin, ok := allow["access-control-allow-origin"]
+	switch {
+	case !ok:
+		problems = append(problems, "no Access-Control-Allow-Origin, so a browser wouldn't send the request")
+	case origin != "*" && origin != p.origin:
+		problems = append(problems, fmt.Sprintf("Access-Control-Allow-Origin is %q, not %q", origin, p.origin))
+	}
+	listed := func(list, item string) bool {
+		for _, v := range strings.Split(list, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.EqualFold(v, item) {
+				return true
+			}
+		}
+		return false
+	}
+	if !corsSimpleMethods[p.method] && !listed(allow["access-control-allow-methods"], p.method) {
+		problems = append(problems, fmt.Sprintf("Access-Control-Allow-Methods doesn't allow %s", p.method))
+	}
+	for _, h := range p.headers {
+		if !listed(allow["access-control-allow-headers"], h) {
+			problems = append(problems, fmt.Sprintf("Access-Control-Allow-Headers doesn't allow %s", h))
+		}
+	}
+	return problems
+}
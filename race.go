@@ -0,0 +1,108 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// idleRaceOffsets are the offsets from the estimated idle timeout at which reuse of an
+// idle connection is attempted.
+var idleRaceOffsets = []time.Duration{
+	-2 * time.Second, -time.Second, -500 * time.Millisecond, -250 * time.Millisecond, -100 * time.Millisecond,
+	0, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+}
+
+// runIdleRace measures the window in which reusing an idle connection can fail
+// because the server is closing it, around the estimated idle timeout. For each
+// offset, params.idleRaceAttempts connections make a request, sit idle until the
+// offset, and then make another request without first checking for a close, like a
+// client reusing a pooled connection. All attempts run at once.
+func runIdleRace(params testParams, estimate time.Duration) {
+	fmt.Printf("reusing idle connections around the estimated idle timeout of %v, %d attempts per offset\n\n", estimate, params.idleRaceAttempts)
+
+	req := headRequest(params)
+	failures := make([]int, len(idleRaceOffsets))
+	errs := make([]error, len(idleRaceOffsets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, offset := range idleRaceOffsets {
+		gap := estimate + offset
+		if gap <= 0 {
+			continue
+		}
+		for n := 0; n < params.idleRaceAttempts; n++ {
+			wg.Add(1)
+			go func(i int, gap time.Duration) {
+				defer wg.Done()
+				ok, err := reuseAfter(params, req, gap)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs[i] = err
+				} else if !ok {
+					failures[i]++
+				}
+			}(i, gap)
+		}
+	}
+	wg.Wait()
+
+	earliest := time.Duration(0)
+	for i, offset := range idleRaceOffsets {
+		if estimate+offset <= 0 {
+			continue
+		}
+		sign := ""
+		if offset > 0 {
+			sign = "+"
+		}
+		line := fmt.Sprintf("%s%v (idle %v): %d of %d reuses failed", sign, offset, estimate+offset, failures[i], params.idleRaceAttempts)
+		switch {
+		case errs[i] != nil:
+			fmt.Println(line, red("(some attempts couldn't be made: "+errs[i].Error()+")"))
+		case failures[i] > 0:
+			fmt.Println(yellow(line))
+		default:
+			fmt.Println(line)
+		}
+		if failures[i] > 0 && earliest == 0 && offset < 0 {
+			earliest = offset
+		}
+	}
+
+	fmt.Println()
+	if earliest != 0 {
+		fmt.Println(cyan(fmt.Sprintf("reuse started failing %v before the estimated idle timeout: a client's idle timeout should be at least that much shorter", -earliest)))
+	} else {
+		fmt.Println(cyan("no reuse failed before the estimated idle timeout"))
+	}
+}
+
+// reuseAfter makes a request on a new connection, sleeps for gap without watching
+// the connection, and then makes another request. ok is true if the second request
+// got a response. err is only set if the attempt couldn't be made at all.
+func reuseAfter(params testParams, req string, gap time.Duration) (ok bool, err error) {
+	conn, err := dial(params)
+	if err != nil {
+		return false, err
+	}
+	defer conn.c.Close()
+
+	if _, err := conn.c.Write([]byte(req)); err != nil {
+		return false, fmt.Errorf("first request write failed: %w", err)
+	}
+	if _, err := readResponseHead(conn); err != nil {
+		return false, fmt.Errorf("first request got no response: %w", err)
+	}
+
+	time.Sleep(gap)
+
+	if _, err := conn.c.Write([]byte(req)); err != nil {
+		return false, nil
+	}
+	head, err := readResponseHead(conn)
+	return err == nil && responseStatus(head) != "408", nil
+}
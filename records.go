@@ -0,0 +1,48 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// tlsRecordHeaderLen is the length of a TLS record's header: its content type,
+// version, and length.
+const tlsRecordHeaderLen = 5
+
+// recordMark is how many TLS records, and bytes, had been written to the raw
+// connection at some point after the handshake.
+type recordMark struct {
+	records, wireBytes int
+}
+
+// countRecords counts the TLS records in b, which crypto/tls writes to the raw
+// connection a whole record (or, during the handshake, several) at a time.
+func (c *eofTrackingConn) countRecords(b []byte) {
+	c.written.wireBytes += len(b)
+	for len(b) >= tlsRecordHeaderLen {
+		c.written.records++
+		n := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(b[3:5]))
+		if n > len(b) {
+			break
+		}
+		b = b[n:]
+	}
+}
+
+// describeRecords describes how appBytes bytes of the request, written in writes
+// calls, went out as TLS records since before.
+func describeRecords(conn *conn, before recordMark, appBytes, writes int) string {
+	records := conn.raw.written.records - before.records
+	wire := conn.raw.written.wireBytes - before.wireBytes
+	what := fmt.Sprintf("%d bytes", appBytes)
+	if writes > 1 {
+		what = fmt.Sprintf("%d writes of %d bytes in all", writes, appBytes)
+	}
+	if records == 0 {
+		return fmt.Sprintf("(TLS: %s produced no records)", what)
+	}
+	return fmt.Sprintf("(TLS: %s went out as %d record(s), %d bytes on the wire, %d of them record overhead)",
+		what, records, wire, wire-appBytes)
+}
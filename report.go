@@ -0,0 +1,253 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// printCloseReport describes how the connection ended. readErr is the error that
+// ended reading, or nil if we stopped reading and closed the connection ourselves.
+func printCloseReport(conn *conn, readErr error) {
+	endTime := conn.readEndTime
+	if readErr == nil {
+		endTime = time.Now()
+	}
+
+	switch {
+	case readErr == nil:
+		fmt.Println(cyan("connection closed by us"))
+	case readErr == io.EOF:
+		how := "FIN"
+		if conn.raw != nil {
+			// The TLS layer stops reading at close_notify, so if the raw connection
+			// hit EOF the server closed without sending one.
+			if conn.raw.sawEOF {
+				how += ", no TLS close_notify"
+			} else {
+				how += ", with TLS close_notify"
+			}
+		}
+		fmt.Printf(cyan("connection closed by peer (%s)\n"), how)
+		if conn.raw != nil {
+			explain(explainCloseNotify)
+		}
+	case errors.Is(readErr, syscall.ECONNRESET):
+		fmt.Println(cyan("connection reset by peer (RST)"))
+		explain(explainReset)
+	default:
+		fmt.Printf(cyan("connection ended by error, not a close: %v\n"), readErr)
+	}
+
+	if conn.lastWriteTime.IsZero() {
+		fmt.Println(cyan("  nothing was written"))
+	} else {
+		fmt.Printf(cyan("  %s our last write\n"), relative(endTime.Sub(conn.lastWriteTime)))
+	}
+	if conn.lastReadTime.IsZero() {
+		fmt.Println(cyan("  no response bytes were received"))
+	} else {
+		idle := relative(endTime.Sub(conn.lastReadTime))
+		if readErr != nil && conn.closeUncertainty >= readEndPrecision {
+			fmt.Printf(cyan("  %s the last response byte (~idle timeout; the end may have come up to %v earlier)\n"), idle, conn.closeUncertainty.Round(time.Millisecond))
+		} else {
+			fmt.Printf(cyan("  %s the last response byte (~idle timeout)\n"), idle)
+		}
+		explain(explainIdle)
+	}
+}
+
+// printWriteStalls reports writes that blocked because the server stopped taking
+// our data (its receive buffer and our send buffer filled), which otherwise just
+// inflates the time to send.
+func printWriteStalls(conn *conn) {
+	if conn.firstStallTime.IsZero() {
+		return
+	}
+	fmt.Printf(cyan("writes blocked for %v in total (the longest write took %v); the server first stopped taking our request at %.3fs, after %d bytes\n"),
+		conn.writeBlocked.Round(time.Millisecond), conn.maxWriteTime.Round(time.Millisecond),
+		conn.firstStallTime.Sub(conn.connectTime).Seconds(), conn.firstStallOffset)
+}
+
+// handlerTimeoutMinIdle is how long the connection must stay open after a 503 for it
+// to be considered still usable.
+const handlerTimeoutMinIdle = time.Second
+
+// printClassification explains which kind of server timeout the response looks
+// like, if it looks like one we know about. In particular, it distinguishes a
+// handler timeout (like Go's http.TimeoutHandler: a 503 with a body, and the
+// connection is left usable) from a server write timeout (like Go's
+// http.Server.WriteTimeout: the connection is killed without a response).
+func printClassification(conn *conn, readErr error) {
+	closedByPeer := readErr == io.EOF || errors.Is(readErr, syscall.ECONNRESET)
+
+	switch {
+	case len(conn.response) == 0 && closedByPeer && !conn.requestSentTime.IsZero():
+		fmt.Println(cyan("looks like a server write timeout (e.g. Go's WriteTimeout): the connection was killed without a response"))
+		explain(explainWrite)
+	case responseStatus(conn.response) == "503":
+		stayedOpen := readErr == nil || conn.readEndTime.Sub(conn.lastReadTime) >= handlerTimeoutMinIdle
+		if stayedOpen {
+			fmt.Println(cyan("looks like a handler timeout (e.g. Go's TimeoutHandler): 503 response and the connection stayed usable"))
+			explain(explainHandler)
+		} else {
+			fmt.Println(cyan("503 response, but the connection was closed right after it (a handler timeout usually leaves it usable)"))
+		}
+	}
+
+	printReadDeadlineSemantics(conn)
+}
+
+// printHeadBodyCheck warns if the response to a HEAD request (incorrectly) had a body.
+// Without one, anything after the headers would have to be another response.
+func printHeadBodyCheck(conn *conn) {
+	end := bytes.Index(conn.response, []byte("\r\n\r\n"))
+	if end < 0 {
+		return
+	}
+	extra := conn.responseLen - (end + 4)
+	if extra > 0 {
+		fmt.Printf(red("server sent %d bytes after the headers of its HEAD response; HEAD responses must not have a body\n"), extra)
+	}
+}
+
+// printAltSvc reports any alternative services (like HTTP/3) that the response
+// advertises in Alt-Svc headers. Clients that switch to them will see that protocol's
+// timeouts, not the ones found here.
+func printAltSvc(conn *conn) {
+	end := bytes.Index(conn.response, []byte("\r\n\r\n"))
+	if end < 0 {
+		return
+	}
+	var services []string
+	for _, line := range strings.Split(string(conn.response[:end]), "\r\n")[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "Alt-Svc") {
+			continue
+		}
+		for _, entry := range strings.Split(value, ",") {
+			if s := describeAltSvc(strings.TrimSpace(entry)); s != "" {
+				services = append(services, s)
+			}
+		}
+	}
+	if len(services) == 0 {
+		return
+	}
+	fmt.Println(cyan("server advertises alternative services (Alt-Svc): " + strings.Join(services, "; ")))
+	fmt.Println(cyan("  only HTTP/1.1 was tested; clients that switch to these may see different timeouts"))
+}
+
+// describeAltSvc describes an Alt-Svc entry, like `h3=":443"; ma=86400`. It returns ""
+// for "clear", which withdraws any earlier advertisement.
+func describeAltSvc(entry string) string {
+	params := strings.Split(entry, ";")
+	protocol, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+	if !ok {
+		return ""
+	}
+	desc := fmt.Sprintf("%s at %s", protocol, strings.Trim(authority, `"`))
+	for _, p := range params[1:] {
+		if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "ma" {
+			if secs, err := strconv.Atoi(v); err == nil {
+				desc += fmt.Sprintf(" (for %v)", time.Duration(secs)*time.Second)
+			}
+		}
+	}
+	return desc
+}
+
+// minSemanticsRatio is how many times longer than our longest pause the request must
+// have taken for the read timeout semantics to be distinguishable.
+const minSemanticsRatio = 3
+
+// minSemanticsDuration is how long the request must have taken for the read timeout
+// semantics to be worth reporting.
+const minSemanticsDuration = time.Second
+
+// printReadDeadlineSemantics says whether the server's request read timeout looks like
+// a single deadline for the whole request (like Go's ReadTimeout, set once when the
+// request starts) or a per-read inactivity timeout (like nginx's client_body_timeout).
+// It can only tell when we wrote with short pauses over a long time.
+func printReadDeadlineSemantics(conn *conn) {
+	if conn.firstWriteTime.IsZero() || conn.maxWriteGap == 0 {
+		return
+	}
+
+	if !conn.requestSentTime.IsZero() {
+		took := conn.requestSentTime.Sub(conn.firstWriteTime)
+		if took < minSemanticsDuration || took < minSemanticsRatio*conn.maxWriteGap {
+			return
+		}
+		fmt.Printf(cyan("request took %v to send with pauses of at most %v and was accepted: no whole-request read deadline shorter than that (any read timeout is per-read inactivity, like nginx)\n"),
+			took.Round(time.Millisecond), conn.maxWriteGap.Round(time.Millisecond))
+		explain(explainPerRead)
+		return
+	}
+
+	// The server cut the request off; it either responded early or ended the connection
+	cut := conn.readEndTime
+	if !conn.firstByteTime.IsZero() && (cut.IsZero() || conn.firstByteTime.Before(cut)) {
+		cut = conn.firstByteTime
+	}
+	if cut.IsZero() {
+		return
+	}
+	took := cut.Sub(conn.firstWriteTime)
+	// The pause from our last write until the cut counts too
+	maxGap := conn.maxWriteGap
+	if gap := cut.Sub(conn.lastWriteTime); gap > maxGap {
+		maxGap = gap
+	}
+	if took < minSemanticsDuration || took < minSemanticsRatio*maxGap {
+		return
+	}
+	fmt.Printf(cyan("server cut the request off after %v although we never paused more than %v: looks like a whole-request read deadline (like Go's ReadTimeout)\n"),
+		took.Round(time.Millisecond), maxGap.Round(time.Millisecond))
+	explain(explainWholeRequest)
+}
+
+// responseStatus returns the status code from the status line of resp, or "" if there
+// isn't one.
+func responseStatus(resp []byte) string {
+	m := statusLineRegexp.FindSubmatch(resp)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+var statusLineRegexp = regexp.MustCompile(`^HTTP/\d\.\d (\d{3})`)
+
+// timestamp returns a line prefix giving the time since the connection was made.
+func timestamp(conn *conn) string {
+	return fmt.Sprintf("[%8.3fs] ", time.Since(conn.connectTime).Seconds())
+}
+
+// relative formats d as "<d> after" or "<d> before".
+func relative(d time.Duration) string {
+	if d < 0 {
+		return fmt.Sprintf("%v before", -d)
+	}
+	return fmt.Sprintf("%v after", d)
+}
+
+func red(s string) string {
+	return fmt.Sprintf("\033[91m%s\033[0m", s)
+}
+
+func yellow(s string) string {
+	return fmt.Sprintf("\033[93m%s\033[0m", s)
+}
+
+func cyan(s string) string {
+	return fmt.Sprintf("\033[96m%s\033[0m", s)
+}
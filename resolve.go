@@ -0,0 +1,136 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// resolveTimeout is how long to wait for a custom resolver to answer.
+const resolveTimeout = 5 * time.Second
+
+// resolveHost looks up the host of params.host with the custom resolver (an IP
+// address, or a DNS-over-HTTPS URL) and prints the time it took and the answers.
+// Split-horizon DNS can send us to a different backend than other clients, so this
+// shows which one we're testing. The returned params dial the first answer, while
+// Host and SNI still come from params.host.
+func resolveHost(params testParams, resolver string) (testParams, error) {
+	host, port, err := net.SplitHostPort(params.host)
+	if err != nil {
+		return params, err
+	}
+	if net.ParseIP(host) != nil {
+		// Nothing to resolve
+		return params, nil
+	}
+
+	start := time.Now()
+	var addrs []string
+	if strings.HasPrefix(resolver, "https://") {
+		addrs, err = lookupDoH(resolver, host)
+	} else {
+		addrs, err = lookupDNS(resolver, host)
+	}
+	took := time.Since(start)
+	if err != nil {
+		return params, fmt.Errorf("resolving %s via %s failed: %w", host, resolver, err)
+	}
+	if len(addrs) == 0 {
+		return params, fmt.Errorf("resolving %s via %s gave no addresses", host, resolver)
+	}
+
+	fmt.Printf(cyan("resolved %s via %s in %v: %s (using %s)\n"), host, resolver, took.Round(time.Millisecond), strings.Join(addrs, ", "), addrs[0])
+	params.dialHost = net.JoinHostPort(addrs[0], port)
+	return params, nil
+}
+
+// lookupDNS resolves host with the DNS server at server, which is an IP address with
+// an optional port.
+func lookupDNS(server, host string) ([]string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, ip.IP.String())
+	}
+	return addrs, nil
+}
+
+// dohResponse is the part of a DNS-over-HTTPS JSON response that we use.
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// DNS record types asked for in DoH lookups.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// lookupDoH resolves host with the JSON form of DNS-over-HTTPS (as served by
+// Cloudflare and Google) at endpoint. A records are asked for first, then AAAA.
+func lookupDoH(endpoint, host string) ([]string, error) {
+	client := &http.Client{Timeout: resolveTimeout}
+	var addrs []string
+	for _, qtype := range []int{dnsTypeA, dnsTypeAAAA} {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("name", host)
+		q.Set("type", fmt.Sprint(qtype))
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/dns-json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var dr dohResponse
+		err = json.NewDecoder(resp.Body).Decode(&dr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad DoH response (%s): %w", resp.Status, err)
+		}
+		if dr.Status != 0 {
+			return nil, fmt.Errorf("DoH lookup failed with DNS rcode %d", dr.Status)
+		}
+		// Answers can include the CNAMEs followed to get there
+		for _, a := range dr.Answer {
+			if a.Type == qtype {
+				addrs = append(addrs, a.Data)
+			}
+		}
+	}
+	return addrs, nil
+}
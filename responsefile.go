@@ -0,0 +1,86 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// responseHeadSuffix is added to ResponseFile's name for the file the head goes in.
+const responseHeadSuffix = ".head"
+
+// responseSaver saves the response bytes as they arrive: the head (after any interim
+// 1xx responses, which go with it) in one file, and the body in another. The body
+// is saved as it came, with any chunked framing.
+type responseSaver struct {
+	headFile, bodyFile *os.File
+	head, body         *bufio.Writer
+	// pending is the head so far, until it's whole
+	pending []byte
+	inBody  bool
+}
+
+// newResponseSaver creates filename for the body, and filename+responseHeadSuffix
+// for the head.
+func newResponseSaver(filename string) (*responseSaver, error) {
+	bodyFile, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	headFile, err := os.Create(filename + responseHeadSuffix)
+	if err != nil {
+		bodyFile.Close()
+		return nil, err
+	}
+	return &responseSaver{
+		headFile: headFile, bodyFile: bodyFile,
+		head: bufio.NewWriter(headFile), body: bufio.NewWriter(bodyFile),
+	}, nil
+}
+
+// WriteByte adds the next response byte.
+func (s *responseSaver) WriteByte(b byte) error {
+	if s.inBody {
+		return s.body.WriteByte(b)
+	}
+	s.pending = append(s.pending, b)
+	if !bytes.HasSuffix(s.pending, []byte("\r\n\r\n")) {
+		return nil
+	}
+	// This is only the end of an interim response's head if there's no final one yet
+	if parsePartialResponse(s.pending, "").headEnd < 0 {
+		return nil
+	}
+	s.inBody = true
+	_, err := s.head.Write(s.pending)
+	s.pending = nil
+	return err
+}
+
+// Close writes out whatever is left (all of it goes in the head file if the head
+// never ended) and closes the files.
+func (s *responseSaver) Close() error {
+	var errs []error
+	if !s.inBody {
+		_, err := s.head.Write(s.pending)
+		errs = append(errs, err)
+	}
+	errs = append(errs, s.head.Flush(), s.body.Flush(), s.headFile.Close(), s.bodyFile.Close())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe says where the response was saved.
+func (s *responseSaver) describe() string {
+	if !s.inBody {
+		return fmt.Sprintf("response saved to %s (its head never ended, so %s is empty)", s.headFile.Name(), s.bodyFile.Name())
+	}
+	return fmt.Sprintf("response head saved to %s and body to %s", s.headFile.Name(), s.bodyFile.Name())
+}
@@ -0,0 +1,50 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResponseSaver(t *testing.T) {
+	tests := []struct {
+		name       string
+		resp       string
+		head, body string
+	}{
+		{"whole response",
+			"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", "hello"},
+		{"100 Continue goes with the head",
+			"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n", "ok"},
+		{"chunked body keeps its framing",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", "2\r\nok\r\n0\r\n\r\n"},
+		{"head cut off",
+			"HTTP/1.1 200 OK\r\nContent-Le",
+			"HTTP/1.1 200 OK\r\nContent-Le", ""},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "response.bin")
+		s, err := newResponseSaver(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(tt.resp); i++ {
+			if err := s.WriteByte(tt.resp[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		head, _ := os.ReadFile(filename + responseHeadSuffix)
+		body, _ := os.ReadFile(filename)
+		if string(head) != tt.head || string(body) != tt.body {
+			t.Errorf("%s: saved head %q, body %q; want %q, %q", tt.name, head, body, tt.head, tt.body)
+		}
+	}
+}
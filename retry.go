@@ -0,0 +1,90 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+)
+
+// earlyFailure is how soon after connecting a failure must come for
+// RetryEarlyFailure to retry the request.
+const earlyFailure = time.Second
+
+// attempt is how one run of the request went, for comparing with a retry.
+type attempt struct {
+	rtt time.Duration
+	// end is how the connection ended: "reset", "FIN", "write failed", "read error",
+	// or "closed by us"
+	end string
+	// endedAfter is how long after connecting it ended
+	endedAfter time.Duration
+	// responseLen is the number of response bytes received; status is the response
+	// status, if a status line arrived; complete is set if the whole response did
+	responseLen int
+	status      string
+	complete    bool
+}
+
+// newAttempt sums up a finished run of the request on conn.
+func newAttempt(conn *conn, r *run) attempt {
+	a := attempt{rtt: conn.rtt, responseLen: conn.responseLen, status: responseStatus(conn.response)}
+	method, _ := r.params.requestLine()
+	a.complete = conn.responseLen > 0 && parsePartialResponse(conn.response, method).complete
+	endTime := conn.readEndTime
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	a.endedAfter = endTime.Sub(conn.connectTime)
+
+	switch {
+	case errors.Is(r.readErr, syscall.ECONNRESET) || errors.Is(conn.writeErr, syscall.ECONNRESET):
+		a.end = "reset"
+	case r.err != nil && r.err != errStopAfter && r.readErr != io.EOF:
+		a.end = "write failed"
+	case r.readErr == io.EOF:
+		a.end = "FIN"
+	case r.readErr != nil:
+		a.end = "read error"
+	default:
+		a.end = "closed by us"
+	}
+	return a
+}
+
+// diedEarly says whether the connection failed soon after it was made: the server
+// ended it within earlyFailure, without a whole response.
+func (a attempt) diedEarly() bool {
+	return a.end != "closed by us" && a.endedAfter < earlyFailure && (a.end == "reset" || !a.complete)
+}
+
+// ending describes how the connection ended.
+func (a attempt) ending() string {
+	if a.responseLen == 0 {
+		return a.end + ", no response"
+	}
+	if a.complete {
+		return fmt.Sprintf("%s, after a whole %s response", a.end, a.status)
+	}
+	return fmt.Sprintf("%s, after %d response bytes", a.end, a.responseLen)
+}
+
+// compareAttempts reports whether a retry behaved like the first attempt. If it
+// didn't, the first one probably hit something that only affects a first connection,
+// like a cold cache or a stale conntrack entry.
+func compareAttempts(first, second attempt) {
+	fmt.Println(cyan("first attempt compared with the retry:"))
+	fmt.Printf("  %-16s %-36s %s\n", "", "first", "retry")
+	fmt.Printf("  %-16s %-36v %v\n", "connect RTT", first.rtt, second.rtt)
+	fmt.Printf("  %-16s %-36s %s\n", "ended", first.ending(), second.ending())
+	fmt.Printf("  %-16s %-36v %v\n", "after", first.endedAfter.Round(time.Millisecond), second.endedAfter.Round(time.Millisecond))
+
+	if first.end == second.end && first.status == second.status && first.complete == second.complete && second.diedEarly() {
+		fmt.Println(cyan("both attempts failed the same way, so the early failure looks real rather than a first-connection anomaly"))
+		return
+	}
+	fmt.Println(yellow("the attempts behaved differently, so the first was likely a first-connection anomaly (a cold cache, a stale conntrack or NAT entry, or a connection limit); the retry's result is the one to trust"))
+}
@@ -0,0 +1,147 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// confirmRuntime is how long a run can plausibly take before it needs confirming
+	confirmRuntime = 10 * time.Minute
+	// estimateMaxRTT is the slowest RTT assumed for sleeps given as multiples of it
+	estimateMaxRTT = 500 * time.Millisecond
+)
+
+// assumeYes skips the confirmation of long runs.
+var assumeYes bool
+
+// runtimeEstimate is how long a run will plausibly take.
+type runtimeEstimate struct {
+	min, max time.Duration
+	// open, if set, is why there's no upper bound, and max is meaningless
+	open string
+}
+
+func (e runtimeEstimate) String() string {
+	if e.open != "" {
+		return fmt.Sprintf("at least %v (%s)", roundEstimate(e.min), e.open)
+	}
+	if roundEstimate(e.min) == roundEstimate(e.max) {
+		return fmt.Sprintf("about %v", roundEstimate(e.min))
+	}
+	return fmt.Sprintf("%v to %v", roundEstimate(e.min), roundEstimate(e.max))
+}
+
+// roundEstimate rounds d to a precision that doesn't claim more than an estimate knows.
+func roundEstimate(d time.Duration) time.Duration {
+	if d < time.Minute {
+		return d.Round(100 * time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
+
+// estimateRuntime estimates how long running params will take, from its sleeps,
+// pacing, and probe bounds. Time spent waiting on the server is unknown, so it's only
+// counted where a probe bounds it.
+func (p testParams) estimateRuntime() runtimeEstimate {
+	switch {
+	case p.watch != 0:
+		return runtimeEstimate{open: "Watch runs until interrupted"}
+	case p.idleProbeMax != 0:
+		e := runtimeEstimate{min: p.idleProbeMin, max: idleProbeWorstCase(p.idleProbeMin, p.idleProbeMax)}
+		if p.idleRaceAttempts > 0 {
+			// The race attempts all run at once, around the estimate found
+			e.max += p.idleProbeMax + idleRaceOffsets[len(idleRaceOffsets)-1]
+		}
+		return e
+	case p.idlePoolSize != 0:
+		return runtimeEstimate{
+			min:  time.Duration(p.idlePoolSize-1) * idlePoolOpenGap,
+			open: "the pool is watched until the server has closed every connection",
+		}
+	case p.closeCompare:
+		return runtimeEstimate{max: 2 * closeCompareWait}
+	case p.tarpitBytes != 0:
+		return runtimeEstimate{max: p.tarpitMax}
+	}
+
+	min, _ := p.minRuntime()
+	e := runtimeEstimate{min: min, max: min + time.Duration(p.sleepRTTs()*float64(estimateMaxRTT))}
+	if p.retryEarlyFailure {
+		// A retry only follows a first attempt that failed within earlyFailure
+		e.max += earlyFailure
+	}
+	if p.perByteResponseReadSleep != 0 || p.perByteResponseReadSleepRTTs != 0 {
+		if p.maxResponseBytes == 0 || !p.closeAtMaxResponseBytes {
+			e.open = "the response is read slowly until the server closes the connection"
+		}
+	}
+	return e
+}
+
+// sleepRTTs is the total of the sleeps given as multiples of the RTT, in RTTs.
+func (p testParams) sleepRTTs() float64 {
+	rtts := p.headerEndSleepRTTs + p.bodyStartSleepRTTs
+	for _, h := range p.headers {
+		rtts += h.sleepRTTs
+	}
+	if len(p.body) > 1 {
+		rtts += float64(len(p.body)-1) * p.perByteBodySleepRTTs
+	}
+	if p.maxResponseBytes != 0 && p.closeAtMaxResponseBytes {
+		rtts += float64(p.maxResponseBytes-1) * p.perByteResponseReadSleepRTTs
+	}
+	return rtts
+}
+
+// idleProbeWorstCase is the longest that bracketIdleTimeout can spend idle, which is
+// when the timeout is just under max: every doubling of the gap still works, and then
+// every step of bisecting down to idleProbeResolution waits almost max.
+func idleProbeWorstCase(min, max time.Duration) time.Duration {
+	var total time.Duration
+	gap := min
+	for {
+		total += gap
+		if gap == max {
+			break
+		}
+		gap *= 2
+		if gap > max {
+			gap = max
+		}
+	}
+	for width := max - max/2; width > idleProbeResolution; width /= 2 {
+		total += max
+	}
+	return total
+}
+
+// confirmLongRun prints the estimated runtime of params and, if it may exceed
+// confirmRuntime, asks whether to go ahead, unless -yes was given. It exits if the
+// answer is no.
+func confirmLongRun(params testParams) {
+	e := params.estimateRuntime()
+	fmt.Println("estimated runtime:", e)
+	if params.watch != 0 || assumeYes {
+		return
+	}
+	longest := e.max
+	if e.open != "" {
+		longest = e.min
+	}
+	if longest <= confirmRuntime {
+		return
+	}
+
+	fmt.Print(yellow(fmt.Sprintf("this may take more than %v; continue? [y/N]: ", confirmRuntime)))
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer != "y" && answer != "yes" {
+		fmt.Println("not running; pass -yes to skip this question")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,105 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinRuntime(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     testParams
+		want  time.Duration
+		exact bool
+	}{
+		{
+			name:  "nothing",
+			want:  0,
+			exact: true,
+		},
+		{
+			name: "header sleeps and boundary sleeps",
+			p: testParams{
+				headers:        []header{{val: "GET / HTTP/1.1"}, {sleep: time.Second}, {sleep: 2 * time.Second}},
+				headerEndSleep: 3 * time.Second,
+				bodyStartSleep: 4 * time.Second,
+			},
+			want:  10 * time.Second,
+			exact: true,
+		},
+		{
+			name: "body pacing is between bytes",
+			p:    testParams{body: "abcde", perByteBodySleep: 100 * time.Millisecond},
+			want: 400 * time.Millisecond, exact: true,
+		},
+		{
+			name: "one-byte body has no gaps",
+			p:    testParams{body: "a", perByteBodySleep: time.Hour},
+			want: 0, exact: true,
+		},
+		{
+			name: "response pacing with a close",
+			p:    testParams{perByteResponseReadSleep: time.Second, maxResponseBytes: 11, closeAtMaxResponseBytes: true},
+			want: 10 * time.Second, exact: true,
+		},
+		{
+			name: "response pacing until the server closes",
+			p:    testParams{perByteResponseReadSleep: time.Second, maxResponseBytes: 11},
+			want: 0, exact: false,
+		},
+		{
+			name: "RTT sleeps aren't known",
+			p:    testParams{headers: []header{{sleep: time.Second}, {sleepRTTs: 5}}},
+			want: time.Second, exact: false,
+		},
+	}
+	for _, tt := range tests {
+		got, exact := tt.p.minRuntime()
+		if got != tt.want || exact != tt.exact {
+			t.Errorf("%s: minRuntime() = %v, %v; want %v, %v", tt.name, got, exact, tt.want, tt.exact)
+		}
+	}
+}
+
+func TestSleepRTTs(t *testing.T) {
+	tests := []struct {
+		name string
+		p    testParams
+		want float64
+	}{
+		{"none", testParams{headers: []header{{sleep: time.Second}}}, 0},
+		{"headers and boundaries", testParams{
+			headers:            []header{{sleepRTTs: 2}, {val: "Host: x"}, {sleepRTTs: 0.5}},
+			headerEndSleepRTTs: 1,
+			bodyStartSleepRTTs: 3,
+		}, 6.5},
+		{"body bytes", testParams{body: "abcd", perByteBodySleepRTTs: 2}, 6},
+		{"response bytes only with a close", testParams{perByteResponseReadSleepRTTs: 1, maxResponseBytes: 5}, 0},
+		{"response bytes", testParams{perByteResponseReadSleepRTTs: 1, maxResponseBytes: 5, closeAtMaxResponseBytes: true}, 4},
+	}
+	for _, tt := range tests {
+		if got := tt.p.sleepRTTs(); got != tt.want {
+			t.Errorf("%s: sleepRTTs() = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIdleProbeWorstCase(t *testing.T) {
+	tests := []struct {
+		min, max, want time.Duration
+	}{
+		// 1+2+4+8, then bisecting 4s down to 500ms takes 3 more waits of 8s
+		{time.Second, 8 * time.Second, 15*time.Second + 3*8*time.Second},
+		// 1+2+4+5, with the last doubling clipped to max; bisecting 2.5s takes 3
+		{time.Second, 5 * time.Second, 12*time.Second + 3*5*time.Second},
+		// The bracket is already narrow enough after the first failure
+		{100 * time.Millisecond, 800 * time.Millisecond, 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := idleProbeWorstCase(tt.min, tt.max); got != tt.want {
+			t.Errorf("idleProbeWorstCase(%v, %v) = %v; want %v", tt.min, tt.max, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// The subset of SARIF 2.1.0 that audit findings need.
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool          `json:"tool"`
+	Results    []sarifResult      `json:"results"`
+	Properties sarifRunProperties `json:"properties"`
+}
+
+// sarifRunProperties records how the audit was run, and what it connected to.
+type sarifRunProperties struct {
+	SchemaVersion int                   `json:"schemaVersion"`
+	Run           *runMetadata          `json:"run"`
+	Targets       []sarifTargetMetadata `json:"targets"`
+}
+
+type sarifTargetMetadata struct {
+	URI        string            `json:"uri"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Connection *connMetadata     `json:"connection,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string                 `json:"ruleId"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// sarifLevels maps finding severities to SARIF result levels.
+var sarifLevels = map[string]string{
+	severityHigh:   "error",
+	severityMedium: "warning",
+	severityLow:    "note",
+	severityInfo:   "none",
+}
+
+// auditRuleID is the SARIF rule ID for an audit probe.
+func auditRuleID(probe string) string {
+	return strings.ReplaceAll(probe, " ", "-")
+}
+
+// probeFailedRuleID is the SARIF rule for a probe that couldn't be run, so that a
+// target that couldn't be audited doesn't look like one with nothing to report.
+const probeFailedRuleID = "probe-failed"
+
+// writeAuditSARIF writes audit findings to filename as a SARIF log. Probes that failed
+// are errors under probeFailedRuleID.
+func writeAuditSARIF(filename string, meta *runMetadata, results []auditResult) error {
+	driver := sarifDriver{
+		Name:           "httptimeout",
+		InformationURI: "https://github.com/adam-p/httptimeout",
+	}
+	for _, p := range auditProbes {
+		driver.Rules = append(driver.Rules, sarifRule{
+			ID:               auditRuleID(p.name),
+			ShortDescription: sarifMessage{Text: p.name},
+		})
+	}
+	driver.Rules = append(driver.Rules, sarifRule{
+		ID:               probeFailedRuleID,
+		ShortDescription: sarifMessage{Text: "audit probe failed"},
+	})
+
+	run := sarifRun{
+		Tool:       sarifTool{Driver: driver},
+		Results:    []sarifResult{},
+		Properties: sarifRunProperties{SchemaVersion: reportSchemaVersion, Run: meta},
+	}
+	for _, r := range results {
+		run.Properties.Targets = append(run.Properties.Targets, sarifTargetMetadata{URI: r.target, Tags: r.tags, Connection: r.conn})
+		for _, f := range r.findings {
+			if f.err != nil {
+				run.Results = append(run.Results, sarifFailedResult(r.target, r.tags, f))
+				continue
+			}
+			run.Results = append(run.Results, sarifFindingResult(r.target, r.tags, f))
+		}
+	}
+	b, err := json.MarshalIndent(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0o644)
+}
+
+// sarifFindingResult converts an audit finding for target, which has tags, to a SARIF
+// result.
+func sarifFindingResult(target string, tags map[string]string, f auditFinding) sarifResult {
+	text := f.probe + ": " + f.outcome
+	if f.note != "" {
+		text += " (" + f.note + ")"
+	}
+	res := sarifResult{
+		RuleID:  auditRuleID(f.probe),
+		Level:   sarifLevels[f.severity],
+		Message: sarifMessage{Text: text},
+		Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: target},
+		}}},
+		Properties: map[string]interface{}{"severity": f.severity},
+	}
+	if f.after != 0 {
+		res.Properties["afterMs"] = f.after.Milliseconds()
+	}
+	if f.margin != 0 {
+		res.Properties["estimateMs"] = (f.after - f.margin).Milliseconds()
+		res.Properties["marginMs"] = f.margin.Milliseconds()
+		res.Properties["lowConfidence"] = f.lowConfidence
+	}
+	if f.hasExpected {
+		res.Properties["expectedMs"] = f.expected.Milliseconds()
+		res.Properties["metExpected"] = f.metExpected
+		if f.expectedAtLeast {
+			res.Properties["expectedAtLeast"] = true
+		}
+	}
+	if len(tags) > 0 {
+		res.Properties["tags"] = tags
+	}
+	return res
+}
+
+// sarifFailedResult converts an audit finding for target, whose probe failed, to a
+// SARIF result.
+func sarifFailedResult(target string, tags map[string]string, f auditFinding) sarifResult {
+	res := sarifResult{
+		RuleID:  probeFailedRuleID,
+		Level:   "error",
+		Message: sarifMessage{Text: f.probe + ": probe failed: " + f.err.Error()},
+		Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: target},
+		}}},
+		Properties: map[string]interface{}{"probe": f.probe, "error": f.err.Error()},
+	}
+	if len(tags) > 0 {
+		res.Properties["tags"] = tags
+	}
+	return res
+}
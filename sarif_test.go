@@ -0,0 +1,58 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteAuditSARIF(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.sarif")
+	results := []auditResult{{
+		target: "api.example.com:443",
+		tags:   map[string]string{"team": "edge"},
+		findings: []auditFinding{
+			{probe: "header read timeout", outcome: "closed", after: 10 * time.Second, severity: severityInfo},
+			{probe: "idle timeout", err: errors.New("connection refused")},
+		},
+	}}
+	if err := writeAuditSARIF(filename, nil, results); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(b, &log); err != nil {
+		t.Fatal(err)
+	}
+
+	got := log.Runs[0].Results
+	if len(got) != 2 {
+		t.Fatalf("got %d results; want 2 (failed probes included)", len(got))
+	}
+	failed := got[1]
+	if failed.RuleID != probeFailedRuleID || failed.Level != "error" {
+		t.Errorf("failed probe: ruleId %q, level %q; want %q, error", failed.RuleID, failed.Level, probeFailedRuleID)
+	}
+	if failed.Message.Text != "idle timeout: probe failed: connection refused" {
+		t.Errorf("failed probe message = %q", failed.Message.Text)
+	}
+	if failed.Properties["probe"] != "idle timeout" || failed.Properties["error"] != "connection refused" {
+		t.Errorf("failed probe properties = %v", failed.Properties)
+	}
+
+	hasRule := false
+	for _, r := range log.Runs[0].Tool.Driver.Rules {
+		hasRule = hasRule || r.ID == probeFailedRuleID
+	}
+	if !hasRule {
+		t.Errorf("no %s rule", probeFailedRuleID)
+	}
+}
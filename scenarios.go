@@ -0,0 +1,164 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed scenarios/*.txt
+var scenarioFiles embed.FS
+
+// scenario is one of the canned configs in the scenarios directory.
+type scenario struct {
+	name string
+	// purpose is the comment at the top of the file, which explains what the scenario
+	// does and what to expect
+	purpose string
+	config  []byte
+}
+
+// readScenarios returns the embedded scenarios, sorted by name.
+func readScenarios() ([]scenario, error) {
+	paths, err := fs.Glob(scenarioFiles, "scenarios/*.txt")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var res []scenario
+	for _, p := range paths {
+		config, err := scenarioFiles.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var purpose []string
+		for _, line := range strings.Split(string(config), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				break
+			}
+			purpose = append(purpose, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+		}
+		res = append(res, scenario{
+			name:    strings.TrimSuffix(path.Base(p), ".txt"),
+			purpose: strings.Join(purpose, " "),
+			config:  config,
+		})
+	}
+	return res, nil
+}
+
+// summary is the first sentence of the scenario's purpose.
+func (s scenario) summary() string {
+	if i := strings.Index(s.purpose, ". "); i >= 0 {
+		return s.purpose[:i+1]
+	}
+	return s.purpose
+}
+
+// runScenarios implements the scenarios subcommand, which lists, describes, and
+// prints the scenarios built into the binary.
+func runScenarios(args []string) {
+	usage := func() {
+		fmt.Println("Usage: httptimeout scenarios list")
+		fmt.Println("       httptimeout scenarios describe <name>")
+		fmt.Println("       httptimeout scenarios show <name>   (print the config, to save and edit)")
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	scenarios, err := readScenarios()
+	if err != nil {
+		fmt.Println(red("failed to read scenarios:"), err)
+		os.Exit(1)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, s := range scenarios {
+			fmt.Printf("%-24s %s\n", s.name, s.summary())
+		}
+		return
+	case (args[0] == "describe" || args[0] == "show") && len(args) == 2:
+	default:
+		usage()
+	}
+
+	name := strings.TrimSuffix(args[1], ".txt")
+	for _, s := range scenarios {
+		if s.name != name {
+			continue
+		}
+		if args[0] == "show" {
+			os.Stdout.Write(s.config)
+		} else {
+			describeScenario(s)
+		}
+		return
+	}
+	fmt.Printf(red("no scenario named %q; see \"httptimeout scenarios list\"\n"), name)
+	os.Exit(1)
+}
+
+// describeScenario prints the scenario's purpose and the settings it runs with.
+func describeScenario(s scenario) {
+	fmt.Println(cyan(s.name))
+	fmt.Println()
+	fmt.Println(wrapText(s.purpose, 80))
+	fmt.Println()
+
+	params, err := parseConfig(bytes.NewReader(s.config))
+	if err != nil {
+		fmt.Println(red("the scenario's config doesn't parse:"), err)
+		return
+	}
+	settings := params.settings()
+	var keys []string
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := settings[k]
+		if k == "request" {
+			// The whole request can be long, like with oversized headers
+			v, _, _ = strings.Cut(v, "\r\n")
+		}
+		fmt.Printf("  %-26s %s\n", k+":", v)
+	}
+	for _, h := range params.headers {
+		if h.isSleep() {
+			fmt.Printf("  %-26s %v\n", "header sleep:", h.sleep)
+		}
+	}
+	if params.body != "" {
+		fmt.Printf("  %-26s %d bytes\n", "body:", len(params.body))
+	}
+	fmt.Printf("\nto run it: httptimeout scenarios show %s > %s.txt && httptimeout %s.txt\n", s.name, s.name, s.name)
+}
+
+// wrapText wraps s into lines no longer than width, at spaces.
+func wrapText(s string, width int) string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	return strings.Join(append(lines, line), "\n")
+}
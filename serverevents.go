@@ -0,0 +1,77 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// serverEventsTimeout is how long to wait for the server's events.
+const serverEventsTimeout = 10 * time.Second
+
+// timelineEvent is an event on the client's or server's side of the connection.
+type timelineEvent struct {
+	At     time.Time `json:"at"`
+	Event  string    `json:"event"`
+	server bool
+}
+
+// printMergedTimeline fetches the server's events for the connection from eventsURL
+// (the example server's /events) and prints them interleaved with the client's. The
+// two clocks are assumed to agree, as they do when both run on the same machine.
+func printMergedTimeline(conn *conn, readErr error, eventsURL string) {
+	u, err := url.Parse(eventsURL)
+	if err != nil {
+		fmt.Println(red("bad ServerEvents URL:"), err)
+		return
+	}
+	q := u.Query()
+	q.Set("client", conn.c.LocalAddr().String())
+	u.RawQuery = q.Encode()
+
+	client := http.Client{Timeout: serverEventsTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		fmt.Println(red("failed to fetch server events:"), err)
+		return
+	}
+	defer resp.Body.Close()
+	var timeline []timelineEvent
+	if err := json.NewDecoder(resp.Body).Decode(&timeline); err != nil {
+		fmt.Println(red("failed to decode server events:"), err)
+		return
+	}
+	for i := range timeline {
+		timeline[i].server = true
+	}
+
+	add := func(t time.Time, event string) {
+		if !t.IsZero() {
+			timeline = append(timeline, timelineEvent{At: t, Event: event})
+		}
+	}
+	add(conn.connectTime, "connected")
+	add(conn.firstWriteTime, "first request byte sent")
+	add(conn.requestSentTime, "whole request sent")
+	add(conn.firstByteTime, "first response byte received")
+	add(conn.lastReadTime, "last response byte received")
+	if readErr != nil {
+		add(conn.readEndTime, fmt.Sprintf("read ended: %v", readErr))
+	}
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].At.Before(timeline[j].At) })
+
+	fmt.Println(cyan("merged timeline (client on the left, server on the right; assumes the clocks agree):"))
+	for _, e := range timeline {
+		at := fmt.Sprintf("%10v", e.At.Sub(conn.connectTime).Round(time.Millisecond))
+		if e.server {
+			fmt.Printf("%s %40s %s\n", at, "", yellow(e.Event))
+		} else {
+			fmt.Printf("%s %s\n", at, e.Event)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// signingKeys returns the secrets that HMAC and SigV4 sign with, from the
+// environment, or an error if one they need isn't set.
+func (p testParams) signingKeys() (hmacSecret string, creds awsCredentials, err error) {
+	if p.hmacHeader != "" {
+		if hmacSecret = os.Getenv(p.hmacSecretEnv); hmacSecret == "" {
+			return "", creds, fmt.Errorf("HMAC needs the secret in $%s", p.hmacSecretEnv)
+		}
+	}
+	if p.sigV4Region != "" {
+		creds = awsCredentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if creds.accessKey == "" || creds.secretKey == "" {
+			return "", creds, fmt.Errorf("SigV4 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	}
+	return hmacSecret, creds, nil
+}
+
+// signed returns p with the signature headers that HMAC and SigV4 ask for added to
+// the end of its head, computed over the request as it will be sent at now.
+func (p testParams) signed(now time.Time) (testParams, error) {
+	if p.hmacHeader == "" && p.sigV4Region == "" {
+		return p, nil
+	}
+	secret, creds, err := p.signingKeys()
+	if err != nil {
+		return p, err
+	}
+	p.headers = append([]header(nil), p.headers...)
+
+	if p.hmacHeader != "" {
+		sig := p.hmacPrefix + hex.EncodeToString(hmacSHA256([]byte(secret), p.body))
+		p.headers = append(p.headers, header{val: p.hmacHeader + ": " + sig})
+	}
+
+	if p.sigV4Region != "" {
+		method, target := p.requestLine()
+		host := p.host
+		for _, h := range p.headers {
+			if name, value, ok := strings.Cut(h.val, ":"); h.isLine() && ok && strings.EqualFold(strings.TrimSpace(name), "host") {
+				host = strings.TrimSpace(value)
+			}
+		}
+		headers := sigV4Headers(creds, p.sigV4Region, p.sigV4Service, method, target, host, p.body, now)
+		for _, h := range headers {
+			p.headers = append(p.headers, header{val: h})
+		}
+	}
+	return p, nil
+}
+
+// awsCredentials are the credentials that SigV4 signs with, as the AWS CLI takes
+// them from the environment.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// sigV4Headers returns the header lines that sign a request with AWS Signature
+// Version 4: X-Amz-Date, any X-Amz-Security-Token and X-Amz-Content-Sha256 (which S3
+// requires), and Authorization. target is the path and query from the request line,
+// as sent; host is the Host header.
+func sigV4Headers(creds awsCredentials, region, service, method, target, host, body string, now time.Time) []string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", amzDate[:8], region, service)
+	payloadHash := sha256Hex(body)
+
+	signedHeaders := map[string]string{"host": host, "x-amz-date": amzDate}
+	res := []string{"X-Amz-Date: " + amzDate}
+	if creds.sessionToken != "" {
+		signedHeaders["x-amz-security-token"] = creds.sessionToken
+		res = append(res, "X-Amz-Security-Token: "+creds.sessionToken)
+	}
+	if service == "s3" {
+		signedHeaders["x-amz-content-sha256"] = payloadHash
+		res = append(res, "X-Amz-Content-Sha256: "+payloadHash)
+	}
+	var names []string
+	for name := range signedHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(signedHeaders[name]))
+	}
+
+	path, query, _ := strings.Cut(target, "?")
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		sigV4CanonicalPath(path, service),
+		sigV4CanonicalQuery(query),
+		canonicalHeaders.String(),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), amzDate[:8])
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return append(res, fmt.Sprintf("Authorization: AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, strings.Join(names, ";"), signature))
+}
+
+// sigV4CanonicalPath is the path of a request as SigV4 signs it. The path is already
+// encoded as sent, and every service but S3 encodes it again.
+func sigV4CanonicalPath(path, service string) string {
+	if service == "s3" {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = awsURIEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sigV4CanonicalQuery is the query string of a request as SigV4 signs it: each
+// parameter encoded the AWS way, sorted by encoded name and then by encoded value.
+// (Sorting the "name=value" strings instead would put "a-b=1" before "a=2".)
+func sigV4CanonicalQuery(query string) string {
+	if query == "" {
+		return ""
+	}
+	var params [][2]string
+	for _, kv := range strings.Split(query, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		if dk, err := url.QueryUnescape(k); err == nil {
+			k = dk
+		}
+		if dv, err := url.QueryUnescape(v); err == nil {
+			v = dv
+		}
+		params = append(params, [2]string{awsURIEncode(k), awsURIEncode(v)})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, len(params))
+	for i, kv := range params {
+		pairs[i] = kv[0] + "=" + kv[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters, as SigV4
+// requires (unlike url.QueryEscape, which turns spaces into "+").
+func awsURIEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
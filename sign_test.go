@@ -0,0 +1,57 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The requests and signatures are from AWS's SigV4 test suite
+// (https://docs.aws.amazon.com/general/latest/gr/signature-v4-test-suite.html).
+func TestSigV4Headers(t *testing.T) {
+	creds := awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name, method, target, signature string
+	}{
+		{"get-vanilla", "GET", "/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-empty-query-key", "GET", "/?Param1=value1", "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+		{"get-vanilla-query-order-key", "GET", "/?Param1=value2&Param1=Value1", "eedbc4e291e521cf13422ffca22be7d2eb8146eecf653089df300a15b2382bd1"},
+		{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"get-vanilla-query-order-value", "GET", "/?Param1=value2&Param1=value1", "5772eed61e12b33fae39ee5e7012498b51d56abc0abb7c60486157bd471c4694"},
+		{"get-vanilla-utf8-query", "GET", "/?ሴ=bar", "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04"},
+		{"post-vanilla", "POST", "/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"post-vanilla-query", "POST", "/?Param1=value1", "28038455d6de14eafc1f9222cf5aa6f1a96197d7deb8263271d420d138af7f11"},
+	}
+	for _, tt := range tests {
+		headers := sigV4Headers(creds, "us-east-1", "service", tt.method, tt.target, "example.amazonaws.com", "", now)
+		want := "Authorization: AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+		if got := headers[len(headers)-1]; got != want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, want)
+		}
+		if headers[0] != "X-Amz-Date: 20150830T123600Z" {
+			t.Errorf("%s: first header = %q", tt.name, headers[0])
+		}
+	}
+}
+
+func TestSigV4CanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"", ""},
+		{"Param2=value2&Param1=value1", "Param1=value1&Param2=value2"},
+		{"Param1=value2&Param1=Value1", "Param1=Value1&Param1=value2"},
+		// sorted by name before value, although "a-b=1" < "a=2"
+		{"a-b=1&a=2", "a=2&a-b=1"},
+		{"a=2&a=10", "a=10&a=2"},
+		{"q=a+b&x=%7E", "q=a%20b&x=~"},
+		{"flag", "flag="},
+	}
+	for _, tt := range tests {
+		if got := sigV4CanonicalQuery(tt.query); got != tt.want {
+			t.Errorf("sigV4CanonicalQuery(%q) = %q; want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// snippetServers are the servers that -snippets can write settings for.
+var snippetServers = []string{"go", "nginx", "envoy"}
+
+// parseSnippetServers parses the -snippets value: a comma-separated list of
+// snippetServers, or "all".
+func parseSnippetServers(s string) ([]string, error) {
+	if s == "all" {
+		return snippetServers, nil
+	}
+	var servers []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, k := range snippetServers {
+			known = known || name == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown server %q; want all, or some of %s", name, strings.Join(snippetServers, ", "))
+		}
+		servers = append(servers, name)
+	}
+	return servers, nil
+}
+
+// measuredTimeout is what an audit found for one probe, for a snippet.
+type measuredTimeout struct {
+	// d is the timeout seen, rounded; zero if none was
+	d time.Duration
+	// seen is set if the probe ran and saw a timeout
+	seen bool
+	// failed is set if the probe didn't run
+	failed bool
+}
+
+// comment says why there's no measurement, for a comment beside the setting; ""
+// if there is one.
+func (m measuredTimeout) comment(bound time.Duration) string {
+	switch {
+	case m.failed:
+		return "not measured (the probe failed)"
+	case !m.seen:
+		return fmt.Sprintf("none seen within %v", bound)
+	default:
+		return ""
+	}
+}
+
+// snippetTimeouts collects the timeouts in r by probe name. Measurements are rounded
+// to the second (or to 100ms under a second), since the probes aren't any more
+// precise than that and a config would say 10s rather than 10.003s.
+func snippetTimeouts(r auditResult) map[string]measuredTimeout {
+	timeouts := map[string]measuredTimeout{}
+	for _, f := range r.findings {
+		m := measuredTimeout{failed: f.err != nil, seen: f.err == nil && f.after != 0}
+		if m.seen {
+			m.d = f.after.Round(time.Second)
+			if f.after < time.Second {
+				m.d = f.after.Round(100 * time.Millisecond)
+			}
+		}
+		timeouts[f.probe] = m
+	}
+	return timeouts
+}
+
+// printSnippets prints, for each of servers, the settings that would make a server
+// behave as the audit found r's target to. bound is the longest each probe waited,
+// which is as long as a timeout could be seen.
+func printSnippets(r auditResult, servers []string, bound time.Duration) {
+	fmt.Printf("settings that would reproduce what was seen at %s:\n", r.target)
+	if r.cdn != nil {
+		fmt.Println(yellow(fmt.Sprintf("  (these are %s's edge timeouts, not the origin's)", r.cdn.name)))
+	}
+	timeouts := snippetTimeouts(r)
+	for _, server := range servers {
+		fmt.Println()
+		var lines []string
+		switch server {
+		case "go":
+			lines = goSnippet(timeouts, bound)
+		case "nginx":
+			lines = nginxSnippet(timeouts, bound)
+		case "envoy":
+			lines = envoySnippet(timeouts, bound)
+		}
+		for _, l := range lines {
+			fmt.Println("  " + l)
+		}
+	}
+	fmt.Println()
+}
+
+// goSnippet is an http.Server literal. The body probe stalls right after quickly sent
+// headers, so what it sees is close to the whole ReadTimeout.
+func goSnippet(timeouts map[string]measuredTimeout, bound time.Duration) []string {
+	lines := []string{"// Go", "srv := &http.Server{"}
+	field := func(name, probe string) {
+		m := timeouts[probe]
+		if m.failed {
+			lines = append(lines, fmt.Sprintf("\t// %s: %s", name, m.comment(bound)))
+			return
+		}
+		// Aligned as gofmt would
+		l := fmt.Sprintf("\t%-18s %s,", name+":", goDuration(m.d))
+		if c := m.comment(bound); c != "" {
+			l += " // " + c
+		}
+		lines = append(lines, l)
+	}
+	field("ReadHeaderTimeout", "header read timeout")
+	field("ReadTimeout", "body read timeout")
+	field("WriteTimeout", "response write timeout")
+	field("IdleTimeout", "idle timeout")
+	if timeouts["idle timeout"].seen {
+		lines = append(lines, "\t// the idle timeout is an upper bound; see the audit's bracket")
+	}
+	return append(lines, "}")
+}
+
+// goDuration writes d as a Go expression.
+func goDuration(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "0"
+	case d%time.Second == 0:
+		return fmt.Sprintf("%d * time.Second", d/time.Second)
+	default:
+		return fmt.Sprintf("%d * time.Millisecond", d/time.Millisecond)
+	}
+}
+
+// nginxSnippet is nginx http (or server) block directives. nginx has no way to turn
+// these timeouts off, so one that wasn't seen is left as a comment.
+func nginxSnippet(timeouts map[string]measuredTimeout, bound time.Duration) []string {
+	lines := []string{"# nginx (http or server block)"}
+	directive := func(name, probe string) {
+		m := timeouts[probe]
+		if !m.seen {
+			lines = append(lines, fmt.Sprintf("# %s: %s; nginx can't turn it off, so set it longer than that", name, m.comment(bound)))
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%s %s;", name, configDuration(m.d)))
+	}
+	directive("client_header_timeout", "header read timeout")
+	directive("client_body_timeout", "body read timeout")
+	directive("send_timeout", "response write timeout")
+	directive("keepalive_timeout", "idle timeout")
+	return lines
+}
+
+// envoySnippet is fields of an HttpConnectionManager, where 0s turns a timeout off.
+// Envoy has one stream_idle_timeout for a stalled request body and a stalled
+// response alike, so it's taken from the body probe.
+func envoySnippet(timeouts map[string]measuredTimeout, bound time.Duration) []string {
+	lines := []string{"# Envoy (HttpConnectionManager)"}
+	field := func(indent, name, probe string) {
+		m := timeouts[probe]
+		if m.failed {
+			lines = append(lines, fmt.Sprintf("%s# %s: %s", indent, name, m.comment(bound)))
+			return
+		}
+		l := fmt.Sprintf("%s%s: %s", indent, name, configDuration(m.d))
+		if c := m.comment(bound); c != "" {
+			l += "  # " + c
+		}
+		lines = append(lines, l)
+	}
+	field("", "request_headers_timeout", "header read timeout")
+	field("", "stream_idle_timeout", "body read timeout")
+	if w, b := timeouts["response write timeout"], timeouts["body read timeout"]; !w.failed && w.d != b.d {
+		seen := configDuration(w.d)
+		if !w.seen {
+			seen = fmt.Sprintf("none within %v", bound)
+		}
+		lines = append(lines, fmt.Sprintf("# stream_idle_timeout also covers a client that stops reading, where the audit saw %s", seen))
+	}
+	lines = append(lines, "common_http_protocol_options:")
+	field("  ", "idle_timeout", "idle timeout")
+	return lines
+}
+
+// configDuration writes d as nginx and Envoy both take it, like 10s or 500ms.
+func configDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
@@ -0,0 +1,64 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// socketQueueSizes are the bytes waiting in a socket's kernel queues.
+type socketQueueSizes struct {
+	// send is what we've written that the server hasn't acknowledged yet, of which
+	// unsent hasn't even been put on the wire
+	send   int
+	unsent int
+	// recv is what has arrived that we haven't read
+	recv int
+}
+
+// printSocketState prints the sizes of the connection's kernel queues at phase (like
+// "end of headers"). A write returns once the kernel has the bytes, not the server,
+// so this shows how much of what was timed as sent was still sitting in our send
+// queue. Nothing is printed where the sizes aren't available.
+func printSocketState(conn *conn, phase string) {
+	q, err := socketQueues(conn.sc)
+	if err != nil {
+		return
+	}
+	fmt.Printf(cyan("socket queues at %s: %d bytes unacknowledged in our send queue (%d unsent), %d unread in our receive queue\n"),
+		phase, q.send, q.unsent, q.recv)
+	if q.send > 0 {
+		fmt.Printf(yellow("the server hadn't acknowledged our last %d bytes yet, so they may not have reached it by this point\n"), q.send)
+	}
+}
+
+// sendDrainPoll is how often the send queue is checked while waiting for it to drain.
+const sendDrainPoll = time.Millisecond
+
+// sendDrainMax is how long to wait for the send queue to drain.
+const sendDrainMax = 10 * time.Second
+
+// printSendDrain waits for the server to acknowledge everything we've written, and
+// reports how long that took after our last write. With a send buffer bigger than a
+// byte, the last write can return seconds before the server has the body, so this is
+// when the request really arrived. Response bytes that come in meanwhile are kept for
+// slowRead. Nothing is printed where the queue sizes aren't available.
+func printSendDrain(conn *conn) {
+	q, err := socketQueues(conn.sc)
+	if err != nil {
+		return
+	}
+	for q.send > 0 && time.Since(conn.lastWriteTime) < sendDrainMax && conn.writeErr == nil {
+		readDuring(conn, sendDrainPoll)
+		if q, err = socketQueues(conn.sc); err != nil {
+			return
+		}
+	}
+	took := time.Since(conn.lastWriteTime).Round(time.Microsecond)
+	if q.send > 0 {
+		fmt.Printf(yellow("%d request bytes still unacknowledged %v after our last write\n"), q.send, took)
+		return
+	}
+	fmt.Printf(cyan("the server had acknowledged the whole request by %v after our last write\n"), took)
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReceiveBuffer sets SO_RCVBUF on a socket that hasn't connected yet.
+func setReceiveBuffer(rc syscall.RawConn, size int) error {
+	var sysErr error
+	err := rc.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// setMaxSegment isn't available: Windows has no TCP_MAXSEG to set.
+func setMaxSegment(rc syscall.RawConn, size int) error {
+	return errors.New("TCP_MAXSEG can't be set on Windows")
+}
+
+func maxSegment(sc syscall.Conn) (int, error) {
+	return 0, errors.New("TCP_MAXSEG can't be read on Windows")
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import "syscall"
+
+// setReceiveBuffer sets SO_RCVBUF on a socket that hasn't connected yet.
+func setReceiveBuffer(rc syscall.RawConn, size int) error {
+	var sysErr error
+	err := rc.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// setMaxSegment sets TCP_MAXSEG on a socket that hasn't connected yet, which caps the
+// MSS we advertise in the SYN as well as the size of the segments we send.
+func setMaxSegment(rc syscall.RawConn, size int) error {
+	var sysErr error
+	err := rc.Control(func(fd uintptr) {
+		sysErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, size)
+	})
+	if err != nil {
+		return err
+	}
+	return sysErr
+}
+
+// maxSegment gets the MSS of a connected socket: the smaller of ours and the
+// server's, less any TCP options.
+func maxSegment(sc syscall.Conn) (int, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mss int
+	var sysErr error
+	err = rc.Control(func(fd uintptr) {
+		mss, sysErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mss, sysErr
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// siocOutqNSD is SIOCOUTQNSD, which isn't in package syscall: the bytes in the send
+// queue that haven't been sent yet.
+const siocOutqNSD = 0x894B
+
+// socketQueues returns the sizes of the socket's kernel queues.
+func socketQueues(sc syscall.Conn) (socketQueueSizes, error) {
+	var q socketQueueSizes
+	var sysErr error
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return q, err
+	}
+	err = rc.Control(func(fd uintptr) {
+		for _, req := range []struct {
+			op  uintptr
+			res *int
+		}{
+			{syscall.TIOCOUTQ, &q.send},
+			{siocOutqNSD, &q.unsent},
+			{syscall.TIOCINQ, &q.recv},
+		} {
+			var n int32
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req.op, uintptr(unsafe.Pointer(&n))); errno != 0 {
+				sysErr = errno
+				return
+			}
+			*req.res = int(n)
+		}
+	})
+	if err != nil {
+		return q, err
+	}
+	return q, sysErr
+}
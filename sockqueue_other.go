@@ -0,0 +1,14 @@
+//go:build !linux
+
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func socketQueues(sc syscall.Conn) (socketQueueSizes, error) {
+	return socketQueueSizes{}, errors.New("socket queue sizes are only available on Linux")
+}
@@ -0,0 +1,135 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdPrefix starts the name of every metric sent.
+const statsdPrefix = "httptimeout."
+
+// statsdClient sends metrics to a StatsD server over UDP, with tags in the DogStatsD
+// format that Datadog's agent understands (plain StatsD servers ignore them).
+type statsdClient struct {
+	conn net.Conn
+	// tags go on every metric, like "env:prod"
+	tags []string
+}
+
+// newStatsdClient returns a client that sends to addr (host:port) with tags, a
+// comma-separated list like "env:prod,team:web".
+func newStatsdClient(addr, tags string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &statsdClient{conn: conn}
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.tags = append(c.tags, t)
+		}
+	}
+	return c, nil
+}
+
+func (c *statsdClient) close() {
+	c.conn.Close()
+}
+
+// timing sends a measured duration, like how long a phase of the request took.
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	c.send(name, fmt.Sprintf("%.3f|ms", float64(d)/float64(time.Millisecond)), tags)
+}
+
+// gauge sends a detected value, like a timeout, in milliseconds.
+func (c *statsdClient) gauge(name string, d time.Duration, tags ...string) {
+	c.send(name, fmt.Sprintf("%.3f|g", float64(d)/float64(time.Millisecond)), tags)
+}
+
+// send sends one metric. UDP makes it fire-and-forget, so errors are printed but
+// otherwise ignored, and metrics can be lost.
+func (c *statsdClient) send(name, value string, tags []string) {
+	line := statsdPrefix + name + ":" + value
+	if all := append(append([]string(nil), c.tags...), tags...); len(all) > 0 {
+		line += "|#" + strings.Join(all, ",")
+	}
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		fmt.Println(red("failed to send metric:"), err)
+	}
+}
+
+// statsdTag makes a tag from a name and value, replacing characters that have a
+// meaning in the DogStatsD format.
+func statsdTag(name, value string) string {
+	return name + ":" + strings.NewReplacer(",", "_", "|", "_", " ", "_", "#", "_").Replace(value)
+}
+
+// sendRunMetrics sends the phase durations of a run of the configured request. Phases
+// that didn't happen, like reading a response that never came, are left out.
+func sendRunMetrics(params testParams, conn *conn, startTime, headerTime, bodyTime time.Time) {
+	c, err := newStatsdClient(params.statsd, params.statsdTags)
+	if err != nil {
+		fmt.Println(red("StatsD connection failed:"), err)
+		return
+	}
+	defer c.close()
+
+	host := statsdTag("host", params.host)
+	c.timing("phase.headers", headerTime.Sub(startTime), host)
+	c.timing("phase.body", bodyTime.Sub(headerTime), host)
+	if !conn.firstByteTime.IsZero() {
+		if ttfb := conn.firstByteTime.Sub(bodyTime); ttfb >= 0 {
+			c.timing("phase.ttfb", ttfb, host)
+		}
+		c.timing("phase.response", conn.lastReadTime.Sub(conn.firstByteTime), host)
+	}
+	if !conn.readEndTime.IsZero() {
+		// The close is timed from the last read or write, whichever came later
+		last := conn.lastWriteTime
+		if conn.lastReadTime.After(last) {
+			last = conn.lastReadTime
+		}
+		c.timing("phase.close", conn.readEndTime.Sub(last), host)
+	}
+}
+
+// sendIdleMetrics sends the idle timeout found by bracketIdleTimeout, as the middle of
+// its bracket. Nothing is sent if no timeout was found.
+func sendIdleMetrics(params testParams, alive, dead time.Duration) {
+	if dead == 0 {
+		return
+	}
+	c, err := newStatsdClient(params.statsd, params.statsdTags)
+	if err != nil {
+		fmt.Println(red("StatsD connection failed:"), err)
+		return
+	}
+	defer c.close()
+	c.gauge("idle_timeout", alive+(dead-alive)/2, statsdTag("host", params.host))
+}
+
+// sendAuditMetrics sends the timeout that each audit probe found.
+func sendAuditMetrics(addr, tags string, results []auditResult) {
+	c, err := newStatsdClient(addr, tags)
+	if err != nil {
+		fmt.Println(red("StatsD connection failed:"), err)
+		return
+	}
+	defer c.close()
+	for _, r := range results {
+		for _, f := range r.findings {
+			if f.err != nil || f.after == 0 {
+				continue
+			}
+			tags := []string{statsdTag("target", r.target), statsdTag("probe", f.probe)}
+			for name, value := range r.tags {
+				tags = append(tags, statsdTag(name, value))
+			}
+			c.gauge("audit.timeout", f.after, tags...)
+		}
+	}
+}
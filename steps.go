@@ -0,0 +1,244 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// run is the state of sending the configured request and reading its response,
+// which steps act on in turn.
+type run struct {
+	params testParams
+	conn   *conn
+	// eol returns the line ending for the next line of the request head
+	eol func() string
+	// err is set once the request has been interrupted (or stopped by StopAfter);
+	// steps that send the request are skipped after that
+	err error
+
+	startTime  time.Time
+	headerTime time.Time
+	bodyTime   time.Time
+	// readErr is the error that ended the response read (see slowRead)
+	readErr error
+}
+
+// step is one action in running the request. The built-in steps send the request
+// head, sleep, send the body, and read the response; configs can add more with
+// "step" lines (see stepTypes).
+type step interface {
+	run(r *run)
+}
+
+// stepType makes steps from the arguments of a "step <name> <args>" config line.
+// Those lines go among the header lines, to run at that point in the request head,
+// or among the byte-sleeps, to run after the headers and before the body.
+type stepType struct {
+	usage string
+	parse func(args string) (step, error)
+}
+
+// stepTypes are the custom step types that configs can use, by name. New kinds of
+// step are added with registerStepType, from an init function, without touching the
+// request loop. Steps write to an HTTP/1.1 connection; they can't carry HTTP/2, which
+// needs its own connection handling (see the README).
+var stepTypes = map[string]stepType{}
+
+// registerStepType adds a custom step type. It panics if name is taken.
+func registerStepType(name, usage string, parse func(args string) (step, error)) {
+	if _, ok := stepTypes[name]; ok {
+		panic("step type registered twice: " + name)
+	}
+	stepTypes[name] = stepType{usage: usage, parse: parse}
+}
+
+// parseStep parses the rest of a "step" config line.
+func parseStep(s string) (step, error) {
+	name, args, _ := strings.Cut(strings.TrimSpace(s), " ")
+	t, ok := stepTypes[name]
+	if !ok {
+		var names []string
+		for n := range stepTypes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no step type %q (there are %s)", name, strings.Join(names, ", "))
+	}
+	st, err := t.parse(strings.TrimSpace(args))
+	if err != nil {
+		return nil, fmt.Errorf("step %s: %w (usage: step %s %s)", name, err, name, t.usage)
+	}
+	return st, nil
+}
+
+// requestSteps is the pipeline that sends params' request and reads the response.
+func requestSteps(params testParams) []step {
+	steps := []step{phaseStep{"headers"}}
+	gotContentLength := false
+	for _, h := range params.headers {
+		switch {
+		case h.isSleep():
+			steps = append(steps, sleepStep{h.sleep, explainHeaderRead})
+		case h.step != nil:
+			steps = append(steps, h.step)
+		default:
+			if strings.HasPrefix(strings.ToLower(h.val), "content-length:") {
+				gotContentLength = true
+			}
+			steps = append(steps, writeStep{h.val, true})
+		}
+	}
+	if len(params.trailers) > 0 {
+		// The body is sent chunked, so that the trailers can follow it
+		for _, line := range chunkedHeaders(params.trailers) {
+			steps = append(steps, writeStep{line, true})
+		}
+	} else if !gotContentLength {
+		steps = append(steps, writeStep{fmt.Sprintf("Content-Length: %d", len(params.body)), true})
+	}
+	if params.headerEndSleep != 0 {
+		steps = append(steps, sleepStep{params.headerEndSleep, explainHeaderRead})
+	}
+	if params.stopAfter == "headers" {
+		steps = append(steps, stopStep{"stopping before the end of the headers (StopAfter)"})
+	} else {
+		steps = append(steps, writeStep{"", true})
+	}
+
+	steps = append(steps, phaseStep{"body"})
+	steps = append(steps, params.bodyStartSteps...)
+	if params.bodyStartSleep != 0 {
+		steps = append(steps, sleepStep{params.bodyStartSleep, explainBodyRead})
+	}
+	return append(steps, bodyStep{}, phaseStep{"response"}, readStep{})
+}
+
+// writeStep writes part of the request head. If line is set, the line ending is
+// added.
+type writeStep struct {
+	text string
+	line bool
+}
+
+func (s writeStep) run(r *run) {
+	text := s.text
+	if s.line {
+		text += r.eol()
+	}
+	r.err = write(r.err, r.conn, text)
+}
+
+// sleepStep sleeps partway through sending the request; topic is what to explain if
+// the server ends the connection during it.
+type sleepStep struct {
+	sleep time.Duration
+	topic string
+}
+
+func (s sleepStep) run(r *run) {
+	r.err = flushWrites(r.err, r.conn, false)
+	r.err = requestSleep(r.err, r.conn, s.sleep, s.topic)
+}
+
+// stopStep stops sending the request, for StopAfter.
+type stopStep struct {
+	msg string
+}
+
+func (s stopStep) run(r *run) {
+	r.err = flushWrites(r.err, r.conn, true)
+	if r.err == nil {
+		fmt.Println(timestamp(r.conn) + yellow(s.msg))
+		r.err = errStopAfter
+	}
+}
+
+// phaseStep starts a phase of the request: "headers", "body", or "response". It
+// reports on the phase before, and keypresses apply to the new one.
+type phaseStep struct {
+	phase string
+}
+
+func (s phaseStep) run(r *run) {
+	switch s.phase {
+	case "headers":
+		r.err = startWrites(r.err, r.conn)
+		r.startTime = time.Now()
+	case "body":
+		r.err = flushWrites(r.err, r.conn, false)
+		r.headerTime = time.Now()
+		fmt.Printf(cyan("time to send headers: %v\n"), r.headerTime.Sub(r.startTime))
+		printSocketState(r.conn, "end of headers")
+		fmt.Println()
+	case "response":
+		r.err = flushWrites(r.err, r.conn, true)
+		r.bodyTime = time.Now()
+		fmt.Printf(cyan("time to send body: %v\n"), r.bodyTime.Sub(r.headerTime))
+		printWriteStalls(r.conn)
+		if !r.conn.requestSentTime.IsZero() {
+			printSendDrain(r.conn)
+		}
+		printSocketState(r.conn, "end of body")
+		fmt.Println()
+	}
+	keys.startPhase(s.phase)
+}
+
+// bodyStep sends the body, paced by PerByteBodySleep, with the chunked framing if
+// there are trailers.
+type bodyStep struct{}
+
+func (bodyStep) run(r *run) {
+	params, conn := r.params, r.conn
+	body := []byte(params.body)
+	var chunkHead, chunkTail string
+	if len(params.trailers) > 0 {
+		chunkHead, chunkTail = chunkedFraming(body, params.trailers)
+		if chunkHead != "" {
+			r.err = write(r.err, conn, chunkHead)
+		}
+	}
+	if params.stopAfter == "body" {
+		body = body[:len(body)-1]
+	}
+	if r.err == nil {
+		if !slowWrite(conn, params.perByteBodySleep, body) {
+			fmt.Println(red("\nbody write interrupted"))
+			explain(explainBodyRead)
+		} else if params.stopAfter == "body" {
+			fmt.Println(timestamp(conn) + yellow("stopping before the last body byte (StopAfter)"))
+		} else if chunkTail != "" && write(nil, conn, chunkTail) != nil {
+			fmt.Println(red("trailer write interrupted"))
+		} else if flushWrites(nil, conn, true) != nil {
+			fmt.Println(red("body write interrupted"))
+		} else {
+			conn.requestSentTime = time.Now()
+		}
+	} else if r.err != errStopAfter {
+		fmt.Println("skipping body write")
+	}
+}
+
+// readStep reads the response, paced by PerByteResponseReadSleep. It's attempted no
+// matter if the writing was interrupted.
+type readStep struct{}
+
+func (readStep) run(r *run) {
+	stopAt := 0
+	if r.params.closeAtMaxResponseBytes {
+		stopAt = r.params.maxResponseBytes
+	}
+	if r.params.stopAfter == "first-response-byte" {
+		stopAt = 1
+	}
+	r.readErr = slowRead(r.conn, r.params.perByteResponseReadSleep, stopAt)
+	keys.stop()
+	if r.readErr != nil && r.readErr != io.EOF {
+		fmt.Println(red("response read interrupted"))
+	}
+}
@@ -0,0 +1,134 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tarpitInterval is how often accepted throughput is reported.
+const tarpitInterval = time.Second
+
+// tarpitChunk is how much is written at a time.
+const tarpitChunk = 512
+
+// tarpitMinWindow is the least that a TCP sender can have in flight without the
+// receiver holding it back: the usual initial congestion window of 10 segments.
+const tarpitMinWindow = 14600
+
+// tarpitNetworkShare is the fraction of the network's least throughput (for the RTT)
+// below which the server, not the network, is the limit.
+const tarpitNetworkShare = 0.01
+
+// runTarpitProbe sends the configured request's headers with a body of
+// params.tarpitBytes, written as fast as the server will take it, and reports how
+// fast it's accepted. With our send buffer kept small, a write only completes as the
+// server takes the data, so this shows a server that deliberately accepts slowly
+// (advertising a tiny receive window to punish a client) as distinct from a slow
+// network, which would still allow at least an initial window per round trip.
+func runTarpitProbe(params testParams) {
+	conn, err := dial(params)
+	if err != nil {
+		fmt.Println(red("connection failed:"), err)
+		return
+	}
+	defer conn.c.Close()
+	conn.tcp.SetWriteBuffer(1)
+
+	networkRate := float64(tarpitMinWindow) / conn.rtt.Seconds()
+	fmt.Printf("sending a %d byte body to %s as fast as it's accepted, for up to %v (connect RTT %v)\n\n",
+		params.tarpitBytes, params.host, params.tarpitMax, conn.rtt)
+
+	var head strings.Builder
+	for _, h := range params.headers {
+		if !h.isLine() || strings.HasPrefix(strings.ToLower(h.val), "content-length:") {
+			continue
+		}
+		head.WriteString(h.val + "\r\n")
+	}
+	fmt.Fprintf(&head, "Content-Length: %d\r\n\r\n", params.tarpitBytes)
+	if _, err := conn.c.Write([]byte(head.String())); err != nil {
+		fmt.Println(red("header write failed:"), err)
+		return
+	}
+
+	chunk := []byte(strings.Repeat("x", tarpitChunk))
+	start := time.Now()
+	var rates []float64
+	sent := 0
+	var writeErr error
+	for sent < params.tarpitBytes && writeErr == nil && time.Since(start) < params.tarpitMax {
+		intervalStart := time.Now()
+		deadline := intervalStart.Add(tarpitInterval)
+		conn.c.SetWriteDeadline(deadline)
+		accepted := 0
+		for sent < params.tarpitBytes && time.Now().Before(deadline) {
+			b := chunk
+			if rest := params.tarpitBytes - sent; rest < len(b) {
+				b = b[:rest]
+			}
+			n, err := conn.c.Write(b)
+			accepted += n
+			sent += n
+			if err != nil {
+				if !isTimeout(err) {
+					writeErr = err
+				}
+				break
+			}
+		}
+		rate := float64(accepted) / time.Since(intervalStart).Seconds()
+		rates = append(rates, rate)
+		fmt.Printf("[%8.3fs] %7d bytes accepted (%s)\n", time.Since(start).Seconds(), accepted, formatRate(rate))
+	}
+	conn.c.SetWriteDeadline(time.Time{})
+	fmt.Println()
+
+	took := time.Since(start)
+	if writeErr != nil {
+		fmt.Printf(cyan("server %s after accepting %d bytes in %v\n"), describeEnd(writeErr), sent, took.Round(time.Millisecond))
+	}
+	avg := float64(sent) / took.Seconds()
+	fmt.Printf(cyan("accepted %d of %d bytes in %v: %s on average; the network (RTT %v) allows at least %s\n"),
+		sent, params.tarpitBytes, took.Round(time.Millisecond), formatRate(avg), conn.rtt, formatRate(networkRate))
+
+	// The first interval includes filling the socket buffers on both ends, so it's
+	// left out unless it's all there is
+	steady := rates
+	if len(steady) > 1 {
+		steady = steady[1:]
+	}
+	var trickle, stalled int
+	for _, r := range steady {
+		switch {
+		case r == 0:
+			stalled++
+		case r < tarpitNetworkShare*networkRate:
+			trickle++
+		}
+	}
+	switch {
+	case sent == params.tarpitBytes && trickle == 0:
+		fmt.Println(cyan("no tarpit: the body was accepted at the speed the network allows"))
+	case stalled == len(steady):
+		fmt.Println(yellow("the server stopped accepting data altogether (it stopped reading), rather than trickling it in"))
+	case trickle+stalled == len(steady):
+		fmt.Println(yellow("looks like a tarpit: the server is accepting data far slower than the network allows"))
+	default:
+		fmt.Println(yellow("the server accepted data in bursts, sometimes far slower than the network allows; it may be reading slowly"))
+	}
+}
+
+// formatRate formats a throughput in bytes per second.
+func formatRate(bytesPerSec float64) string {
+	switch {
+	case bytesPerSec >= 1<<20:
+		return fmt.Sprintf("%.1f MB/s", bytesPerSec/(1<<20))
+	case bytesPerSec >= 1<<10:
+		return fmt.Sprintf("%.1f KB/s", bytesPerSec/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", bytesPerSec)
+	}
+}
@@ -0,0 +1,148 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the functions that config templates can use, on top of
+// text/template's own (like len and printf).
+var templateFuncs = template.FuncMap{
+	"now":        func() time.Time { return time.Now().UTC() },
+	"nonce":      func() (string, error) { return randomHex(16) },
+	"uuid":       randomUUID,
+	"env":        os.Getenv,
+	"sha256":     sha256Hex,
+	"hmacSHA256": func(key, s string) string { return hex.EncodeToString(hmacSHA256([]byte(key), s)) },
+	"base64":     func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+}
+
+// templateData is what config templates can refer to, like {{len .Body}}.
+type templateData struct {
+	Host string
+	// Body is the request body, after its own templates are expanded
+	Body string
+	// Baseline is the headers of the response to the baseline request, if there was
+	// one, for values that depend on it (like {{.Baseline.Get "ETag"}})
+	Baseline textproto.MIMEHeader
+}
+
+// hasTemplate is true if s uses the template syntax.
+func hasTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// parseTemplate parses s as a config template.
+func parseTemplate(s string) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(s)
+}
+
+// expandTemplate expands the template s with data.
+func expandTemplate(s string, data templateData) (string, error) {
+	t, err := parseTemplate(s)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// literalBracesHint is how to send a literal "{{", for errors about templates that
+// were likely never meant to be templates.
+const literalBracesHint = `to send a literal "{{", write {{"{{"}}`
+
+// checkTemplates reports the first template in p's header lines and body that
+// doesn't parse, so that mistakes show up before connecting.
+func (p testParams) checkTemplates() error {
+	for _, h := range p.headers {
+		if h.isLine() && hasTemplate(h.val) {
+			if _, err := parseTemplate(h.val); err != nil {
+				return fmt.Errorf("bad template in header line %q (%s): %w", h.val, literalBracesHint, err)
+			}
+		}
+	}
+	if hasTemplate(p.body) {
+		if _, err := parseTemplate(p.body); err != nil {
+			return fmt.Errorf("bad template in body (%s): %w", literalBracesHint, err)
+		}
+	}
+	return nil
+}
+
+// expanded returns p with the templates in its header lines and body expanded, and
+// then signed (see signed). It's done just before each request is sent, so that
+// timestamps, nonces, and signatures are fresh. baselineHead is the head of the
+// baseline response, if there was one.
+func (p testParams) expanded(baselineHead []byte) (testParams, error) {
+	data := templateData{Host: p.host}
+	if len(baselineHead) > 0 {
+		tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(baselineHead)))
+		if _, err := tp.ReadLine(); err == nil {
+			data.Baseline, _ = tp.ReadMIMEHeader()
+		}
+	}
+
+	var err error
+	if hasTemplate(p.body) {
+		if p.body, err = expandTemplate(p.body, data); err != nil {
+			return p, fmt.Errorf("body template failed: %w", err)
+		}
+	}
+	if p.stopAfter == "body" && p.body == "" {
+		// parseConfig could only check the body before it was expanded
+		return p, fmt.Errorf("StopAfter: body needs a body, but the body template expanded to nothing")
+	}
+	data.Body = p.body
+
+	p.headers = append([]header(nil), p.headers...)
+	for i, h := range p.headers {
+		if h.isLine() && hasTemplate(h.val) {
+			if p.headers[i].val, err = expandTemplate(h.val, data); err != nil {
+				return p, fmt.Errorf("template in header line %q failed: %w", h.val, err)
+			}
+		}
+	}
+	return p.signed(time.Now())
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// randomUUID returns a random (version 4) UUID.
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
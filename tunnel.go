@@ -0,0 +1,127 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// tunnelStartTimeout is how long to wait for a tunnel to start forwarding.
+const tunnelStartTimeout = 15 * time.Second
+
+// tunnel is a process (like ssh or kubectl) forwarding a local port to the target.
+type tunnel struct {
+	cmd *exec.Cmd
+	// exited is closed when the process exits
+	exited chan struct{}
+}
+
+// startSSHTunnel runs the ssh command to forward a local port to the target of params
+// through bastion (like user@bastion.example.com), and returns params changed to dial
+// that port. Authentication is left to ssh, so the agent, keys, and ~/.ssh/config
+// all work as usual.
+//
+// What we see is then the local ssh client's connection, not the target's: the RTT
+// is local, and the bastion turns the target's RST into a plain close.
+func startSSHTunnel(params testParams, bastion string) (testParams, *tunnel, error) {
+	target := params.host
+	if params.dialHost != "" {
+		target = params.dialHost
+	}
+	return startTunnel(params, fmt.Sprintf("%s through %s", target, bastion), func(localHost, localPort string) *exec.Cmd {
+		return exec.Command("ssh", "-N", "-o", "ExitOnForwardFailure=yes", "-L", net.JoinHostPort(localHost, localPort)+":"+target, bastion)
+	})
+}
+
+// startK8sTunnel runs kubectl port-forward (with the local kubeconfig) to the
+// Kubernetes service or pod given as namespace/service:port or
+// namespace/pod/name:port, and returns params changed to dial the forwarded port. If
+// params has no host, it's set to the service's in-cluster name, for the Host header
+// and SNI. As with ssh, what we see is kubectl's connection, not the target's.
+func startK8sTunnel(params testParams, target string) (testParams, *tunnel, error) {
+	ref, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return params, nil, fmt.Errorf("bad Kubernetes target %q; want namespace/service:port or namespace/pod/name:port", target)
+	}
+	parts := strings.Split(ref, "/")
+	var namespace, kind, name string
+	switch len(parts) {
+	case 2:
+		namespace, kind, name = parts[0], "svc", parts[1]
+	case 3:
+		namespace, kind, name = parts[0], parts[1], parts[2]
+	}
+	if namespace == "" || name == "" || (kind != "svc" && kind != "pod") {
+		return params, nil, fmt.Errorf("bad Kubernetes target %q; want namespace/service:port or namespace/pod/name:port", target)
+	}
+
+	if params.host == "" {
+		if kind == "svc" {
+			params.host = net.JoinHostPort(name+"."+namespace+".svc", port)
+		} else {
+			params.host = net.JoinHostPort(name, port)
+		}
+	}
+	return startTunnel(params, fmt.Sprintf("%s/%s in namespace %s", kind, name, namespace), func(localHost, localPort string) *exec.Cmd {
+		return exec.Command("kubectl", "port-forward", "-n", namespace, "--address", localHost, kind+"/"+name, localPort+":"+port)
+	})
+}
+
+// startTunnel runs the command made by cmdFor to forward a free local port, waits for
+// it to start listening, and returns params changed to dial that port.
+func startTunnel(params testParams, desc string, cmdFor func(localHost, localPort string) *exec.Cmd) (testParams, *tunnel, error) {
+	// Find a free local port for the tunnel to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return params, nil, err
+	}
+	local := l.Addr().String()
+	l.Close()
+	localHost, localPort, _ := net.SplitHostPort(local)
+
+	cmd := cmdFor(localHost, localPort)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return params, nil, fmt.Errorf("failed to run %s: %w", cmd.Path, err)
+	}
+	t := &tunnel{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(t.exited)
+	}()
+
+	// Wait for the forward to be listening. This connection is forwarded to the target
+	// too, but it's closed before anything is sent.
+	deadline := time.Now().Add(tunnelStartTimeout)
+	for {
+		select {
+		case <-t.exited:
+			return params, nil, fmt.Errorf("tunnel to %s exited: %v", desc, cmd.ProcessState)
+		default:
+		}
+		if c, err := net.DialTimeout("tcp", local, time.Second); err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.close()
+			return params, nil, fmt.Errorf("tunnel to %s didn't start forwarding within %v", desc, tunnelStartTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fmt.Printf(cyan("tunnelling to %s (local %s); timing is of the tunnel, and a reset by the target shows as a close\n"), desc, local)
+	params.dialHost = local
+	return params, t, nil
+}
+
+// close stops the tunnel.
+func (t *tunnel) close() {
+	t.cmd.Process.Kill()
+	<-t.exited
+}
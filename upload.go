@@ -0,0 +1,74 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// uploadKeyData is what an upload URI's template can refer to, like
+// s3://bucket/{{.Target}}/{{.Time}}-{{.Name}}.
+type uploadKeyData struct {
+	// Target is the target's host:port made safe for a key (like
+	// api.example.com_443), or the inventory file's name for an audit of several
+	Target string
+	// Time is when the run started, in UTC, like 20221003T154501Z
+	Time string
+	// Name is the base name of the file being uploaded, like audit.sarif
+	Name string
+}
+
+// uploadKeyUnsafe matches the characters left out of a target in a key.
+var uploadKeyUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// validUploadURI checks that an upload URI is for a supported store and that its
+// template parses.
+func validUploadURI(uri string) error {
+	if !strings.HasPrefix(uri, "s3://") && !strings.HasPrefix(uri, "gs://") {
+		return fmt.Errorf("want an s3:// or gs:// URI, got %q", uri)
+	}
+	if _, err := template.New("").Option("missingkey=error").Parse(uri); err != nil {
+		return fmt.Errorf("bad template in upload URI %q: %w", uri, err)
+	}
+	return nil
+}
+
+// uploadResult copies the result file filename to object storage at uri, after
+// expanding its template for target. It uses the aws or gcloud command, so their
+// usual credentials apply, and reports the outcome rather than failing the run.
+func uploadResult(uri, filename, target string) {
+	var sb strings.Builder
+	t := template.Must(template.New("").Option("missingkey=error").Parse(uri))
+	err := t.Execute(&sb, uploadKeyData{
+		Target: uploadKeyUnsafe.ReplaceAllString(target, "_"),
+		Time:   runStartTime.UTC().Format("20060102T150405Z"),
+		Name:   filepath.Base(filename),
+	})
+	if err != nil {
+		fmt.Println(red("upload failed:"), err)
+		return
+	}
+	dest := sb.String()
+	if strings.HasSuffix(dest, "/") {
+		dest += filepath.Base(filename)
+	}
+
+	var cmd *exec.Cmd
+	if strings.HasPrefix(dest, "s3://") {
+		cmd = exec.Command("aws", "s3", "cp", "--only-show-errors", filename, dest)
+	} else {
+		cmd = exec.Command("gcloud", "storage", "cp", filename, dest)
+	}
+	start := time.Now()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf(red("upload of %s to %s failed: %v: %s\n"), filename, dest, err, strings.TrimSpace(string(out)))
+		return
+	}
+	fmt.Printf(cyan("%s uploaded to %s in %v\n"), filename, dest, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,146 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wizardProbe is a timeout that the init wizard can write a config for.
+type wizardProbe struct {
+	name string
+	desc string
+	// config returns the config for target (host:port), path, and the longest the
+	// timeout is expected to be
+	config func(target, path string, bound time.Duration) string
+}
+
+var wizardProbes = []wizardProbe{
+	{"header", "header read timeout: headers sent with a long pause partway through", func(target, path string, bound time.Duration) string {
+		return fmt.Sprintf("%s\n\nGET %s HTTP/1.1\nHost: %s\nsleep %v\nUser-Agent: httptimeout\n", target, path, target, bound)
+	}},
+	{"body", "body read timeout: a long pause before the body", func(target, path string, bound time.Duration) string {
+		return fmt.Sprintf("%s\n\nPOST %s HTTP/1.1\nHost: %s\nContent-Type: text/plain\n\nBodyStartSleep: %v\n\nhello\n", target, path, target, bound)
+	}},
+	{"steady-body", "whole-request timeout: a body sent steadily, a byte at a time, for longer than the bound", func(target, path string, bound time.Duration) string {
+		const bodyLen = 40
+		return fmt.Sprintf("%s\n\nPOST %s HTTP/1.1\nHost: %s\nContent-Type: text/plain\n\nPerByteBodySleep: %v\n\n%s\n",
+			target, path, target, (bound / bodyLen * 5 / 4).Round(time.Millisecond), strings.Repeat("x", bodyLen))
+	}},
+	{"stalled-reader", "response write timeout: the response read very slowly (the path should give a large response)", func(target, path string, bound time.Duration) string {
+		return fmt.Sprintf("%s\n\nGET %s HTTP/1.1\nHost: %s\n\nPerByteResponseReadSleep: 1s\nReceiveBuffer: 1\nMaxResponseBytes: 4096\n", target, path, target)
+	}},
+	{"idle", "keep-alive idle timeout: bracketed with HEAD requests on idle connections", func(target, path string, bound time.Duration) string {
+		return fmt.Sprintf("%s\n\nHEAD %s HTTP/1.1\nHost: %s\n\nIdleProbe: 1s %v\n", target, path, target, bound)
+	}},
+	{"audit", "all of them at once (prints an audit command instead of writing a config)", nil},
+}
+
+// runWizard implements the init subcommand, which asks what to test and writes a
+// ready-to-run config for it. args are the command line arguments after "init".
+func runWizard(args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: httptimeout init [config-file.txt]")
+		os.Exit(2)
+	}
+	w := wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+
+	target := w.ask("target host:port", "localhost:8585", func(s string) error {
+		if !strings.Contains(s, ":") {
+			return fmt.Errorf("include the port, like example.com:443")
+		}
+		return nil
+	})
+	path := w.ask("path", "/", func(s string) error {
+		if !strings.HasPrefix(s, "/") {
+			return fmt.Errorf("the path must start with /")
+		}
+		return nil
+	})
+
+	fmt.Fprintln(w.out, "\nwhich timeout?")
+	for i, p := range wizardProbes {
+		fmt.Fprintf(w.out, "  %d. %-15s %s\n", i+1, p.name, p.desc)
+	}
+	var probe wizardProbe
+	w.ask("number or name", "1", func(s string) error {
+		for i, p := range wizardProbes {
+			if s == p.name || s == strconv.Itoa(i+1) {
+				probe = p
+				return nil
+			}
+		}
+		return fmt.Errorf("pick one of 1-%d", len(wizardProbes))
+	})
+
+	var bound time.Duration
+	w.ask("longest you expect the timeout to be", "1m", func(s string) (err error) {
+		if bound, err = time.ParseDuration(s); err == nil && bound <= 0 {
+			err = fmt.Errorf("it must be positive")
+		}
+		return err
+	})
+	fmt.Fprintln(w.out)
+
+	if probe.config == nil {
+		fmt.Fprintf(w.out, "run: httptimeout audit -bound %v -path %s %s\n", bound*5/4, path, target)
+		return
+	}
+	filename := probe.name + ".txt"
+	if len(args) == 1 {
+		filename = args[0]
+	}
+	config := fmt.Sprintf("# %s, against %s (written by httptimeout init)\n", probe.desc, target) + probe.config(target, path, bound)
+	if err := writeNewFile(filename, config); err != nil {
+		fmt.Println(red("failed to write config:"), err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(w.out, cyan("wrote %s; run: httptimeout %s\n"), filename, filename)
+}
+
+// writeNewFile writes content to filename, which mustn't exist already.
+func writeNewFile(filename, content string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// wizard asks questions on the terminal.
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask asks question until the answer (or def, if it's left blank) passes check, and
+// returns it. If the input ends, the program exits.
+func (w wizard) ask(question, def string, check func(string) error) string {
+	for {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+		line, err := w.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(w.out)
+			os.Exit(1)
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintln(w.out, yellow(err.Error()))
+			continue
+		}
+		return answer
+	}
+}
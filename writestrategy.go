@@ -0,0 +1,110 @@
+/* Copyright 2022 Adam Pritchard. Licensed under Apache License 2.0. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// The write strategies, which decide how the request's writes become syscalls and
+// packets. A middlebox sees the packets, so the same pacing can look quite different
+// to it depending on the strategy.
+const (
+	// writeEach makes a write syscall for each write: each header line, and each
+	// body byte
+	writeEach = "each"
+	// writeBuffered collects writes and makes one syscall for them at each sleep
+	// (and at the end of the headers, body, and request)
+	writeBuffered = "buffered"
+	// writeCork makes a syscall for each write, with TCP_CORK set so that the kernel
+	// holds them, and uncorks at each sleep (Linux only)
+	writeCork = "cork"
+)
+
+// describeWriteStrategy describes a write strategy for the report.
+func describeWriteStrategy(strategy string) string {
+	switch strategy {
+	case writeBuffered:
+		return "writes are buffered and sent in one syscall at each sleep"
+	case writeCork:
+		return "a syscall per write, with TCP_CORK holding them in the kernel until each sleep"
+	default:
+		return "a syscall per write (each header line, and each body byte)"
+	}
+}
+
+// startWrites prepares conn for the request's writes, as its write strategy has it.
+func startWrites(currErr error, conn *conn) error {
+	if currErr != nil || conn.writeStrategy != writeCork {
+		return currErr
+	}
+	if err := setCork(conn.sc, true); err != nil {
+		return fmt.Errorf("failed to set TCP_CORK: %w", err)
+	}
+	return nil
+}
+
+// flushWrites sends what the write strategy has held back: the buffered writes, or
+// what TCP_CORK is holding. It's called at each sleep, before anything that waits on
+// the server, and at the end of each phase of the request; if done is set, it's the
+// last time for the request.
+func flushWrites(currErr error, conn *conn, done bool) error {
+	if currErr != nil {
+		return currErr
+	}
+	switch conn.writeStrategy {
+	case writeBuffered:
+		if len(conn.pending) == 0 {
+			return nil
+		}
+		var before recordMark
+		if conn.traceRecords {
+			before = conn.raw.written
+		}
+		n, blocked, err := sendPending(conn)
+		if n > 0 {
+			note := fmt.Sprintf("(sent %d buffered bytes in one write)", n)
+			if blocked > 0 {
+				note += yellow(fmt.Sprintf(" (write blocked %v)", blocked.Round(time.Millisecond)))
+			}
+			fmt.Println(timestamp(conn) + cyan(note))
+			if conn.traceRecords {
+				fmt.Println(timestamp(conn) + cyan(describeRecords(conn, before, n, 1)))
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	case writeCork:
+		if err := setCork(conn.sc, false); err != nil {
+			return fmt.Errorf("failed to clear TCP_CORK: %w", err)
+		}
+		if !done {
+			if err := setCork(conn.sc, true); err != nil {
+				return fmt.Errorf("failed to set TCP_CORK: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sendPending writes what the buffered strategy is holding, in one syscall. blocked
+// is how long the write blocked, if it did.
+func sendPending(conn *conn) (n int, blocked time.Duration, err error) {
+	b := conn.pending
+	conn.pending = nil
+	start := time.Now()
+	n, err = conn.c.Write(b)
+	if n > 0 {
+		if took, ok := recordWrite(conn, start, time.Now(), n); ok {
+			blocked = took
+		}
+	}
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	return n, blocked, err
+}